@@ -0,0 +1,187 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/iamtraining/gallery/models"
+)
+
+const usage = `usage: gallery [flags] [command]
+
+commands:
+  (none)                start the web server
+  migrate up            apply all pending migrations
+  migrate down          revert the last applied migration
+  migrate status        list migrations and whether they are applied
+  images backfill       generate missing thumbnails and renditions
+  images reconcile      list images of galleries that no longer exist
+  images reconcile -delete
+                        delete them
+  users delete <id|email>
+                        delete a user with their galleries, images and
+                        sessions
+  users disable-2fa <id|email>
+                        turn off two-factor authentication for a user who
+                        lost their authenticator app and recovery codes
+  users role <id|email> <role>
+                        give a user the role user, moderator or admin`
+
+func runCommand(serv *models.Services, args []string) error {
+	switch args[0] {
+	case "migrate":
+		return runMigrate(serv, args[1:])
+	case "images":
+		return runImages(serv, args[1:])
+	case "users":
+		return runUsers(serv, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+func runMigrate(serv *models.Services, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%s", usage)
+	}
+
+	switch args[0] {
+	case "up":
+		done, err := serv.MigrateUp()
+		for _, m := range done {
+			fmt.Printf("applied %d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			fmt.Println("nothing to migrate")
+		}
+	case "down":
+		m, err := serv.MigrateDown()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("reverted %d_%s\n", m.Version, m.Name)
+	case "status":
+		status, err := serv.MigrationStatus()
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range status {
+			appliedAt := "pending"
+			if s.Applied {
+				appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command %q\n%s", args[0], usage)
+	}
+
+	return nil
+}
+
+func runImages(serv *models.Services, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s", usage)
+	}
+
+	switch args[0] {
+	case "backfill":
+		n, err := serv.Img.BackfillRenditions()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("generated renditions for %d images\n", n)
+	case "reconcile":
+		fs := flag.NewFlagSet("images reconcile", flag.ContinueOnError)
+		remove := fs.Bool("delete", false, "delete the orphaned images")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		orphans, err := serv.OrphanedImgGalleries(*remove)
+		for _, id := range orphans {
+			if *remove {
+				fmt.Printf("deleted images of gallery %d\n", id)
+			} else {
+				fmt.Printf("gallery %d no longer exists but has images\n", id)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if len(orphans) == 0 {
+			fmt.Println("no orphaned images")
+		}
+	default:
+		return fmt.Errorf("unknown images command %q\n%s", args[0], usage)
+	}
+
+	return nil
+}
+
+func runUsers(serv *models.Services, args []string) error {
+	want := 2
+	if len(args) > 0 && args[0] == "role" {
+		want = 3
+	}
+	if len(args) != want {
+		return fmt.Errorf("%s", usage)
+	}
+
+	switch args[0] {
+	case "delete":
+		user, err := findUser(serv, args[1])
+		if err != nil {
+			return err
+		}
+
+		if err := serv.DeleteUser(user.ID); err != nil {
+			return err
+		}
+		fmt.Printf("deleted user %d (%s)\n", user.ID, user.Email)
+	case "disable-2fa":
+		user, err := findUser(serv, args[1])
+		if err != nil {
+			return err
+		}
+
+		if err := serv.TwoFactor.Disable(user.ID); err != nil {
+			return err
+		}
+		fmt.Printf("turned off two-factor authentication for user %d (%s)\n", user.ID, user.Email)
+	case "role":
+		user, err := findUser(serv, args[1])
+		if err != nil {
+			return err
+		}
+
+		user.Role = args[2]
+		if err := serv.User.Update(user); err != nil {
+			return err
+		}
+		fmt.Printf("user %d (%s) is now a %s\n", user.ID, user.Email, user.Role)
+	default:
+		return fmt.Errorf("unknown users command %q\n%s", args[0], usage)
+	}
+
+	return nil
+}
+
+// findUser looks a user up by ID or, if arg is not a number, by email.
+func findUser(serv *models.Services, arg string) (*models.User, error) {
+	if id, err := strconv.ParseUint(arg, 10, 64); err == nil {
+		return serv.User.ByID(uint(id))
+	}
+
+	return serv.User.ByEmail(arg)
+}
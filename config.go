@@ -0,0 +1,637 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/iamtraining/gallery/email"
+	"github.com/iamtraining/gallery/hash"
+	"github.com/iamtraining/gallery/idp"
+	"github.com/iamtraining/gallery/middleware"
+	"github.com/iamtraining/gallery/models"
+	"github.com/iamtraining/gallery/ratelimit"
+	"github.com/iamtraining/gallery/storage"
+)
+
+const (
+	envDev  = "dev"
+	envProd = "prod"
+
+	devPepper  = "secret-random-string"
+	devHMACKey = "secret-hmac-key"
+)
+
+type PostgresConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Name     string `json:"name"`
+	SSLMode  string `json:"sslmode"`
+}
+
+func (c PostgresConfig) Dialect() string {
+	return "postgres"
+}
+
+func (c PostgresConfig) ConnectionInfo() string {
+	info := fmt.Sprintf("host=%s port=%d user=%s dbname=%s sslmode=%s",
+		c.Host, c.Port, c.User, c.Name, c.SSLMode)
+	if c.Password != "" {
+		info += fmt.Sprintf(" password=%s", c.Password)
+	}
+
+	return info
+}
+
+func DefaultPostgresConfig() PostgresConfig {
+	return PostgresConfig{
+		Host:     "localhost",
+		Port:     5432,
+		User:     "postgres",
+		Password: "1111",
+		Name:     "gallery_dev",
+		SSLMode:  "disable",
+	}
+}
+
+type UploadConfig struct {
+	// MaxFileSize is the largest image accepted, in bytes.
+	MaxFileSize int64 `json:"max_file_size"`
+	// MaxRequestSize caps the whole multipart request, in bytes.
+	MaxRequestSize int64 `json:"max_request_size"`
+	// MaxPixels is the largest width times height accepted. A small file
+	// can claim huge dimensions, and decoding it takes memory for every
+	// pixel.
+	MaxPixels int64 `json:"max_pixels"`
+}
+
+func DefaultUploadConfig() UploadConfig {
+	return UploadConfig{
+		MaxFileSize:    10 << 20,
+		MaxRequestSize: 50 << 20,
+		MaxPixels:      50000000,
+	}
+}
+
+const (
+	storageLocal = "local"
+	storageS3    = "s3"
+)
+
+type StorageConfig struct {
+	// Backend is either "local" or "s3".
+	Backend string           `json:"backend"`
+	Local   LocalConfig      `json:"local"`
+	S3      storage.S3Config `json:"s3"`
+}
+
+type LocalConfig struct {
+	Dir string `json:"dir"`
+}
+
+func DefaultStorageConfig() StorageConfig {
+	return StorageConfig{
+		Backend: storageLocal,
+		Local: LocalConfig{
+			Dir: "images",
+		},
+	}
+}
+
+func (c StorageConfig) Open() (storage.Storage, error) {
+	switch c.Backend {
+	case storageLocal:
+		return storage.NewLocal(c.Local.Dir), nil
+	case storageS3:
+		return storage.NewS3(c.S3)
+	default:
+		return nil, fmt.Errorf("config: unknown storage backend %q", c.Backend)
+	}
+}
+
+const (
+	emailLog  = "log"
+	emailSMTP = "smtp"
+)
+
+type EmailConfig struct {
+	// Backend is either "smtp" or "log", which writes the messages to
+	// LogFile, or to stdout if it is empty.
+	Backend string           `json:"backend"`
+	From    string           `json:"from"`
+	LogFile string           `json:"log_file"`
+	SMTP    email.SMTPConfig `json:"smtp"`
+}
+
+func DefaultEmailConfig() EmailConfig {
+	return EmailConfig{
+		Backend: emailLog,
+		From:    "Gallery <no-reply@localhost>",
+	}
+}
+
+func (c EmailConfig) Open() (email.Sender, error) {
+	switch c.Backend {
+	case emailLog:
+		if c.LogFile == "" {
+			return email.NewLog(os.Stdout, c.From), nil
+		}
+
+		f, err := os.OpenFile(c.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		return email.NewLog(f, c.From), nil
+	case emailSMTP:
+		return email.NewSMTP(c.SMTP, c.From)
+	default:
+		return nil, fmt.Errorf("config: unknown email backend %q", c.Backend)
+	}
+}
+
+// Duration is a time.Duration written as a string such as "720h" in the
+// config file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"24h\": %v", err)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type SessionConfig struct {
+	// Secure marks the session and CSRF cookies as HTTPS only.
+	Secure bool `json:"secure"`
+	// SameSite is "lax", "strict" or "none".
+	SameSite string `json:"same_site"`
+	Domain   string `json:"domain"`
+	// AbsoluteTimeout ends a session this long after sign in, no matter
+	// how active it is.
+	AbsoluteTimeout Duration `json:"absolute_timeout"`
+	// IdleTimeout ends a session that has not been used for this long.
+	IdleTimeout Duration `json:"idle_timeout"`
+	// RenewInterval is how old a session token gets before it is replaced.
+	RenewInterval Duration `json:"renew_interval"`
+}
+
+func DefaultSessionConfig() SessionConfig {
+	return SessionConfig{
+		SameSite:        "lax",
+		AbsoluteTimeout: Duration(30 * 24 * time.Hour),
+		IdleTimeout:     Duration(7 * 24 * time.Hour),
+		RenewInterval:   Duration(24 * time.Hour),
+	}
+}
+
+func (c SessionConfig) Timeouts() models.SessionTimeouts {
+	return models.SessionTimeouts{
+		Absolute: time.Duration(c.AbsoluteTimeout),
+		Idle:     time.Duration(c.IdleTimeout),
+		Renew:    time.Duration(c.RenewInterval),
+	}
+}
+
+func (c SessionConfig) Cookie() *middleware.SessionCookie {
+	return &middleware.SessionCookie{
+		Domain:   c.Domain,
+		Secure:   c.Secure,
+		SameSite: sameSiteModes[c.SameSite],
+	}
+}
+
+var sameSiteModes = map[string]http.SameSite{
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+type LimitConfig struct {
+	// Burst is how many attempts can be made at once.
+	Burst int `json:"burst"`
+	// Refill is how long it takes to get one attempt back.
+	Refill Duration `json:"refill"`
+}
+
+func (c LimitConfig) Limit() ratelimit.Limit {
+	return ratelimit.Limit{
+		Burst:  c.Burst,
+		Refill: time.Duration(c.Refill),
+	}
+}
+
+// RateLimitConfig throttles the login, signup and password reset forms.
+type RateLimitConfig struct {
+	Enabled bool `json:"enabled"`
+	// IP limits the requests to these forms from one IP address.
+	IP LimitConfig `json:"ip"`
+	// LoginFailures locks an email address out after this many failed
+	// logins, for Refill per failure over the limit.
+	LoginFailures LimitConfig `json:"login_failures"`
+	// ResetEmails limits the password reset emails to one address.
+	ResetEmails LimitConfig `json:"reset_emails"`
+}
+
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Enabled: true,
+		IP: LimitConfig{
+			Burst:  20,
+			Refill: Duration(30 * time.Second),
+		},
+		LoginFailures: LimitConfig{
+			Burst:  5,
+			Refill: Duration(15 * time.Minute),
+		},
+		ResetEmails: LimitConfig{
+			Burst:  3,
+			Refill: Duration(time.Hour),
+		},
+	}
+}
+
+func (c LimitConfig) valid() bool {
+	return c.Burst > 0 && c.Refill > 0
+}
+
+// MaxIdle is how long it takes until the bucket of every limit is full
+// again. Buckets idle for longer can be dropped without loosening a limit.
+func (c RateLimitConfig) MaxIdle() time.Duration {
+	var max time.Duration
+	for _, l := range []LimitConfig{c.IP, c.LoginFailures, c.ResetEmails} {
+		if full := time.Duration(l.Burst) * time.Duration(l.Refill); full > max {
+			max = full
+		}
+	}
+
+	return max
+}
+
+type Config struct {
+	Env  string `json:"env"`
+	Port int    `json:"port"`
+	// BaseURL is where the site is reachable from outside, it is used for
+	// the links in emails.
+	BaseURL string `json:"base_url"`
+	// Pepper and HMACKey are the single secrets of older configs. They are
+	// used with the empty ID, after Peppers and HMACKeys.
+	Pepper  string `json:"pepper"`
+	HMACKey string `json:"hmac_key"`
+	// Peppers and HMACKeys list the secrets by ID, the current one first.
+	// To rotate a secret, put a new one with a new ID in front and keep the
+	// old one until it is no longer used.
+	Peppers  []hash.Key `json:"peppers"`
+	HMACKeys []hash.Key `json:"hmac_keys"`
+	LogSQL   bool       `json:"log_sql"`
+	// RequireVerifiedEmail keeps users from creating galleries and
+	// uploading images until they confirmed their email address.
+	RequireVerifiedEmail bool `json:"require_verified_email"`
+	// AutoMigrate applies pending migrations when the server starts. In prod
+	// migrations are expected to be run explicitly with "migrate up".
+	AutoMigrate bool            `json:"auto_migrate"`
+	Database    PostgresConfig  `json:"database"`
+	Upload      UploadConfig    `json:"upload"`
+	Storage     StorageConfig   `json:"storage"`
+	Session     SessionConfig   `json:"session"`
+	Email       EmailConfig     `json:"email"`
+	RateLimit   RateLimitConfig `json:"rate_limit"`
+	// OIDC lists the OpenID Connect providers users can log in with.
+	OIDC []idp.OIDCConfig `json:"oidc"`
+}
+
+func (c Config) IsProd() bool {
+	return c.Env == envProd
+}
+
+func (c Config) Addr() string {
+	return fmt.Sprintf(":%d", c.Port)
+}
+
+// DefaultConfig returns the settings of the given profile before any file or
+// environment overrides are applied. The prod profile deliberately has no
+// secrets or database credentials.
+func DefaultConfig(env string) Config {
+	switch env {
+	case envProd:
+		return Config{
+			Env:                  envProd,
+			Port:                 3000,
+			RequireVerifiedEmail: true,
+			Database: PostgresConfig{
+				Host:    "localhost",
+				Port:    5432,
+				SSLMode: "require",
+			},
+			Upload:    DefaultUploadConfig(),
+			Storage:   DefaultStorageConfig(),
+			Session:   prodSessionConfig(),
+			Email:     prodEmailConfig(),
+			RateLimit: DefaultRateLimitConfig(),
+		}
+	default:
+		return Config{
+			Env:         envDev,
+			Port:        3000,
+			BaseURL:     "http://localhost:3000",
+			Pepper:      devPepper,
+			HMACKey:     devHMACKey,
+			LogSQL:      true,
+			AutoMigrate: true,
+			Database:    DefaultPostgresConfig(),
+			Upload:      DefaultUploadConfig(),
+			Storage:     DefaultStorageConfig(),
+			Session:     DefaultSessionConfig(),
+			Email:       DefaultEmailConfig(),
+			RateLimit:   DefaultRateLimitConfig(),
+		}
+	}
+}
+
+func prodSessionConfig() SessionConfig {
+	c := DefaultSessionConfig()
+	c.Secure = true
+
+	return c
+}
+
+// prodEmailConfig sends real emails; logging them would put reset links in
+// the server logs.
+func prodEmailConfig() EmailConfig {
+	c := DefaultEmailConfig()
+	c.Backend = emailSMTP
+	c.From = ""
+
+	return c
+}
+
+// LoadConfig builds the configuration for env from the profile defaults,
+// the JSON file at path and GALLERY_* environment variables, in that order.
+// The file is optional in dev and required in prod.
+func LoadConfig(env, path string) (Config, error) {
+	if env != envDev && env != envProd {
+		return Config{}, fmt.Errorf("config: unknown profile %q", env)
+	}
+
+	c := DefaultConfig(env)
+
+	f, err := os.Open(path)
+	switch {
+	case err == nil:
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(&c); err != nil {
+			return Config{}, fmt.Errorf("config: parsing %s: %v", path, err)
+		}
+		c.Env = env
+	case os.IsNotExist(err) && env == envDev:
+	default:
+		return Config{}, err
+	}
+
+	if err := c.applyEnv(); err != nil {
+		return Config{}, err
+	}
+
+	if err := c.validate(); err != nil {
+		return Config{}, err
+	}
+
+	return c, nil
+}
+
+func (c *Config) applyEnv() error {
+	strs := map[string]*string{
+		"GALLERY_PEPPER":               &c.Pepper,
+		"GALLERY_HMAC_KEY":             &c.HMACKey,
+		"GALLERY_DB_HOST":              &c.Database.Host,
+		"GALLERY_DB_USER":              &c.Database.User,
+		"GALLERY_DB_PASSWORD":          &c.Database.Password,
+		"GALLERY_DB_NAME":              &c.Database.Name,
+		"GALLERY_DB_SSLMODE":           &c.Database.SSLMode,
+		"GALLERY_STORAGE":              &c.Storage.Backend,
+		"GALLERY_S3_ENDPOINT":          &c.Storage.S3.Endpoint,
+		"GALLERY_S3_REGION":            &c.Storage.S3.Region,
+		"GALLERY_S3_BUCKET":            &c.Storage.S3.Bucket,
+		"GALLERY_S3_ACCESS_KEY_ID":     &c.Storage.S3.AccessKeyID,
+		"GALLERY_S3_SECRET_ACCESS_KEY": &c.Storage.S3.SecretAccessKey,
+		"GALLERY_SESSION_SAME_SITE":    &c.Session.SameSite,
+		"GALLERY_SESSION_DOMAIN":       &c.Session.Domain,
+		"GALLERY_BASE_URL":             &c.BaseURL,
+		"GALLERY_EMAIL":                &c.Email.Backend,
+		"GALLERY_EMAIL_FROM":           &c.Email.From,
+		"GALLERY_EMAIL_LOG_FILE":       &c.Email.LogFile,
+		"GALLERY_SMTP_HOST":            &c.Email.SMTP.Host,
+		"GALLERY_SMTP_USERNAME":        &c.Email.SMTP.Username,
+		"GALLERY_SMTP_PASSWORD":        &c.Email.SMTP.Password,
+	}
+	for key, dst := range strs {
+		if v, ok := os.LookupEnv(key); ok {
+			*dst = v
+		}
+	}
+
+	ints := map[string]*int{
+		"GALLERY_PORT":      &c.Port,
+		"GALLERY_DB_PORT":   &c.Database.Port,
+		"GALLERY_SMTP_PORT": &c.Email.SMTP.Port,
+	}
+	for key, dst := range ints {
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("config: %s must be a number: %v", key, err)
+		}
+		*dst = n
+	}
+
+	int64s := map[string]*int64{
+		"GALLERY_UPLOAD_MAX_FILE_SIZE":    &c.Upload.MaxFileSize,
+		"GALLERY_UPLOAD_MAX_REQUEST_SIZE": &c.Upload.MaxRequestSize,
+		"GALLERY_UPLOAD_MAX_PIXELS":       &c.Upload.MaxPixels,
+	}
+	for key, dst := range int64s {
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("config: %s must be a number: %v", key, err)
+		}
+		*dst = n
+	}
+
+	bools := map[string]*bool{
+		"GALLERY_LOG_SQL":                &c.LogSQL,
+		"GALLERY_REQUIRE_VERIFIED_EMAIL": &c.RequireVerifiedEmail,
+		"GALLERY_RATE_LIMIT":             &c.RateLimit.Enabled,
+		"GALLERY_SESSION_SECURE":         &c.Session.Secure,
+	}
+	for key, dst := range bools {
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("config: %s must be a boolean: %v", key, err)
+		}
+		*dst = b
+	}
+
+	durations := map[string]*Duration{
+		"GALLERY_SESSION_ABSOLUTE_TIMEOUT": &c.Session.AbsoluteTimeout,
+		"GALLERY_SESSION_IDLE_TIMEOUT":     &c.Session.IdleTimeout,
+		"GALLERY_SESSION_RENEW_INTERVAL":   &c.Session.RenewInterval,
+	}
+	for key, dst := range durations {
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("config: %s must be a duration: %v", key, err)
+		}
+		*dst = Duration(d)
+	}
+
+	return nil
+}
+
+// IdentityProviders creates the configured identity providers.
+func (c Config) IdentityProviders() ([]idp.Provider, error) {
+	providers := make([]idp.Provider, 0, len(c.OIDC))
+	names := make(map[string]bool, len(c.OIDC))
+	for _, pc := range c.OIDC {
+		if names[pc.Name] {
+			return nil, fmt.Errorf("config: more than one oidc provider is named %q", pc.Name)
+		}
+		names[pc.Name] = true
+
+		p, err := idp.NewOIDC(pc)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+
+	return providers, nil
+}
+
+// PepperKeyring returns the peppers, the current one first.
+func (c Config) PepperKeyring() []hash.Key {
+	return keyring(c.Peppers, c.Pepper)
+}
+
+// HMACKeyring returns the HMAC keys, the current one first.
+func (c Config) HMACKeyring() []hash.Key {
+	return keyring(c.HMACKeys, c.HMACKey)
+}
+
+func keyring(keys []hash.Key, legacy string) []hash.Key {
+	if legacy == "" {
+		return keys
+	}
+
+	return append(keys[:len(keys):len(keys)], hash.Key{Secret: legacy})
+}
+
+func validateKeys(name string, keys []hash.Key, devSecret string, prod bool) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("config: at least one of %s is required", name)
+	}
+
+	ids := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key.Secret == "" {
+			return fmt.Errorf("config: %s %q has no secret", name, key.ID)
+		}
+
+		if ids[key.ID] {
+			return fmt.Errorf("config: %s has more than one key with the ID %q", name, key.ID)
+		}
+		ids[key.ID] = true
+
+		if prod && key.Secret == devSecret {
+			return fmt.Errorf("config: the dev %s must not be used in prod", name)
+		}
+	}
+
+	return nil
+}
+
+func (c Config) validate() error {
+	if err := validateKeys("peppers", c.PepperKeyring(), devPepper, c.IsProd()); err != nil {
+		return err
+	}
+
+	if err := validateKeys("hmac_keys", c.HMACKeyring(), devHMACKey, c.IsProd()); err != nil {
+		return err
+	}
+
+	if c.Database.Name == "" || c.Database.User == "" {
+		return fmt.Errorf("config: database name and user are required")
+	}
+
+	if c.Upload.MaxFileSize <= 0 || c.Upload.MaxRequestSize < c.Upload.MaxFileSize {
+		return fmt.Errorf("config: upload sizes must be positive and max_request_size at least max_file_size")
+	}
+
+	if c.Upload.MaxPixels <= 0 {
+		return fmt.Errorf("config: upload max_pixels must be positive")
+	}
+
+	rl := c.RateLimit
+	if rl.Enabled && !(rl.IP.valid() && rl.LoginFailures.valid() && rl.ResetEmails.valid()) {
+		return fmt.Errorf("config: rate limits need a positive burst and refill")
+	}
+
+	if u, err := url.Parse(c.BaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("config: base_url must be an absolute URL such as https://example.com")
+	}
+
+	if _, ok := sameSiteModes[c.Session.SameSite]; !ok {
+		return fmt.Errorf("config: session same_site must be lax, strict or none")
+	}
+
+	if c.Session.SameSite == "none" && !c.Session.Secure {
+		return fmt.Errorf("config: session same_site none requires secure cookies")
+	}
+
+	s := c.Session
+	if s.IdleTimeout <= 0 || s.AbsoluteTimeout < s.IdleTimeout {
+		return fmt.Errorf("config: session timeouts must be positive and absolute_timeout at least idle_timeout")
+	}
+
+	if s.RenewInterval < Duration(5*time.Minute) || s.RenewInterval > s.IdleTimeout {
+		return fmt.Errorf("config: session renew_interval must be between 5m and idle_timeout")
+	}
+
+	return nil
+}
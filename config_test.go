@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iamtraining/gallery/hash"
+)
+
+func TestKeyring(t *testing.T) {
+	keys := []hash.Key{{ID: "2", Secret: "new"}, {ID: "1", Secret: "old"}}
+
+	got := keyring(keys, "legacy")
+	if len(got) != 3 || got[0] != keys[0] || got[1] != keys[1] || got[2] != (hash.Key{Secret: "legacy"}) {
+		t.Errorf("keyring() = %v, want the keys then the legacy secret with the empty ID", got)
+	}
+	if len(keys) != 2 {
+		t.Errorf("keyring() changed the configured keys to %v", keys)
+	}
+
+	if got := keyring(keys, ""); len(got) != 2 {
+		t.Errorf("keyring() without a legacy secret = %v, want the keys", got)
+	}
+
+	if got := keyring(nil, "legacy"); len(got) != 1 || got[0].ID != "" || got[0].Secret != "legacy" {
+		t.Errorf("keyring() of an old config = %v, want the legacy secret alone", got)
+	}
+}
+
+func TestValidateKeys(t *testing.T) {
+	cases := []struct {
+		name  string
+		keys  []hash.Key
+		prod  bool
+		valid bool
+	}{
+		{"one key", []hash.Key{{ID: "1", Secret: "s"}}, true, true},
+		{"rotated", []hash.Key{{ID: "2", Secret: "s2"}, {ID: "1", Secret: "s1"}}, true, true},
+		{"none", nil, false, false},
+		{"no secret", []hash.Key{{ID: "1"}}, false, false},
+		{"duplicate ID", []hash.Key{{ID: "1", Secret: "a"}, {ID: "1", Secret: "b"}}, false, false},
+		{"dev secret in dev", []hash.Key{{ID: "1", Secret: devHMACKey}}, false, true},
+		{"dev secret in prod", []hash.Key{{ID: "2", Secret: "s"}, {ID: "1", Secret: devHMACKey}}, true, false},
+	}
+
+	for _, tc := range cases {
+		err := validateKeys("hmac_keys", tc.keys, devHMACKey, tc.prod)
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: validateKeys() = %v, want valid %v", tc.name, err, tc.valid)
+		}
+	}
+}
+
+func TestRateLimitMaxIdle(t *testing.T) {
+	rl := DefaultRateLimitConfig()
+	// 3 reset emails take an hour each to come back
+	if got, want := rl.MaxIdle(), 3*time.Hour; got != want {
+		t.Errorf("MaxIdle() of the defaults = %v, want %v", got, want)
+	}
+
+	rl.ResetEmails = LimitConfig{Burst: 3, Refill: Duration(24 * time.Hour)}
+	if got, want := rl.MaxIdle(), 72*time.Hour; got != want {
+		t.Errorf("MaxIdle() = %v, want %v of the slowest limit", got, want)
+	}
+}
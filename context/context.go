@@ -9,7 +9,10 @@ import (
 type privateKey string
 
 const (
-	userKey privateKey = "user"
+	userKey     privateKey = "user"
+	sessionKey  privateKey = "session"
+	csrfKey     privateKey = "csrf"
+	apiTokenKey privateKey = "api_token"
 )
 
 func WithUser(ctx context.Context, user *models.User) context.Context {
@@ -25,3 +28,46 @@ func GetUser(ctx context.Context) *models.User {
 
 	return nil
 }
+
+func WithSession(ctx context.Context, session *models.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+// GetSession returns the session the current user signed in with.
+func GetSession(ctx context.Context) *models.Session {
+	if v := ctx.Value(sessionKey); v != nil {
+		if session, ok := v.(*models.Session); ok {
+			return session
+		}
+	}
+
+	return nil
+}
+
+func WithAPIToken(ctx context.Context, token *models.APIToken) context.Context {
+	return context.WithValue(ctx, apiTokenKey, token)
+}
+
+// GetAPIToken returns the API token the request was authenticated with,
+// if it did not come from a signed in browser.
+func GetAPIToken(ctx context.Context) *models.APIToken {
+	if v := ctx.Value(apiTokenKey); v != nil {
+		if token, ok := v.(*models.APIToken); ok {
+			return token
+		}
+	}
+
+	return nil
+}
+
+func WithCSRFToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, csrfKey, token)
+}
+
+func GetCSRFToken(ctx context.Context) string {
+	if v, ok := ctx.Value(csrfKey).(string); ok {
+		return v
+	}
+
+	return ""
+}
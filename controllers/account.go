@@ -0,0 +1,244 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/iamtraining/gallery/context"
+	"github.com/iamtraining/gallery/middleware"
+	"github.com/iamtraining/gallery/models"
+	"github.com/iamtraining/gallery/views"
+)
+
+// AccountDeleter deletes a user together with everything they own.
+type AccountDeleter interface {
+	DeleteUser(id uint) error
+}
+
+type AccountForm struct {
+	Name  string `schema:"name"`
+	Email string `schema:"email"`
+}
+
+type PasswordForm struct {
+	Current string `schema:"current_password"`
+	New     string `schema:"new_password"`
+}
+
+type DeleteAccountForm struct {
+	Password string `schema:"password"`
+}
+
+type accountPage struct {
+	Name          string
+	Email         string
+	EmailVerified bool
+	// Providers are the identity providers offered for login. Users who
+	// signed up through one have a password they never saw and are told
+	// how to set one.
+	Providers []providerLink
+}
+
+// GET /account
+func (u *Users) Account(w http.ResponseWriter, r *http.Request) {
+	u.renderAccount(w, r, views.Data{})
+}
+
+// POST /account/profile
+//
+// Changing the email address goes through the same checks as signing up,
+// and the new address has to be confirmed again.
+func (u *Users) UpdateAccount(w http.ResponseWriter, r *http.Request) {
+	var data views.Data
+	var form AccountForm
+
+	if err := parseForm(r, &form); err != nil {
+		data.SetAlert(err)
+		u.renderAccount(w, r, data)
+		return
+	}
+
+	// work on a copy, the user in the context stays as it is stored if the
+	// update is rejected
+	current := context.GetUser(r.Context())
+	user := *current
+	user.Name = form.Name
+	user.Email = form.Email
+
+	if err := u.us.Update(&user); err != nil {
+		data.SetAlert(err)
+		u.renderAccount(w, r, data)
+		return
+	}
+
+	msg := "Your account has been updated."
+	if user.Email != current.Email {
+		if err := u.sendVerification(&user); err != nil {
+			log.Printf("sending verification email to user %d: %v", user.ID, err)
+		}
+		msg += " We sent a link to " + user.Email + " to confirm the new address."
+	}
+
+	*current = user
+	data.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: msg,
+	}
+	u.renderAccount(w, r, data)
+}
+
+// POST /account/password
+//
+// The current password is required, so a session left open on a shared
+// computer is not enough to take over the account. Other sessions are
+// signed out.
+func (u *Users) UpdatePassword(w http.ResponseWriter, r *http.Request) {
+	var data views.Data
+	var form PasswordForm
+
+	if err := parseForm(r, &form); err != nil {
+		data.SetAlert(err)
+		u.renderAccount(w, r, data)
+		return
+	}
+
+	user, wait, err := u.confirmPassword(w, r, form.Current)
+	if wait > 0 {
+		data.CreateErrorAlert(middleware.TooManyAttemptsMsg(wait))
+		u.renderAccountStatus(w, r, http.StatusTooManyRequests, data)
+		return
+	}
+	if err != nil {
+		if err == models.ErrPasswordInvalid {
+			data.CreateErrorAlert("The current password is not correct.")
+		} else {
+			data.SetAlert(err)
+		}
+		u.renderAccount(w, r, data)
+		return
+	}
+
+	if form.New == "" {
+		data.SetAlert(models.ErrPasswordRequired)
+		u.renderAccount(w, r, data)
+		return
+	}
+
+	user.Password = form.New
+	if err := u.us.Update(user); err != nil {
+		data.SetAlert(err)
+		u.renderAccount(w, r, data)
+		return
+	}
+
+	u.signOutOthers(r, user)
+
+	data.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your password has been changed and your other sessions were signed out.",
+	}
+	u.renderAccount(w, r, data)
+}
+
+// POST /account/delete
+func (u *Users) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	var data views.Data
+	var form DeleteAccountForm
+
+	if err := parseForm(r, &form); err != nil {
+		data.SetAlert(err)
+		u.renderAccount(w, r, data)
+		return
+	}
+
+	user, wait, err := u.confirmPassword(w, r, form.Password)
+	if wait > 0 {
+		data.CreateErrorAlert(middleware.TooManyAttemptsMsg(wait))
+		u.renderAccountStatus(w, r, http.StatusTooManyRequests, data)
+		return
+	}
+	if err != nil {
+		if err == models.ErrPasswordInvalid {
+			data.CreateErrorAlert("The password is not correct, your account was not deleted.")
+		} else {
+			data.SetAlert(err)
+		}
+		u.renderAccount(w, r, data)
+		return
+	}
+
+	if err := u.accounts.DeleteUser(user.ID); err != nil {
+		data.SetAlert(err)
+		u.renderAccount(w, r, data)
+		return
+	}
+
+	u.cookie.Clear(w)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func (u *Users) renderAccount(w http.ResponseWriter, r *http.Request, data views.Data) {
+	u.renderAccountStatus(w, r, http.StatusOK, data)
+}
+
+func (u *Users) renderAccountStatus(w http.ResponseWriter, r *http.Request, status int, data views.Data) {
+	user := context.GetUser(r.Context())
+	data.Body = accountPage{
+		Name:          user.Name,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Providers:     u.providers,
+	}
+
+	u.AccountView.RenderStatus(w, r, status, data)
+}
+
+// confirmPassword checks the password the signed in user typed to confirm
+// a change. Wrong passwords count towards the login lockout of their
+// address, so an open session is no way around it. If the address is
+// locked out, wait is how long it stays so and Retry-After is set.
+func (u *Users) confirmPassword(w http.ResponseWriter, r *http.Request, password string) (*models.User, time.Duration, error) {
+	email := context.GetUser(r.Context()).Email
+	key := limitKey(email)
+	if locked, wait, err := u.limits.LoginFailures.Blocked(key); err != nil {
+		log.Printf("login rate limit: %v", err)
+	} else if locked {
+		middleware.SetRetryAfter(w, wait)
+		return nil, wait, nil
+	}
+
+	user, err := u.us.Authentificate(email, password)
+	if err != nil {
+		if err == models.ErrPasswordInvalid {
+			u.loginFailed(key)
+		}
+		return nil, 0, err
+	}
+
+	if err := u.limits.LoginFailures.Reset(key); err != nil {
+		log.Printf("login rate limit: %v", err)
+	}
+
+	return user, 0, nil
+}
+
+// signOutOthers ends every session of user except the one of the request.
+func (u *Users) signOutOthers(r *http.Request, user *models.User) {
+	sessions, err := u.ss.ByUserID(user.ID)
+	if err != nil {
+		log.Printf("listing sessions of user %d: %v", user.ID, err)
+		return
+	}
+
+	current := context.GetSession(r.Context())
+	for _, s := range sessions {
+		if current != nil && s.ID == current.ID {
+			continue
+		}
+
+		if err := u.ss.Delete(s.ID); err != nil {
+			log.Printf("deleting session %d: %v", s.ID, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iamtraining/gallery/context"
+	"github.com/iamtraining/gallery/models"
+	"github.com/iamtraining/gallery/ratelimit"
+	"github.com/jinzhu/gorm"
+)
+
+// postAs posts form to h on behalf of the signed in user.
+func postAs(h http.HandlerFunc, user *models.User, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/account", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r = r.WithContext(context.WithUser(r.Context(), user))
+
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	return w
+}
+
+func TestConfirmPasswordLockout(t *testing.T) {
+	limit := ratelimit.Limit{Burst: 2, Refill: 5 * time.Minute}
+
+	cases := []struct {
+		name    string
+		handler func(u *Users) http.HandlerFunc
+		form    url.Values
+	}{
+		{"change password", func(u *Users) http.HandlerFunc { return u.UpdatePassword },
+			url.Values{"current_password": {"guess"}, "new_password": {"new password"}}},
+		{"delete account", func(u *Users) http.HandlerFunc { return u.DeleteAccount },
+			url.Values{"password": {"guess"}}},
+		{"turn off two-factor", func(u *Users) http.HandlerFunc { return u.DisableTwoFactor },
+			url.Values{"password": {"guess"}}},
+	}
+
+	for _, tc := range cases {
+		passwords := &passwordsStub{}
+		u := &Users{
+			LoginView:     alertView,
+			AccountView:   alertView,
+			TwoFactorView: alertView,
+			us:            passwords,
+			limits: Limits{
+				LoginFailures: ratelimit.New(ratelimit.NewMemoryStore(time.Hour), "login", limit),
+			},
+		}
+		user := &models.User{Model: gorm.Model{ID: 1}, Email: "alice@example.com"}
+		h := tc.handler(u)
+
+		for i := 0; i < limit.Burst; i++ {
+			if w := postAs(h, user, tc.form); w.Code != http.StatusOK {
+				t.Fatalf("%s: wrong password %d: status %d, want 200", tc.name, i+1, w.Code)
+			}
+		}
+
+		w := postAs(h, user, tc.form)
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "300" {
+			t.Errorf("%s: after %d wrong passwords: status %d, Retry-After %q; want 429, 300",
+				tc.name, limit.Burst, w.Code, w.Header().Get("Retry-After"))
+		}
+		if passwords.attempts != limit.Burst {
+			t.Errorf("%s: %d passwords checked, want %d", tc.name, passwords.attempts, limit.Burst)
+		}
+
+		// the guesses count towards the lockout of the login form
+		if w := postLogin(u, user.Email); w.Code != http.StatusTooManyRequests {
+			t.Errorf("%s: login after the lockout: status %d, want 429", tc.name, w.Code)
+		}
+	}
+}
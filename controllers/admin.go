@@ -0,0 +1,287 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/iamtraining/gallery/context"
+	"github.com/iamtraining/gallery/models"
+	"github.com/iamtraining/gallery/views"
+)
+
+// adminPageSize is how many users or galleries a page of the admin area
+// lists.
+const adminPageSize = 50
+
+// Admin is the area under /admin where moderators disable accounts and take
+// down galleries, and admins change roles.
+type Admin struct {
+	UsersView     *views.View
+	GalleriesView *views.View
+	us            models.UserService
+	ss            models.SessionService
+	g             models.GalleryService
+}
+
+type RoleForm struct {
+	Role string `schema:"role"`
+}
+
+type adminUsersPage struct {
+	Users []models.User
+	Roles []string
+	// Actor is the signed in moderator or admin.
+	Actor *models.User
+	pager
+}
+
+type adminGalleriesPage struct {
+	Galleries []adminGallery
+	pager
+}
+
+type adminGallery struct {
+	models.Gallery
+	// Owner is the email address of the owner.
+	Owner string
+}
+
+type pager struct {
+	Page int
+	Next bool
+}
+
+func (p pager) Prev() int {
+	return p.Page - 1
+}
+
+func (p pager) NextPage() int {
+	return p.Page + 1
+}
+
+func NewAdmin(us models.UserService, ss models.SessionService, g models.GalleryService) *Admin {
+	return &Admin{
+		UsersView:     views.NewView("bootstrap", "admin/users"),
+		GalleriesView: views.NewView("bootstrap", "admin/galleries"),
+		us:            us,
+		ss:            ss,
+		g:             g,
+	}
+}
+
+// CanManage reports whether the actor of the page may disable user.
+func (p adminUsersPage) CanManage(user models.User) bool {
+	return canManage(p.Actor, &user)
+}
+
+// CanChangeRole reports whether the actor of the page may change the role
+// of user.
+func (p adminUsersPage) CanChangeRole(user models.User) bool {
+	return canChangeRole(p.Actor, &user)
+}
+
+// canManage keeps everyone from disabling their own account, and
+// moderators from disabling other moderators and admins.
+func canManage(actor, user *models.User) bool {
+	return actor.ID != user.ID &&
+		(actor.HasRole(models.RoleAdmin) || !user.HasRole(models.RoleModerator))
+}
+
+// canChangeRole lets admins change the roles of everyone but themselves,
+// so there is always an admin left.
+func canChangeRole(actor, user *models.User) bool {
+	return actor.ID != user.ID && actor.HasRole(models.RoleAdmin)
+}
+
+// GET /admin/users?page=
+func (a *Admin) Users(w http.ResponseWriter, r *http.Request) {
+	a.renderUsers(w, r, views.Data{})
+}
+
+// POST /admin/users/:id/disable
+//
+// The sessions of the user end right away, their API tokens stop working
+// until the account is enabled again.
+func (a *Admin) DisableUser(w http.ResponseWriter, r *http.Request) {
+	a.setDisabled(w, r, true)
+}
+
+// POST /admin/users/:id/enable
+func (a *Admin) EnableUser(w http.ResponseWriter, r *http.Request) {
+	a.setDisabled(w, r, false)
+}
+
+func (a *Admin) setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	var data views.Data
+
+	user, ok := a.managedUser(w, r, canManage)
+	if !ok {
+		return
+	}
+
+	user.Disabled = disabled
+	if err := a.us.Update(user); err != nil {
+		data.SetAlert(err)
+		a.renderUsers(w, r, data)
+		return
+	}
+
+	if disabled {
+		if err := a.ss.DeleteByUserID(user.ID); err != nil {
+			log.Printf("deleting sessions of user %d: %v", user.ID, err)
+		}
+	}
+
+	http.Redirect(w, r, a.usersURL(r), http.StatusFound)
+}
+
+// POST /admin/users/:id/role
+func (a *Admin) SetRole(w http.ResponseWriter, r *http.Request) {
+	var data views.Data
+	var form RoleForm
+
+	if err := parseForm(r, &form); err != nil {
+		data.SetAlert(err)
+		a.renderUsers(w, r, data)
+		return
+	}
+
+	user, ok := a.managedUser(w, r, canChangeRole)
+	if !ok {
+		return
+	}
+
+	user.Role = form.Role
+	if err := a.us.Update(user); err != nil {
+		data.SetAlert(err)
+		a.renderUsers(w, r, data)
+		return
+	}
+
+	http.Redirect(w, r, a.usersURL(r), http.StatusFound)
+}
+
+// GET /admin/galleries?page=
+func (a *Admin) Galleries(w http.ResponseWriter, r *http.Request) {
+	a.renderGalleries(w, r, views.Data{})
+}
+
+// POST /admin/galleries/:id/takedown
+func (a *Admin) TakeDownGallery(w http.ResponseWriter, r *http.Request) {
+	a.setTakenDown(w, r, true)
+}
+
+// POST /admin/galleries/:id/restore
+func (a *Admin) RestoreGallery(w http.ResponseWriter, r *http.Request) {
+	a.setTakenDown(w, r, false)
+}
+
+func (a *Admin) setTakenDown(w http.ResponseWriter, r *http.Request, takenDown bool) {
+	var data views.Data
+
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	gallery, err := a.g.ByID(uint(id))
+	if err != nil {
+		data.SetAlert(err)
+		a.renderGalleries(w, r, data)
+		return
+	}
+
+	gallery.TakenDown = takenDown
+	if err := a.g.Update(gallery); err != nil {
+		data.SetAlert(err)
+		a.renderGalleries(w, r, data)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/galleries?page="+strconv.Itoa(pageNumber(r)), http.StatusFound)
+}
+
+// managedUser loads the user of the request URL if allowed says the
+// signed in user may change them. Otherwise it responds 403.
+func (a *Admin) managedUser(w http.ResponseWriter, r *http.Request,
+	allowed func(actor, user *models.User) bool) (*models.User, bool) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	user, err := a.us.ByID(uint(id))
+	if err != nil {
+		var data views.Data
+		data.SetAlert(err)
+		a.renderUsers(w, r, data)
+		return nil, false
+	}
+
+	if !allowed(context.GetUser(r.Context()), user) {
+		http.Error(w, "you dont have permission to change this user", http.StatusForbidden)
+		return nil, false
+	}
+
+	return user, true
+}
+
+func (a *Admin) renderUsers(w http.ResponseWriter, r *http.Request, data views.Data) {
+	p := adminUsersPage{
+		Roles: models.Roles,
+		Actor: context.GetUser(r.Context()),
+		pager: pager{Page: pageNumber(r)},
+	}
+
+	// one more than shown tells whether there is a next page
+	users, err := a.us.List((p.Page-1)*adminPageSize, adminPageSize+1)
+	if err != nil {
+		data.SetAlert(err)
+	}
+	if len(users) > adminPageSize {
+		users, p.Next = users[:adminPageSize], true
+	}
+	p.Users = users
+
+	data.Body = p
+	a.UsersView.Render(w, r, data)
+}
+
+func (a *Admin) renderGalleries(w http.ResponseWriter, r *http.Request, data views.Data) {
+	p := adminGalleriesPage{
+		pager: pager{Page: pageNumber(r)},
+	}
+
+	galleries, err := a.g.List((p.Page-1)*adminPageSize, adminPageSize+1)
+	if err != nil {
+		data.SetAlert(err)
+	}
+	if len(galleries) > adminPageSize {
+		galleries, p.Next = galleries[:adminPageSize], true
+	}
+
+	owners := make(map[uint]string)
+	for _, g := range galleries {
+		owner, ok := owners[g.UserID]
+		if !ok {
+			if u, err := a.us.ByID(g.UserID); err == nil {
+				owner = u.Email
+			}
+			owners[g.UserID] = owner
+		}
+
+		p.Galleries = append(p.Galleries, adminGallery{Gallery: g, Owner: owner})
+	}
+
+	data.Body = p
+	a.GalleriesView.Render(w, r, data)
+}
+
+func (a *Admin) usersURL(r *http.Request) string {
+	return "/admin/users?page=" + strconv.Itoa(pageNumber(r))
+}
+
+// pageNumber returns the page number of the request, 1 if it has none.
+func pageNumber(r *http.Request) int {
+	n, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || n < 1 {
+		return 1
+	}
+
+	return n
+}
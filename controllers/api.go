@@ -0,0 +1,462 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/iamtraining/gallery/context"
+	"github.com/iamtraining/gallery/models"
+	"github.com/iamtraining/gallery/views"
+)
+
+// API is the JSON interface to galleries and images under /api/v1. It
+// shares the services, and their validation, with the HTML controllers.
+type API struct {
+	g         models.GalleryService
+	i         models.ImgService
+	c         models.CollaboratorService
+	maxUpload int64
+}
+
+type apiGallery struct {
+	ID         uint       `json:"id"`
+	Title      string     `json:"title"`
+	Visibility string     `json:"visibility"`
+	ShareURL   string     `json:"share_url,omitempty"`
+	TakenDown  bool       `json:"taken_down,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	Images     []apiImage `json:"images,omitempty"`
+	// Role is the role of the caller in a gallery shared with them, it is
+	// empty for their own galleries.
+	Role string `json:"role,omitempty"`
+}
+
+type apiImage struct {
+	ID           uint      `json:"id"`
+	GalleryID    uint      `json:"gallery_id"`
+	Filename     string    `json:"filename"`
+	OriginalName string    `json:"original_name"`
+	Size         int64     `json:"size"`
+	MimeType     string    `json:"mime_type"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	Position     int       `json:"position"`
+	URL          string    `json:"url"`
+	ThumbURL     string    `json:"thumb_url"`
+	MediumURL    string    `json:"medium_url"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type apiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	// File is set for the per file errors of an upload.
+	File string `json:"file,omitempty"`
+}
+
+type apiGalleryForm struct {
+	Title      *string `json:"title"`
+	Visibility *string `json:"visibility"`
+}
+
+func NewAPI(g models.GalleryService, i models.ImgService, c models.CollaboratorService, maxUpload int64) *API {
+	return &API{
+		g:         g,
+		i:         i,
+		c:         c,
+		maxUpload: maxUpload,
+	}
+}
+
+// GET /api/v1/galleries
+//
+// Like the HTML index it lists the galleries of the caller, then the ones
+// shared with them.
+func (a *API) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.GetUser(r.Context())
+
+	galleries, err := a.g.ByUserID(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	collaborations, err := a.c.ByUserID(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	res := make([]apiGallery, len(galleries), len(galleries)+len(collaborations))
+	for i := range galleries {
+		res[i] = newAPIGallery(&galleries[i])
+	}
+
+	for _, c := range collaborations {
+		gallery, err := a.g.ByID(c.GalleryID)
+		if err != nil {
+			continue
+		}
+		// collaborators have no access to taken down galleries
+		if gallery.TakenDown {
+			continue
+		}
+
+		shared := newAPIGallery(gallery)
+		shared.Role = c.Role
+		res = append(res, shared)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// POST /api/v1/galleries
+func (a *API) Create(w http.ResponseWriter, r *http.Request) {
+	var form apiGalleryForm
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		writeErrorMsg(w, http.StatusBadRequest, "request body must be a JSON object")
+		return
+	}
+
+	gallery := models.Gallery{
+		UserID: context.GetUser(r.Context()).ID,
+	}
+	form.apply(&gallery)
+
+	if err := a.g.Create(&gallery); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newAPIGallery(&gallery))
+}
+
+// GET /api/v1/galleries/:id
+func (a *API) Show(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.viewableGallery(w, r)
+	if !ok {
+		return
+	}
+
+	res := newAPIGallery(gallery)
+	res.Images = newAPIImages(gallery.Img)
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// PATCH /api/v1/galleries/:id
+//
+// Editors can change the title, only the owner the visibility.
+func (a *API) Update(w http.ResponseWriter, r *http.Request) {
+	gallery, access, ok := a.galleryWithAccess(w, r, models.AccessEdit)
+	if !ok {
+		return
+	}
+
+	var form apiGalleryForm
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		writeErrorMsg(w, http.StatusBadRequest, "request body must be a JSON object")
+		return
+	}
+
+	if form.Visibility != nil && !access.IsOwner() {
+		writeErrorMsg(w, http.StatusForbidden, "only the owner can change the visibility of this gallery")
+		return
+	}
+	form.apply(gallery)
+
+	if err := a.g.Update(gallery); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIGallery(gallery))
+}
+
+// DELETE /api/v1/galleries/:id
+func (a *API) Delete(w http.ResponseWriter, r *http.Request) {
+	gallery, _, ok := a.galleryWithAccess(w, r, models.AccessOwner)
+	if !ok {
+		return
+	}
+
+	if err := a.g.Delete(gallery.ID); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := a.i.DeleteByGalleryID(gallery.ID); err != nil {
+		log.Printf("deleting images of gallery %d: %v", gallery.ID, err)
+	}
+
+	if err := a.c.DeleteByGalleryID(gallery.ID); err != nil {
+		log.Printf("deleting collaborators of gallery %d: %v", gallery.ID, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/v1/galleries/:id/images
+func (a *API) Images(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.viewableGallery(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIImages(gallery.Img))
+}
+
+// POST /api/v1/galleries/:id/images
+//
+// Every file of the "images" multipart field is uploaded on its own. The
+// response lists the images that were stored and an error per rejected
+// file; it is 201 if at least one image was stored.
+func (a *API) UploadImg(w http.ResponseWriter, r *http.Request) {
+	gallery, _, ok := a.galleryWithAccess(w, r, models.AccessUpload)
+	if !ok {
+		return
+	}
+
+	if r.ContentLength > a.maxUpload {
+		writeErrorMsg(w, http.StatusRequestEntityTooLarge, uploadTooLargeMsg(a.maxUpload))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, a.maxUpload)
+
+	if err := r.ParseMultipartForm(Multipart); err != nil {
+		writeErrorMsg(w, http.StatusBadRequest, "request must be multipart/form-data within the size limit")
+		return
+	}
+
+	res := struct {
+		Images []apiImage  `json:"images"`
+		Errors []*apiError `json:"errors,omitempty"`
+	}{
+		Images: []apiImage{},
+	}
+
+	for _, f := range r.MultipartForm.File["images"] {
+		file, err := f.Open()
+		if err == nil {
+			var img *models.Img
+			img, err = a.i.Create(gallery.ID, file, f.Filename)
+			file.Close()
+			if err == nil {
+				res.Images = append(res.Images, newAPIImage(img))
+				continue
+			}
+		}
+
+		e := newAPIError(err)
+		e.File = f.Filename
+		res.Errors = append(res.Errors, e)
+	}
+
+	status := http.StatusCreated
+	if len(res.Images) == 0 {
+		status = http.StatusUnprocessableEntity
+	}
+
+	writeJSON(w, status, res)
+}
+
+// DELETE /api/v1/galleries/:id/images/:imageID
+func (a *API) ImgDelete(w http.ResponseWriter, r *http.Request) {
+	gallery, _, ok := a.galleryWithAccess(w, r, models.AccessEdit)
+	if !ok {
+		return
+	}
+
+	id, _ := strconv.Atoi(mux.Vars(r)["imageID"])
+
+	img, err := a.i.ByID(uint(id))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if img.GalleryID != gallery.ID {
+		writeError(w, models.ErrNotFound)
+		return
+	}
+
+	if err := a.i.Delete(img); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// NotFound answers API requests that match no route.
+func (a *API) NotFound(w http.ResponseWriter, r *http.Request) {
+	writeErrorMsg(w, http.StatusNotFound, "resource not found")
+}
+
+func (a *API) galleryByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, models.ErrNotFound)
+		return nil, false
+	}
+
+	gallery, err := a.g.ByID(uint(id))
+	if err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+
+	return gallery, true
+}
+
+// viewableGallery loads the gallery with its images if the current user
+// may see it. Other galleries are reported as missing.
+func (a *API) viewableGallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, bool) {
+	gallery, _, ok := a.galleryWithAccess(w, r, models.AccessView)
+	if !ok {
+		return nil, false
+	}
+
+	img, err := a.i.ByGalleryID(gallery.ID)
+	if err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+	gallery.Img = img
+
+	return gallery, true
+}
+
+// galleryWithAccess loads the gallery if the current user has at least
+// want access to it. Galleries they cannot see are reported as missing.
+func (a *API) galleryWithAccess(w http.ResponseWriter, r *http.Request,
+	want models.Access) (*models.Gallery, models.Access, bool) {
+	gallery, ok := a.galleryByID(w, r)
+	if !ok {
+		return nil, models.AccessNone, false
+	}
+
+	access, err := a.c.Access(gallery, context.GetUser(r.Context()))
+	if err != nil {
+		writeError(w, err)
+		return nil, access, false
+	}
+
+	if access < want {
+		if access.CanView() {
+			writeErrorMsg(w, http.StatusForbidden, "you dont have permission to change this gallery")
+		} else {
+			writeError(w, models.ErrNotFound)
+		}
+		return nil, access, false
+	}
+
+	return gallery, access, true
+}
+
+func (f apiGalleryForm) apply(g *models.Gallery) {
+	if f.Title != nil {
+		g.Title = *f.Title
+	}
+
+	if f.Visibility != nil {
+		g.Visibility = *f.Visibility
+	}
+}
+
+func newAPIGallery(g *models.Gallery) apiGallery {
+	res := apiGallery{
+		ID:         g.ID,
+		Title:      g.Title,
+		Visibility: g.Visibility,
+		TakenDown:  g.TakenDown,
+		CreatedAt:  g.CreatedAt,
+		UpdatedAt:  g.UpdatedAt,
+	}
+
+	if g.Shared() {
+		res.ShareURL = g.SharePath()
+	}
+
+	return res
+}
+
+func newAPIImages(imgs []models.Img) []apiImage {
+	res := make([]apiImage, len(imgs))
+	for i := range imgs {
+		res[i] = newAPIImage(&imgs[i])
+	}
+
+	return res
+}
+
+func newAPIImage(i *models.Img) apiImage {
+	return apiImage{
+		ID:           i.ID,
+		GalleryID:    i.GalleryID,
+		Filename:     i.Filename,
+		OriginalName: i.OriginalName,
+		Size:         i.Size,
+		MimeType:     i.MimeType,
+		Width:        i.Width,
+		Height:       i.Height,
+		Position:     i.Position,
+		URL:          i.Path(),
+		ThumbURL:     i.ThumbPath(),
+		MediumURL:    i.MediumPath(),
+		CreatedAt:    i.CreatedAt,
+	}
+}
+
+// newAPIError turns err into an API error. Errors with a public message,
+// such as the model validation errors, are client errors; everything else
+// is logged and hidden behind a generic message.
+func newAPIError(err error) *apiError {
+	if err == models.ErrNotFound {
+		return &apiError{
+			Status:  http.StatusNotFound,
+			Message: models.ErrNotFound.Public(),
+		}
+	}
+
+	if pub, ok := err.(views.PublicError); ok {
+		return &apiError{
+			Status:  http.StatusUnprocessableEntity,
+			Message: pub.Public(),
+		}
+	}
+
+	log.Println(err)
+	return &apiError{
+		Status:  http.StatusInternalServerError,
+		Message: views.AlertMsg,
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	e := newAPIError(err)
+	writeJSON(w, e.Status, struct {
+		Error *apiError `json:"error"`
+	}{e})
+}
+
+func writeErrorMsg(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, struct {
+		Error *apiError `json:"error"`
+	}{&apiError{Status: status, Message: msg}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("encoding api response: %v", err)
+	}
+}
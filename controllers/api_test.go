@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/iamtraining/gallery/context"
+	"github.com/iamtraining/gallery/models"
+	"github.com/jinzhu/gorm"
+)
+
+// galleriesStub serves a fixed set of galleries.
+type galleriesStub struct {
+	models.GalleryService
+	galleries []models.Gallery
+}
+
+func (gs *galleriesStub) ByID(id uint) (*models.Gallery, error) {
+	for _, g := range gs.galleries {
+		if g.ID == id {
+			return &g, nil
+		}
+	}
+
+	return nil, models.ErrNotFound
+}
+
+func (gs *galleriesStub) ByUserID(userID uint) ([]models.Gallery, error) {
+	var galleries []models.Gallery
+	for _, g := range gs.galleries {
+		if g.UserID == userID {
+			galleries = append(galleries, g)
+		}
+	}
+
+	return galleries, nil
+}
+
+// collaboratorsStub serves a fixed set of collaborators.
+type collaboratorsStub struct {
+	models.CollaboratorService
+	collaborators []models.Collaborator
+}
+
+func (cs *collaboratorsStub) ByUserID(userID uint) ([]models.Collaborator, error) {
+	var collaborators []models.Collaborator
+	for _, c := range cs.collaborators {
+		if c.UserID == userID {
+			collaborators = append(collaborators, c)
+		}
+	}
+
+	return collaborators, nil
+}
+
+func TestAPIIndex(t *testing.T) {
+	a := NewAPI(&galleriesStub{galleries: []models.Gallery{
+		{Model: gorm.Model{ID: 1}, UserID: 1, Title: "own"},
+		{Model: gorm.Model{ID: 2}, UserID: 2, Title: "shared"},
+		{Model: gorm.Model{ID: 3}, UserID: 2, Title: "taken down", TakenDown: true},
+		{Model: gorm.Model{ID: 4}, UserID: 2, Title: "not shared"},
+	}}, nil, &collaboratorsStub{collaborators: []models.Collaborator{
+		{ID: 1, GalleryID: 2, UserID: 1, Role: models.CollaboratorEditor},
+		{ID: 2, GalleryID: 3, UserID: 1, Role: models.CollaboratorViewer},
+		// the gallery was deleted in the meantime
+		{ID: 3, GalleryID: 5, UserID: 1, Role: models.CollaboratorViewer},
+	}}, 0)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/galleries", nil)
+	r = r.WithContext(context.WithUser(r.Context(), &models.User{Model: gorm.Model{ID: 1}}))
+	w := httptest.NewRecorder()
+	a.Index(w, r)
+
+	var res []apiGallery
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res) != 2 || res[0].ID != 1 || res[0].Role != "" ||
+		res[1].ID != 2 || res[1].Role != models.CollaboratorEditor {
+		t.Errorf("Index() = %+v, want gallery 1 as owner then gallery 2 as editor", res)
+	}
+}
@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/iamtraining/gallery/context"
+	"github.com/iamtraining/gallery/models"
+	"github.com/iamtraining/gallery/views"
+)
+
+// APITokens lets users manage the tokens their scripts use the API with.
+type APITokens struct {
+	IndexView *views.View
+	ts        models.APITokenService
+}
+
+type APITokenForm struct {
+	Name   string   `schema:"name"`
+	Scopes []string `schema:"scopes"`
+}
+
+type apiTokensPage struct {
+	Tokens []models.APIToken
+	Scopes []string
+	// Created is the token that was just created. Its token is shown this
+	// once.
+	Created *models.APIToken
+}
+
+func NewAPITokens(ts models.APITokenService) *APITokens {
+	return &APITokens{
+		IndexView: views.NewView(
+			"bootstrap",
+			"users/api_tokens",
+		),
+		ts: ts,
+	}
+}
+
+// GET /account/tokens
+func (t *APITokens) Index(w http.ResponseWriter, r *http.Request) {
+	t.render(w, r, views.Data{}, nil)
+}
+
+// POST /account/tokens
+func (t *APITokens) Create(w http.ResponseWriter, r *http.Request) {
+	var data views.Data
+	var form APITokenForm
+
+	if err := parseForm(r, &form); err != nil {
+		data.SetAlert(err)
+		t.render(w, r, data, nil)
+		return
+	}
+
+	token := models.APIToken{
+		UserID: context.GetUser(r.Context()).ID,
+		Name:   form.Name,
+		Scopes: strings.Join(form.Scopes, " "),
+	}
+	if err := t.ts.Create(&token); err != nil {
+		data.SetAlert(err)
+		t.render(w, r, data, nil)
+		return
+	}
+
+	data.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your token has been created. Copy it now, it is not shown again.",
+	}
+	t.render(w, r, data, &token)
+}
+
+// POST /account/tokens/:id/revoke
+func (t *APITokens) Revoke(w http.ResponseWriter, r *http.Request) {
+	user := context.GetUser(r.Context())
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	tokens, err := t.ts.ByUserID(user.ID)
+	if err != nil {
+		http.Error(w, "something goes wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// only tokens of the current user can be revoked
+	for _, token := range tokens {
+		if token.ID != uint(id) {
+			continue
+		}
+
+		if err := t.ts.Delete(token.ID); err != nil {
+			http.Error(w, "something goes wrong", http.StatusInternalServerError)
+			return
+		}
+
+		break
+	}
+
+	http.Redirect(w, r, "/account/tokens", http.StatusFound)
+}
+
+func (t *APITokens) render(w http.ResponseWriter, r *http.Request, data views.Data, created *models.APIToken) {
+	page := apiTokensPage{
+		Scopes:  models.Scopes,
+		Created: created,
+	}
+
+	tokens, err := t.ts.ByUserID(context.GetUser(r.Context()).ID)
+	if err != nil {
+		data.SetAlert(err)
+	}
+	page.Tokens = tokens
+
+	data.Body = page
+	t.IndexView.Render(w, r, data)
+}
@@ -2,6 +2,8 @@ package controllers
 
 import (
 	"fmt"
+	"log"
+	"mime/multipart"
 	"net/http"
 	"strconv"
 
@@ -26,13 +28,42 @@ type Galleries struct {
 	g         models.GalleryService
 	r         *mux.Router
 	i         models.ImgService
+	c         models.CollaboratorService
 }
 
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title      string `schema:"title"`
+	Visibility string `schema:"visibility"`
 }
 
-func NewGalleries(g models.GalleryService, i models.ImgService, r *mux.Router) *Galleries {
+type CollaboratorForm struct {
+	Email string `schema:"email"`
+	Role  string `schema:"role"`
+}
+
+// galleryPage is a gallery as the current user sees it.
+type galleryPage struct {
+	*models.Gallery
+	Access models.Access
+	// Collaborators and Roles are only set for the owner.
+	Collaborators []models.Collaborator
+	Roles         []string
+}
+
+type galleriesPage struct {
+	Owned  []models.Gallery
+	Shared []sharedGallery
+}
+
+// sharedGallery is a gallery of someone else the user collaborates on.
+type sharedGallery struct {
+	models.Gallery
+	Role   string
+	Access models.Access
+}
+
+func NewGalleries(g models.GalleryService, i models.ImgService, c models.CollaboratorService,
+	r *mux.Router) *Galleries {
 	return &Galleries{
 		New:       views.NewView("bootstrap", "galleries/new"),
 		ShowView:  views.NewView("bootstrap", "galleries/show"),
@@ -41,6 +72,7 @@ func NewGalleries(g models.GalleryService, i models.ImgService, r *mux.Router) *
 		g:         g,
 		r:         r,
 		i:         i,
+		c:         c,
 	}
 }
 
@@ -59,8 +91,9 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	user := context.GetUser(r.Context())
 
 	gallery := models.Gallery{
-		Title:  form.Title,
-		UserID: user.ID,
+		Title:      form.Title,
+		UserID:     user.ID,
+		Visibility: form.Visibility,
 	}
 
 	if err := g.g.Create(&gallery); err != nil {
@@ -104,61 +137,110 @@ func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models
 	return gallery, nil
 }
 
-func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
+// galleryWithAccess loads the gallery of the request URL if the current
+// user has at least want access to it. Galleries they cannot see look like
+// missing ones, on the others they get 403.
+func (g *Galleries) galleryWithAccess(w http.ResponseWriter, r *http.Request,
+	want models.Access) (*models.Gallery, models.Access, error) {
 	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return nil, models.AccessNone, err
+	}
+
+	access, err := g.c.Access(gallery, context.GetUser(r.Context()))
+	if err != nil {
+		http.Error(w, "something goes wrong", http.StatusInternalServerError)
+		return nil, access, err
+	}
+
+	if access < want {
+		if access.CanView() {
+			http.Error(w, "you dont have permission to change this gallery", http.StatusForbidden)
+		} else {
+			http.Error(w, "gallery not found", http.StatusNotFound)
+		}
+		return nil, access, models.ErrNotFound
+	}
+
+	return gallery, access, nil
+}
+
+// GET /galleries/:id
+func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
+	gallery, access, err := g.galleryWithAccess(w, r, models.AccessView)
 	if err != nil {
 		return
 	}
 
 	var data views.Data
-	data.Body = gallery
+	data.Body = galleryPage{Gallery: gallery, Access: access}
 
 	g.ShowView.Render(w, r, data)
 }
 
-func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
+// GET /g/:slug
+func (g *Galleries) ShowShared(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.g.ByShareSlug(mux.Vars(r)["slug"])
 	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "gallery not found", http.StatusNotFound)
+		default:
+			http.Error(w, "something goes wrong", http.StatusInternalServerError)
+		}
 		return
 	}
 
-	user := context.GetUser(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "you dont gave permission to edit this gallery", http.StatusForbidden)
+	if !gallery.Shared() {
+		http.Error(w, "gallery not found", http.StatusNotFound)
 		return
 	}
 
+	img, _ := g.i.ByGalleryID(gallery.ID)
+	gallery.Img = img
+	gallery.ShareImgs()
+
 	var data views.Data
-	data.Body = gallery
-	g.EditView.Render(w, r, data)
+	data.Body = galleryPage{Gallery: gallery}
+
+	g.ShowView.Render(w, r, data)
 }
 
-func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
+// GET /galleries/:id/edit
+//
+// Contributors get the page too, for uploading images.
+func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
+	gallery, access, err := g.galleryWithAccess(w, r, models.AccessUpload)
 	if err != nil {
 		return
 	}
 
-	user := context.GetUser(r.Context())
+	g.renderEdit(w, r, views.Data{}, gallery, access)
+}
 
-	if gallery.UserID != user.ID {
-		http.Error(w, "gallery not found", http.StatusNotFound)
+// POST /galleries/:id/update
+//
+// Editors can rename the gallery, only the owner changes its visibility.
+func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
+	gallery, access, err := g.galleryWithAccess(w, r, models.AccessEdit)
+	if err != nil {
 		return
 	}
 
-	//
 	var data views.Data
-	data.Body = gallery
 
 	var form GalleryForm
 
 	if err = parseForm(r, &form); err != nil {
 		data.SetAlert(err)
-		g.EditView.Render(w, r, data)
+		g.renderEdit(w, r, data, gallery, access)
 		return
 	}
 
 	gallery.Title = form.Title
+	if access.IsOwner() {
+		gallery.Visibility = form.Visibility
+	}
 
 	err = g.g.Update(gallery)
 	if err != nil {
@@ -170,32 +252,34 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	g.EditView.Render(w, r, data)
+	g.renderEdit(w, r, data, gallery, access)
 }
 
 func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
+	gallery, access, err := g.galleryWithAccess(w, r, models.AccessOwner)
 	if err != nil {
 		return
 	}
 
-	user := context.GetUser(r.Context())
-
-	if gallery.UserID != user.ID {
-		http.Error(w, "you dont have permissiont to delete this gallery", http.StatusForbidden)
-		return
-	}
-
 	var data views.Data
 
 	err = g.g.Delete(gallery.ID)
 	if err != nil {
 		data.SetAlert(err)
-		data.Body = gallery
-		g.EditView.Render(w, r, data)
+		g.renderEdit(w, r, data, gallery, access)
 		return
 	}
 
+	// the gallery is gone at this point, images left behind by a failure
+	// here are found by the reconcile command
+	if err = g.i.DeleteByGalleryID(gallery.ID); err != nil {
+		log.Printf("deleting images of gallery %d: %v", gallery.ID, err)
+	}
+
+	if err = g.c.DeleteByGalleryID(gallery.ID); err != nil {
+		log.Printf("deleting collaborators of gallery %d: %v", gallery.ID, err)
+	}
+
 	url, err := g.r.Get(IndexGallery).URL()
 	if err != nil {
 		http.Redirect(w, r, "/", http.StatusFound)
@@ -205,6 +289,9 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url.Path, http.StatusFound)
 }
 
+// GET /galleries
+//
+// Lists the galleries of the user and the ones they collaborate on.
 func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	user := context.GetUser(r.Context())
 
@@ -214,91 +301,236 @@ func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	collaborations, err := g.c.ByUserID(user.ID)
+	if err != nil {
+		http.Error(w, "something goes wrong", http.StatusInternalServerError)
+		return
+	}
+
+	page := galleriesPage{Owned: galleries}
+	for _, c := range collaborations {
+		gallery, err := g.g.ByID(c.GalleryID)
+		if err != nil {
+			continue
+		}
+		// collaborators have no access to taken down galleries
+		if gallery.TakenDown {
+			continue
+		}
+
+		page.Shared = append(page.Shared, sharedGallery{
+			Gallery: *gallery,
+			Role:    c.Role,
+			Access:  c.Access(),
+		})
+	}
+
 	var data views.Data
-	data.Body = galleries
+	data.Body = page
 	g.IndexView.Render(w, r, data)
 }
 
-// POST /galleries/:id/images -- jpg jpeg png
+// POST /galleries/:id/images -- jpg jpeg png gif webp
 func (g *Galleries) UploadImg(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
+	gallery, access, err := g.galleryWithAccess(w, r, models.AccessUpload)
 	if err != nil {
 		return
 	}
 
-	user := context.GetUser(r.Context())
-
-	if gallery.UserID != user.ID {
-		http.Error(w, "gallery not found", http.StatusNotFound)
-		return
-	}
-
 	var data views.Data
-	data.Body = gallery
 
+	// the CSRF middleware parsed the form already, within the size limit
 	err = r.ParseMultipartForm(Multipart)
 	if err != nil {
-		data.SetAlert(err)
-		g.EditView.Render(w, r, data)
+		data.CreateErrorAlert("the upload could not be read, please try again")
+		g.renderEdit(w, r, data, gallery, access)
 		return
 	}
 
 	files := r.MultipartForm.File["images"]
 
+	// a bad file is reported and skipped, the rest of the batch is still
+	// uploaded
+	uploaded := 0
 	for _, f := range files {
-		file, err := f.Open()
-		if err != nil {
-			data.SetAlert(err)
-			g.EditView.Render(w, r, data)
-			return
+		if err := g.uploadFile(gallery.ID, f); err != nil {
+			data.AddErrorAlert(f.Filename, err)
+			continue
 		}
+		uploaded++
+	}
 
-		defer file.Close()
+	gallery.Img, _ = g.i.ByGalleryID(gallery.ID)
 
-		err = g.i.Create(gallery.ID, file, f.Filename)
-		if err != nil {
-			data.SetAlert(err)
-			g.EditView.Render(w, r, data)
+	switch {
+	case uploaded == 0 && len(files) > 0:
+		data.CreateErrorAlert("no images were uploaded")
+	case uploaded < len(files):
+		data.Alert = &views.Alert{
+			Level:   views.AlertLvlWarning,
+			Message: fmt.Sprintf("%d of %d images uploaded", uploaded, len(files)),
+		}
+	default:
+		data.Alert = &views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: "images successfully uploaded",
 		}
 	}
 
-	data.Alert = &views.Alert{
-		Level:   views.AlertLvlSuccess,
-		Message: "images successfully uploaded",
+	g.renderEdit(w, r, data, gallery, access)
+}
+
+func (g *Galleries) uploadFile(galleryID uint, f *multipart.FileHeader) error {
+	file, err := f.Open()
+	if err != nil {
+		return err
 	}
 
-	g.EditView.Render(w, r, data)
+	defer file.Close()
+
+	_, err = g.i.Create(galleryID, file, f.Filename)
+
+	return err
+}
+
+func uploadTooLargeMsg(limit int64) string {
+	return fmt.Sprintf("upload is too large, at most %d MB can be sent at once", limit>>20)
 }
 
 func (g *Galleries) ImgDelete(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
+	gallery, access, err := g.galleryWithAccess(w, r, models.AccessEdit)
 	if err != nil {
 		return
 	}
 
-	user := context.GetUser(r.Context())
+	fname := mux.Vars(r)["filename"]
 
-	if gallery.UserID != user.ID {
-		http.Error(w, "you dont have permission to delete this gallery", http.StatusForbidden)
+	i, err := g.i.ByFilename(gallery.ID, fname)
+	if err != nil {
+		var data views.Data
+		data.SetAlert(err)
+		g.renderEdit(w, r, data, gallery, access)
 		return
 	}
 
-	fname := mux.Vars(r)["filename"]
+	err = g.i.Delete(i)
+	if err != nil {
+		var data views.Data
+		data.SetAlert(err)
+		g.renderEdit(w, r, data, gallery, access)
+		return
+	}
 
-	i := models.Img{
-		Filename:  fname,
-		GalleryID: gallery.ID,
+	g.redirectToEdit(w, r, gallery)
+}
+
+// POST /galleries/:id/collaborators
+//
+// Inviting someone who already collaborates changes their role.
+func (g *Galleries) InviteCollaborator(w http.ResponseWriter, r *http.Request) {
+	gallery, access, err := g.galleryWithAccess(w, r, models.AccessOwner)
+	if err != nil {
+		return
 	}
 
-	err = g.i.Delete(&i)
+	var data views.Data
+	var form CollaboratorForm
+
+	if err := parseForm(r, &form); err != nil {
+		data.SetAlert(err)
+		g.renderEdit(w, r, data, gallery, access)
+		return
+	}
+
+	c, err := g.c.Invite(gallery, form.Email, form.Role)
+	if err != nil {
+		data.SetAlert(err)
+	} else {
+		data.Alert = &views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: fmt.Sprintf("%s can now collaborate as %s", c.Email, c.Role),
+		}
+	}
+
+	g.renderEdit(w, r, data, gallery, access)
+}
+
+// POST /galleries/:id/collaborators/:collaboratorID/remove
+func (g *Galleries) RemoveCollaborator(w http.ResponseWriter, r *http.Request) {
+	gallery, access, err := g.galleryWithAccess(w, r, models.AccessOwner)
+	if err != nil {
+		return
+	}
+
+	id, _ := strconv.Atoi(mux.Vars(r)["collaboratorID"])
+
+	collaborators, err := g.c.ByGalleryID(gallery.ID)
 	if err != nil {
 		var data views.Data
-		data.Body = gallery
 		data.SetAlert(err)
-		g.EditView.Render(w, r, data)
+		g.renderEdit(w, r, data, gallery, access)
+		return
+	}
+
+	// only collaborators of this gallery can be removed through it
+	for _, c := range collaborators {
+		if c.ID != uint(id) {
+			continue
+		}
+
+		if err := g.c.Delete(c.ID); err != nil {
+			var data views.Data
+			data.SetAlert(err)
+			g.renderEdit(w, r, data, gallery, access)
+			return
+		}
+	}
+
+	g.redirectToEdit(w, r, gallery)
+}
+
+// POST /galleries/:id/share/regenerate
+func (g *Galleries) RegenerateShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, access, err := g.galleryWithAccess(w, r, models.AccessOwner)
+	if err != nil {
 		return
 	}
 
+	var data views.Data
+
+	if err := g.g.RegenerateShareSlug(gallery); err != nil {
+		data.SetAlert(err)
+	} else {
+		data.Alert = &views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: "the gallery has a new share link, the old one no longer works",
+		}
+	}
+
+	g.renderEdit(w, r, data, gallery, access)
+}
+
+func (g *Galleries) renderEdit(w http.ResponseWriter, r *http.Request, data views.Data,
+	gallery *models.Gallery, access models.Access) {
+	page := galleryPage{
+		Gallery: gallery,
+		Access:  access,
+	}
+
+	if access.IsOwner() {
+		collaborators, err := g.c.ByGalleryID(gallery.ID)
+		if err != nil {
+			log.Printf("listing collaborators of gallery %d: %v", gallery.ID, err)
+		}
+		page.Collaborators = collaborators
+		page.Roles = models.CollaboratorRoles
+	}
+
+	data.Body = page
+	g.EditView.Render(w, r, data)
+}
+
+func (g *Galleries) redirectToEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
 	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
 	if err != nil {
 		http.Redirect(w, r, "/galleries", http.StatusFound)
@@ -12,6 +12,8 @@ func parseForm(r *http.Request, form interface{}) error {
 	}
 
 	dec := schema.NewDecoder()
+	// forms carry fields the handlers do not decode, e.g. the CSRF token
+	dec.IgnoreUnknownKeys(true)
 	if err := dec.Decode(form, r.PostForm); err != nil {
 		return err
 	}
@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/iamtraining/gallery/context"
+	"github.com/iamtraining/gallery/models"
+	"github.com/iamtraining/gallery/storage"
+)
+
+// Images serves image files from storage, applying the visibility of the
+// gallery they belong to.
+type Images struct {
+	store storage.Storage
+	g     models.GalleryService
+	c     models.CollaboratorService
+}
+
+func NewImages(store storage.Storage, g models.GalleryService, c models.CollaboratorService) *Images {
+	return &Images{
+		store: store,
+		g:     g,
+		c:     c,
+	}
+}
+
+// GET /images/galleries/:id/*file
+func (i *Images) Show(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil || !cleanImgPath(vars["file"]) {
+		http.NotFound(w, r)
+		return
+	}
+
+	gallery, err := i.g.ByID(uint(id))
+	if err != nil {
+		i.galleryError(w, r, err)
+		return
+	}
+
+	access, err := i.c.Access(gallery, context.GetUser(r.Context()))
+	if err != nil {
+		i.galleryError(w, r, err)
+		return
+	}
+
+	if !access.CanView() {
+		http.NotFound(w, r)
+		return
+	}
+
+	i.serve(w, r, gallery, vars["file"])
+}
+
+// GET /g/:slug/images/*file
+func (i *Images) ShowShared(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if !cleanImgPath(vars["file"]) {
+		http.NotFound(w, r)
+		return
+	}
+
+	gallery, err := i.g.ByShareSlug(vars["slug"])
+	if err != nil {
+		i.galleryError(w, r, err)
+		return
+	}
+
+	if !gallery.Shared() {
+		http.NotFound(w, r)
+		return
+	}
+
+	i.serve(w, r, gallery, vars["file"])
+}
+
+func (i *Images) galleryError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case models.ErrNotFound:
+		http.NotFound(w, r)
+	default:
+		http.Error(w, "something goes wrong", http.StatusInternalServerError)
+	}
+}
+
+// cleanImgPath accepts only paths that stay inside the gallery, such as
+// "photo.jpg" or "thumb/photo.jpg".
+func cleanImgPath(p string) bool {
+	return p != "" && path.Clean(p) == p && p != ".." &&
+		!strings.HasPrefix(p, "../") && !strings.HasPrefix(p, "/")
+}
+
+func (i *Images) serve(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, file string) {
+	key := (&models.Img{GalleryID: gallery.ID, Filename: file}).Key()
+
+	info, err := i.store.Stat(key)
+	if err != nil {
+		switch err {
+		case storage.ErrNotExist, storage.ErrInvalidKey:
+			http.NotFound(w, r)
+		default:
+			http.Error(w, "something goes wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// only public images may be kept by shared caches
+	if gallery.Public() {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	} else {
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+	}
+
+	if !info.ModTime.IsZero() {
+		if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil &&
+			!info.ModTime.Truncate(time.Second).After(t) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+
+	if ct := mime.TypeByExtension(path.Ext(key)); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	rc, err := i.store.Get(key)
+	if err != nil {
+		http.Error(w, "something goes wrong", http.StatusInternalServerError)
+		return
+	}
+
+	defer rc.Close()
+
+	io.Copy(w, rc)
+}
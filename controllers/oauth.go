@@ -0,0 +1,174 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/iamtraining/gallery/idp"
+	"github.com/iamtraining/gallery/models"
+	"github.com/iamtraining/gallery/rand"
+	"github.com/iamtraining/gallery/views"
+)
+
+const (
+	oauthStateCookie = "oauth_state"
+	// oauthStateMaxAge is how long the user has to sign in at the
+	// provider, in seconds.
+	oauthStateMaxAge = 10 * 60
+)
+
+// IdentityLinker finds, links or creates the user of an external
+// identity.
+type IdentityLinker interface {
+	UserByIdentity(provider string, id *idp.Identity) (*models.User, error)
+}
+
+// OAuth signs users in through external identity providers. The sessions
+// it starts are the same as after a login with a password.
+type OAuth struct {
+	providers map[string]idp.Provider
+	linker    IdentityLinker
+	users     *Users
+	baseURL   string
+}
+
+type providerLink struct {
+	Name        string
+	DisplayName string
+}
+
+// NewOAuth creates the controller for providers and lists them on the
+// login page of users.
+func NewOAuth(providers []idp.Provider, linker IdentityLinker, users *Users, baseURL string) *OAuth {
+	o := &OAuth{
+		providers: make(map[string]idp.Provider, len(providers)),
+		linker:    linker,
+		users:     users,
+		baseURL:   baseURL,
+	}
+
+	for _, p := range providers {
+		o.providers[p.Name()] = p
+		users.providers = append(users.providers, providerLink{
+			Name:        p.Name(),
+			DisplayName: p.DisplayName(),
+		})
+	}
+
+	return o
+}
+
+// GET /auth/:provider/login
+//
+// The state and the nonce are kept in a short lived cookie, the callback
+// only accepts the state that was sent from this browser.
+func (o *OAuth) Login(w http.ResponseWriter, r *http.Request) {
+	p, ok := o.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	state, err := rand.String(32)
+	if err != nil {
+		o.fail(w, r, err)
+		return
+	}
+
+	nonce, err := rand.String(32)
+	if err != nil {
+		o.fail(w, r, err)
+		return
+	}
+
+	authURL, err := p.AuthURL(r.Context(), state, nonce, o.redirectURI(p))
+	if err != nil {
+		o.fail(w, r, err)
+		return
+	}
+
+	http.SetCookie(w, o.stateCookie(state+"."+nonce, oauthStateMaxAge))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// GET /auth/:provider/callback
+func (o *OAuth) Callback(w http.ResponseWriter, r *http.Request) {
+	p, ok := o.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// single use, whatever the outcome
+	http.SetCookie(w, o.stateCookie("", -1))
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		log.Printf("%s login: %s: %s", p.Name(), e, q.Get("error_description"))
+		o.failMsg(w, r, "Signing in with "+p.DisplayName()+" was cancelled or failed.")
+		return
+	}
+
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil {
+		o.failMsg(w, r, "Your sign in has expired, please try again.")
+		return
+	}
+
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 || q.Get("state") == "" || q.Get("state") != parts[0] {
+		o.failMsg(w, r, "Your sign in has expired, please try again.")
+		return
+	}
+
+	identity, err := p.Identify(r.Context(), q.Get("code"), parts[1], o.redirectURI(p))
+	if err != nil {
+		log.Printf("%s login: %v", p.Name(), err)
+		o.failMsg(w, r, "Signing in with "+p.DisplayName()+" failed, please try again.")
+		return
+	}
+
+	user, err := o.linker.UserByIdentity(p.Name(), identity)
+	if err != nil {
+		o.fail(w, r, err)
+		return
+	}
+
+	// a linked account that has two-factor authentication on still asks
+	// for the code
+	if err := o.users.logIn(w, r, user); err != nil {
+		o.fail(w, r, err)
+	}
+}
+
+func (o *OAuth) redirectURI(p idp.Provider) string {
+	return o.baseURL + "/auth/" + p.Name() + "/callback"
+}
+
+// stateCookie has to be sent along with the redirect back from the
+// provider, which SameSite lax allows for top level navigation.
+func (o *OAuth) stateCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    value,
+		Path:     "/auth/",
+		MaxAge:   maxAge,
+		Secure:   o.users.cookie.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (o *OAuth) fail(w http.ResponseWriter, r *http.Request, err error) {
+	var data views.Data
+	data.SetAlert(err)
+	o.users.renderLogin(w, r, http.StatusOK, data)
+}
+
+func (o *OAuth) failMsg(w http.ResponseWriter, r *http.Request, msg string) {
+	var data views.Data
+	data.CreateErrorAlert(msg)
+	o.users.renderLogin(w, r, http.StatusOK, data)
+}
@@ -0,0 +1,291 @@
+package controllers
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/iamtraining/gallery/context"
+	"github.com/iamtraining/gallery/middleware"
+	"github.com/iamtraining/gallery/models"
+	"github.com/iamtraining/gallery/totp"
+	"github.com/iamtraining/gallery/views"
+)
+
+const (
+	challengeCookie = "2fa_challenge"
+	// challengeMaxAge matches the lifetime of the token in the cookie, in
+	// seconds.
+	challengeMaxAge = 5 * 60
+	// totpIssuer is the name authenticator apps list the account under.
+	totpIssuer = "gallery"
+)
+
+type TwoFactorForm struct {
+	Code string `schema:"code"`
+}
+
+type DisableTwoFactorForm struct {
+	Password string `schema:"password"`
+}
+
+type twoFactorPage struct {
+	Enabled   bool
+	CodesLeft int
+	// Secret and URI are set while the authenticator app is being set up.
+	// URI is trusted, html/template would drop the otpauth scheme.
+	Secret string
+	URI    template.URL
+	// RecoveryCodes are set right after two-factor authentication was
+	// turned on, they are not shown again.
+	RecoveryCodes []string
+	// Providers are the identity providers offered for login, see
+	// accountPage.
+	Providers []providerLink
+}
+
+// logIn finishes a login once the password, or an identity provider,
+// vouched for user. Users who turned on two-factor authentication are sent
+// on to enter a code, everyone else is signed in.
+func (u *Users) logIn(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	if user.Disabled {
+		return models.ErrAccountDisabled
+	}
+
+	if !user.TOTPEnabled {
+		if err := u.signIn(w, r, user); err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return nil
+	}
+
+	token, err := u.tf.ChallengeToken(user)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, u.challengeCookie(token, challengeMaxAge))
+	http.Redirect(w, r, "/login/2fa", http.StatusFound)
+
+	return nil
+}
+
+// GET /login/2fa
+func (u *Users) TwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	if _, err := r.Cookie(challengeCookie); err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	u.TwoFactorLoginView.Render(w, r, nil)
+}
+
+// POST /login/2fa
+//
+// Wrong codes count as failed logins of the account, so guessing codes
+// locks it out like guessing passwords does.
+func (u *Users) CompleteTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	var data views.Data
+	var form TwoFactorForm
+
+	if err := parseForm(r, &form); err != nil {
+		data.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, data)
+		return
+	}
+
+	cookie, err := r.Cookie(challengeCookie)
+	if err != nil {
+		data.SetAlert(models.ErrChallengeInvalid)
+		u.renderLogin(w, r, http.StatusOK, data)
+		return
+	}
+
+	user, err := u.tf.Challenge(cookie.Value)
+	if err != nil {
+		http.SetCookie(w, u.challengeCookie("", -1))
+		data.SetAlert(err)
+		u.renderLogin(w, r, http.StatusOK, data)
+		return
+	}
+
+	key := limitKey(user.Email)
+	if locked, wait, err := u.limits.LoginFailures.Blocked(key); err != nil {
+		log.Printf("login rate limit: %v", err)
+	} else if locked {
+		data.CreateErrorAlert(middleware.TooManyAttemptsMsg(wait))
+		middleware.SetRetryAfter(w, wait)
+		u.TwoFactorLoginView.RenderStatus(w, r, http.StatusTooManyRequests, data)
+		return
+	}
+
+	if err := u.tf.Check(user, form.Code); err != nil {
+		if err == models.ErrTOTPCodeInvalid {
+			u.loginFailed(key)
+		}
+		data.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, data)
+		return
+	}
+
+	if err := u.limits.LoginFailures.Reset(key); err != nil {
+		log.Printf("login rate limit: %v", err)
+	}
+
+	http.SetCookie(w, u.challengeCookie("", -1))
+
+	if err := u.signIn(w, r, user); err != nil {
+		data.SetAlert(err)
+		u.renderLogin(w, r, http.StatusOK, data)
+		return
+	}
+
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// GET /account/2fa
+func (u *Users) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	u.renderTwoFactor(w, r, views.Data{}, twoFactorPage{})
+}
+
+// POST /account/2fa/enroll
+//
+// A new secret replaces one from an earlier, unfinished set up.
+func (u *Users) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var data views.Data
+	user := context.GetUser(r.Context())
+
+	secret, err := u.tf.Enroll(user)
+	if err != nil {
+		data.SetAlert(err)
+		u.renderTwoFactor(w, r, data, twoFactorPage{})
+		return
+	}
+
+	u.renderTwoFactor(w, r, data, twoFactorPage{
+		Secret: secret,
+		URI:    template.URL(totp.URI(totpIssuer, user.Email, secret)),
+	})
+}
+
+// POST /account/2fa/enable
+//
+// Other sessions are signed out, they were started with the password
+// alone.
+func (u *Users) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var data views.Data
+	var form TwoFactorForm
+	user := context.GetUser(r.Context())
+
+	if err := parseForm(r, &form); err != nil {
+		data.SetAlert(err)
+		u.renderTwoFactor(w, r, data, twoFactorPage{})
+		return
+	}
+
+	codes, err := u.tf.Enable(user, form.Code)
+	if err != nil {
+		page := twoFactorPage{}
+		if err == models.ErrTOTPCodeInvalid {
+			page.Secret = user.TOTPSecret
+			page.URI = template.URL(totp.URI(totpIssuer, user.Email, user.TOTPSecret))
+		}
+		data.SetAlert(err)
+		u.renderTwoFactor(w, r, data, page)
+		return
+	}
+
+	u.signOutOthers(r, user)
+
+	data.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Two-factor authentication is on. Save your recovery codes now, they are not shown again.",
+	}
+	u.renderTwoFactor(w, r, data, twoFactorPage{
+		RecoveryCodes: codes,
+	})
+}
+
+// POST /account/2fa/disable
+//
+// Like changing the password this needs the current password, so a
+// session left open is not enough to weaken the account.
+func (u *Users) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var data views.Data
+	var form DisableTwoFactorForm
+
+	if err := parseForm(r, &form); err != nil {
+		data.SetAlert(err)
+		u.renderTwoFactor(w, r, data, twoFactorPage{})
+		return
+	}
+
+	current := context.GetUser(r.Context())
+	user, wait, err := u.confirmPassword(w, r, form.Password)
+	if wait > 0 {
+		data.CreateErrorAlert(middleware.TooManyAttemptsMsg(wait))
+		u.renderTwoFactorStatus(w, r, http.StatusTooManyRequests, data, twoFactorPage{})
+		return
+	}
+	if err != nil {
+		if err == models.ErrPasswordInvalid {
+			data.CreateErrorAlert("The password is not correct, two-factor authentication is still on.")
+		} else {
+			data.SetAlert(err)
+		}
+		u.renderTwoFactor(w, r, data, twoFactorPage{})
+		return
+	}
+
+	if err := u.tf.Disable(user.ID); err != nil {
+		data.SetAlert(err)
+		u.renderTwoFactor(w, r, data, twoFactorPage{})
+		return
+	}
+
+	current.TOTPEnabled = false
+	current.TOTPSecret = ""
+	data.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Two-factor authentication is off.",
+	}
+	u.renderTwoFactor(w, r, data, twoFactorPage{})
+}
+
+func (u *Users) renderTwoFactor(w http.ResponseWriter, r *http.Request, data views.Data, page twoFactorPage) {
+	u.renderTwoFactorStatus(w, r, http.StatusOK, data, page)
+}
+
+func (u *Users) renderTwoFactorStatus(w http.ResponseWriter, r *http.Request, status int,
+	data views.Data, page twoFactorPage) {
+	user := context.GetUser(r.Context())
+	page.Enabled = user.TOTPEnabled
+	page.Providers = u.providers
+
+	if page.Enabled {
+		n, err := u.tf.RecoveryCodesLeft(user.ID)
+		if err != nil {
+			log.Printf("counting recovery codes of user %d: %v", user.ID, err)
+		}
+		page.CodesLeft = n
+	}
+
+	data.Body = page
+	u.TwoFactorView.RenderStatus(w, r, status, data)
+}
+
+// challengeCookie holds the challenge token between the password and the
+// code. It is only sent to the code form.
+func (u *Users) challengeCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     challengeCookie,
+		Value:    value,
+		Path:     "/login/2fa",
+		MaxAge:   maxAge,
+		Secure:   u.cookie.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
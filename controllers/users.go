@@ -1,19 +1,54 @@
 package controllers
 
 import (
-	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
+	"github.com/gorilla/mux"
+	"github.com/iamtraining/gallery/context"
+	"github.com/iamtraining/gallery/email"
+	"github.com/iamtraining/gallery/middleware"
 	"github.com/iamtraining/gallery/models"
-	"github.com/iamtraining/gallery/rand"
+	"github.com/iamtraining/gallery/ratelimit"
 	"github.com/iamtraining/gallery/views"
 )
 
 type Users struct {
-	NewView   *views.View
-	LoginView *views.View
-	us        models.UserService
+	NewView      *views.View
+	LoginView    *views.View
+	SessionsView *views.View
+	ForgotPwView *views.View
+	ResetPwView  *views.View
+	VerifyView   *views.View
+	AccountView  *views.View
+	// TwoFactorView sets up and turns off two-factor authentication,
+	// TwoFactorLoginView asks for the code during login.
+	TwoFactorView      *views.View
+	TwoFactorLoginView *views.View
+	us                 models.UserService
+	ss                 models.SessionService
+	tf                 models.TwoFactorService
+	cookie             *middleware.SessionCookie
+	emailer            email.Sender
+	baseURL            string
+	accounts           AccountDeleter
+	limits             Limits
+	// providers are the identity providers offered on the login page, set
+	// by NewOAuth.
+	providers []providerLink
+}
+
+// Limits throttles the forms that take an email address, per address. The
+// limits per IP address are applied by middleware.RateLimit. Nil limiters
+// allow everything.
+type Limits struct {
+	// LoginFailures locks an address out after repeated failed logins.
+	LoginFailures *ratelimit.Limiter
+	// ResetEmails caps the password reset emails sent to an address.
+	ResetEmails *ratelimit.Limiter
 }
 
 type RegisterForm struct {
@@ -27,7 +62,17 @@ type LoginForm struct {
 	Password string `schema:"password"`
 }
 
-func NewUsers(us models.UserService) *Users {
+type ResetPwForm struct {
+	Email    string `schema:"email"`
+	Token    string `schema:"token"`
+	Password string `schema:"password"`
+}
+
+// NewUsers creates the users controller. baseURL is the public address of
+// the site, the links in emails point to it.
+func NewUsers(us models.UserService, ss models.SessionService, tf models.TwoFactorService,
+	accounts AccountDeleter, cookie *middleware.SessionCookie, emailer email.Sender,
+	baseURL string, limits Limits) *Users {
 	return &Users{
 		NewView: views.NewView(
 			"bootstrap",
@@ -37,7 +82,42 @@ func NewUsers(us models.UserService) *Users {
 			"bootstrap",
 			"users/login",
 		),
-		us: us,
+		SessionsView: views.NewView(
+			"bootstrap",
+			"users/sessions",
+		),
+		ForgotPwView: views.NewView(
+			"bootstrap",
+			"users/forgot_pw",
+		),
+		ResetPwView: views.NewView(
+			"bootstrap",
+			"users/reset_pw",
+		),
+		VerifyView: views.NewView(
+			"bootstrap",
+			"users/verify",
+		),
+		AccountView: views.NewView(
+			"bootstrap",
+			"users/account",
+		),
+		TwoFactorView: views.NewView(
+			"bootstrap",
+			"users/two_factor",
+		),
+		TwoFactorLoginView: views.NewView(
+			"bootstrap",
+			"users/login_2fa",
+		),
+		us:       us,
+		ss:       ss,
+		tf:       tf,
+		cookie:   cookie,
+		emailer:  emailer,
+		baseURL:  baseURL,
+		accounts: accounts,
+		limits:   limits,
 	}
 }
 
@@ -72,7 +152,12 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := u.signIn(w, &user)
+	// the address can still be confirmed later with a new link
+	if err := u.sendVerification(&user); err != nil {
+		log.Printf("sending verification email to user %d: %v", user.ID, err)
+	}
+
+	err := u.signIn(w, r, &user)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
@@ -88,7 +173,19 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 
 	if err := parseForm(r, &form); err != nil {
 		data.SetAlert(err)
-		u.LoginView.Render(w, r, data)
+		u.renderLogin(w, r, http.StatusOK, data)
+		return
+	}
+
+	// the address is checked before the password, so a locked out account
+	// costs no bcrypt comparison
+	key := limitKey(form.Email)
+	if locked, wait, err := u.limits.LoginFailures.Blocked(key); err != nil {
+		log.Printf("login rate limit: %v", err)
+	} else if locked {
+		data.CreateErrorAlert(middleware.TooManyAttemptsMsg(wait))
+		middleware.SetRetryAfter(w, wait)
+		u.renderLogin(w, r, http.StatusTooManyRequests, data)
 		return
 	}
 
@@ -96,60 +193,332 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		switch err {
 		case models.ErrNotFound:
+			u.loginFailed(key)
 			data.CreateErrorAlert("invalid email address")
+		case models.ErrPasswordInvalid:
+			u.loginFailed(key)
+			data.SetAlert(err)
 		default:
 			data.SetAlert(err)
 		}
-		u.LoginView.Render(w, r, data)
+		u.renderLogin(w, r, http.StatusOK, data)
 		return
 	}
 
-	err = u.signIn(w, user)
+	if err := u.limits.LoginFailures.Reset(key); err != nil {
+		log.Printf("login rate limit: %v", err)
+	}
+
+	if err := u.logIn(w, r, user); err != nil {
+		data.SetAlert(err)
+		u.renderLogin(w, r, http.StatusOK, data)
+	}
+}
+
+// GET /login
+func (u *Users) LoginPage(w http.ResponseWriter, r *http.Request) {
+	u.renderLogin(w, r, http.StatusOK, views.Data{})
+}
+
+func (u *Users) renderLogin(w http.ResponseWriter, r *http.Request, status int, data views.Data) {
+	data.Body = loginPage{
+		Providers: u.providers,
+	}
+
+	u.LoginView.RenderStatus(w, r, status, data)
+}
+
+type loginPage struct {
+	Providers []providerLink
+}
+
+func (u *Users) loginFailed(key string) {
+	if _, _, err := u.limits.LoginFailures.Allow(key); err != nil {
+		log.Printf("login rate limit: %v", err)
+	}
+}
+
+// limitKey normalizes an email address the way the user service does, so
+// variants of one address share a bucket.
+func limitKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// POST /logout
+func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
+	if session := context.GetSession(r.Context()); session != nil {
+		if err := u.ss.Delete(session.ID); err != nil {
+			log.Printf("deleting session %d: %v", session.ID, err)
+		}
+	}
+
+	u.cookie.Clear(w)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// POST /logout/all
+func (u *Users) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	user := context.GetUser(r.Context())
+	if err := u.ss.DeleteByUserID(user.ID); err != nil {
+		log.Printf("deleting sessions of user %d: %v", user.ID, err)
+	}
+
+	u.cookie.Clear(w)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// GET /sessions
+func (u *Users) Sessions(w http.ResponseWriter, r *http.Request) {
+	var data views.Data
+
+	user := context.GetUser(r.Context())
+	sessions, err := u.ss.ByUserID(user.ID)
 	if err != nil {
 		data.SetAlert(err)
-		u.LoginView.Render(w, r, data)
-		return
 	}
 
-	http.Redirect(w, r, "/galleries", http.StatusFound)
+	data.Body = sessionsPage{
+		Sessions: sessions,
+		Current:  context.GetSession(r.Context()),
+	}
+	u.SessionsView.Render(w, r, data)
 }
 
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
-	if user.Remember == "" {
-		token, err := rand.RememberToken()
-		if err != nil {
-			return err
+// POST /sessions/:id/revoke
+func (u *Users) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := context.GetUser(r.Context())
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	sessions, err := u.ss.ByUserID(user.ID)
+	if err != nil {
+		http.Error(w, "something goes wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// only sessions of the current user can be revoked
+	for _, s := range sessions {
+		if s.ID != uint(id) {
+			continue
 		}
 
-		user.Remember = token
-		err = u.us.Update(user)
-		if err != nil {
-			return err
+		if err := u.ss.Delete(s.ID); err != nil {
+			http.Error(w, "something goes wrong", http.StatusInternalServerError)
+			return
+		}
+
+		if current := context.GetSession(r.Context()); current != nil && current.ID == s.ID {
+			u.cookie.Clear(w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
 		}
-	}
 
-	cookie := http.Cookie{
-		Name:     "remember_token",
-		Value:    user.Remember,
-		HttpOnly: true,
+		break
 	}
-	http.SetCookie(w, &cookie)
 
-	return nil
+	http.Redirect(w, r, "/sessions", http.StatusFound)
 }
 
-func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("remember_token")
+// GET /forgot
+func (u *Users) ForgotPw(w http.ResponseWriter, r *http.Request) {
+	u.ForgotPwView.Render(w, r, nil)
+}
+
+// POST /forgot
+//
+// The response is the same whether or not an account exists for the email
+// address, so the form cannot be used to find out who is signed up.
+func (u *Users) InitiateReset(w http.ResponseWriter, r *http.Request) {
+	var data views.Data
+	var form ResetPwForm
+	data.Body = &form
+
+	if err := parseForm(r, &form); err != nil {
+		data.SetAlert(err)
+		u.ForgotPwView.Render(w, r, data)
+		return
+	}
+
+	ok, wait, err := u.limits.ResetEmails.Allow(limitKey(form.Email))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusFound)
+		log.Printf("password reset rate limit: %v", err)
+	} else if !ok {
+		data.CreateErrorAlert(middleware.TooManyAttemptsMsg(wait))
+		middleware.SetRetryAfter(w, wait)
+		u.ForgotPwView.RenderStatus(w, r, http.StatusTooManyRequests, data)
+		return
+	}
+
+	token, err := u.us.InitiateReset(form.Email)
+	switch err {
+	case nil:
+		resetURL := u.baseURL + "/reset?" + url.Values{"token": {token}}.Encode()
+		if err := u.emailer.Send(email.ResetPw(form.Email, resetURL)); err != nil {
+			log.Printf("sending password reset email: %v", err)
+			data.SetAlert(err)
+			u.ForgotPwView.Render(w, r, data)
+			return
+		}
+	case models.ErrNotFound:
+	default:
+		data.SetAlert(err)
+		u.ForgotPwView.Render(w, r, data)
+		return
+	}
+
+	data.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "If an account exists for this email address, instructions to reset the password have been sent to it.",
+	}
+	u.ForgotPwView.Render(w, r, data)
+}
+
+// GET /reset?token=...
+func (u *Users) ResetPw(w http.ResponseWriter, r *http.Request) {
+	var data views.Data
+	data.Body = &ResetPwForm{
+		Token: r.URL.Query().Get("token"),
+	}
+
+	u.ResetPwView.Render(w, r, data)
+}
+
+// POST /reset
+//
+// A successful reset signs the user out everywhere and starts a new
+// session on this device, after asking for the second factor if the user
+// turned it on: the emailed link alone must not get around it.
+func (u *Users) CompleteReset(w http.ResponseWriter, r *http.Request) {
+	var data views.Data
+	var form ResetPwForm
+	data.Body = &form
+
+	if err := parseForm(r, &form); err != nil {
+		data.SetAlert(err)
+		u.ResetPwView.Render(w, r, data)
 		return
 	}
 
-	user, err := u.us.ByRemember(cookie.Value)
+	user, err := u.us.CompleteReset(form.Token, form.Password)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusFound)
+		data.SetAlert(err)
+		u.ResetPwView.Render(w, r, data)
 		return
 	}
 
-	fmt.Fprintln(w, user)
+	if err := u.ss.DeleteByUserID(user.ID); err != nil {
+		log.Printf("deleting sessions of user %d: %v", user.ID, err)
+	}
+
+	if err := u.logIn(w, r, user); err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+	}
+}
+
+// GET /verify?token=...
+//
+// Without a token the page asks the user to confirm their address and
+// offers to send the link again.
+func (u *Users) Verify(w http.ResponseWriter, r *http.Request) {
+	var data views.Data
+	var page verifyPage
+	data.Body = &page
+
+	if user := context.GetUser(r.Context()); user != nil {
+		page.Email = user.Email
+		page.Verified = user.EmailVerified
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		u.VerifyView.Render(w, r, data)
+		return
+	}
+
+	if _, err := u.us.Verify(token); err != nil {
+		data.SetAlert(err)
+		u.VerifyView.Render(w, r, data)
+		return
+	}
+
+	page.Verified = true
+	data.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Thank you, your email address is confirmed.",
+	}
+	u.VerifyView.Render(w, r, data)
+}
+
+// POST /verify/resend
+func (u *Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var data views.Data
+	var page verifyPage
+	data.Body = &page
+
+	user := context.GetUser(r.Context())
+	if user.EmailVerified {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	page.Email = user.Email
+
+	if err := u.sendVerification(user); err != nil {
+		log.Printf("sending verification email to user %d: %v", user.ID, err)
+		data.SetAlert(err)
+		u.VerifyView.Render(w, r, data)
+		return
+	}
+
+	data.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "A new link has been sent to " + user.Email + ".",
+	}
+	u.VerifyView.Render(w, r, data)
+}
+
+// sendVerification emails user a link that confirms their address.
+func (u *Users) sendVerification(user *models.User) error {
+	token, err := u.us.VerificationToken(user)
+	if err != nil {
+		return err
+	}
+
+	verifyURL := u.baseURL + "/verify?" + url.Values{"token": {token}}.Encode()
+	return u.emailer.Send(email.Verify(user.Email, verifyURL))
+}
+
+type verifyPage struct {
+	// Email is the address of the signed in user, if any.
+	Email    string
+	Verified bool
+}
+
+type sessionsPage struct {
+	Sessions []models.Session
+	Current  *models.Session
+}
+
+// IsCurrent reports whether s is the session of the request being served.
+func (p sessionsPage) IsCurrent(s models.Session) bool {
+	return p.Current != nil && p.Current.ID == s.ID
+}
+
+// signIn starts a new session for user on the requesting device.
+func (u *Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	if user.Disabled {
+		return models.ErrAccountDisabled
+	}
+
+	session := models.Session{
+		UserID:    user.ID,
+		UserAgent: r.UserAgent(),
+		IP:        middleware.ClientIP(r),
+	}
+
+	if err := u.ss.Create(&session); err != nil {
+		return err
+	}
+
+	u.cookie.Set(w, &session)
+
+	return nil
 }
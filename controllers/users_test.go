@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iamtraining/gallery/models"
+	"github.com/iamtraining/gallery/ratelimit"
+	"github.com/iamtraining/gallery/views"
+)
+
+// alertView renders only the alert, the layouts are not parsed in tests.
+var alertView = &views.View{
+	Tmpl: template.Must(template.New("").Parse(
+		`{{define "bootstrap"}}{{with .Alert}}{{.Message}}{{end}}{{end}}`)),
+	Layout: "bootstrap",
+}
+
+// passwordsStub rejects every password and counts the attempts.
+type passwordsStub struct {
+	models.UserService
+	attempts int
+}
+
+func (ps *passwordsStub) Authentificate(email, password string) (*models.User, error) {
+	ps.attempts++
+	return nil, models.ErrPasswordInvalid
+}
+
+func postLogin(u *Users, email string) *httptest.ResponseRecorder {
+	form := url.Values{"email": {email}, "password": {"wrong password"}}
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	u.Login(w, r)
+
+	return w
+}
+
+func TestLoginLockout(t *testing.T) {
+	limit := ratelimit.Limit{Burst: 3, Refill: 5 * time.Minute}
+	passwords := &passwordsStub{}
+	u := &Users{
+		LoginView: alertView,
+		us:        passwords,
+		limits: Limits{
+			LoginFailures: ratelimit.New(ratelimit.NewMemoryStore(time.Hour), "login", limit),
+		},
+	}
+
+	for i := 0; i < limit.Burst; i++ {
+		if w := postLogin(u, "alice@example.com"); w.Code != http.StatusOK {
+			t.Fatalf("failed login %d: status %d, want 200", i+1, w.Code)
+		}
+	}
+
+	// variants of the address share the lockout
+	w := postLogin(u, " Alice@Example.com ")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("login after %d failures: status %d, want 429", limit.Burst, w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "300" {
+		t.Errorf("Retry-After = %q, want 300", got)
+	}
+	if !strings.HasPrefix(w.Body.String(), "Too many attempts.") {
+		t.Errorf("body = %q, want the too many attempts alert", w.Body.String())
+	}
+	if passwords.attempts != limit.Burst {
+		t.Errorf("%d passwords checked, a locked out address must not be checked", passwords.attempts)
+	}
+
+	if w := postLogin(u, "bob@example.com"); w.Code != http.StatusOK {
+		t.Errorf("login of another address: status %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,62 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+}
+
+// Sender delivers messages. Messages without a From address are sent from
+// the default address of the sender.
+type Sender interface {
+	Send(msg Message) error
+}
+
+func ResetPw(to, resetURL string) Message {
+	return Message{
+		To:      to,
+		Subject: "Reset your password",
+		Text: fmt.Sprintf("Hi,\n\n"+
+			"someone asked to reset the password of your account. If it was you, "+
+			"open the link below to choose a new password:\n\n%s\n\n"+
+			"The link is valid for one hour. If you did not ask for it, you can "+
+			"ignore this email, your password stays the same.\n", resetURL),
+	}
+}
+
+func Verify(to, verifyURL string) Message {
+	return Message{
+		To:      to,
+		Subject: "Confirm your email address",
+		Text: fmt.Sprintf("Hi,\n\n"+
+			"please confirm that this is your email address by opening the link "+
+			"below:\n\n%s\n\n"+
+			"The link is valid for two days. If you did not sign up, you can "+
+			"ignore this email.\n", verifyURL),
+	}
+}
+
+// bytes renders msg with the headers needed to send it over SMTP.
+func (msg Message) bytes(now time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", msg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(msg.Text)
+
+	return b.Bytes()
+}
@@ -0,0 +1,40 @@
+package email
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+var _ Sender = &Log{}
+
+// Log writes messages to w instead of sending them, so links in emails can
+// be followed during development and in tests.
+type Log struct {
+	mu   sync.Mutex
+	w    io.Writer
+	from string
+}
+
+func NewLog(w io.Writer, from string) *Log {
+	return &Log{
+		w:    w,
+		from: from,
+	}
+}
+
+func (l *Log) Send(msg Message) error {
+	if msg.From == "" {
+		msg.From = l.from
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.w.Write(msg.bytes(time.Now())); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(l.w, "\r\n----\r\n")
+	return err
+}
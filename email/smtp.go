@@ -0,0 +1,91 @@
+package email
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ Sender = &SMTP{}
+
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// SMTP sends messages through an SMTP server. The connection is upgraded
+// with STARTTLS when the server offers it, which it must before the
+// credentials are sent.
+type SMTP struct {
+	cfg SMTPConfig
+	// from is the default From header, fromAddr the bare address in it
+	// that the server is given as the envelope sender.
+	from     string
+	fromAddr string
+}
+
+func NewSMTP(cfg SMTPConfig, from string) (*SMTP, error) {
+	if cfg.Host == "" {
+		return nil, fmt.Errorf("email: smtp host is required")
+	}
+
+	if from == "" {
+		return nil, fmt.Errorf("email: from address is required")
+	}
+
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("email: invalid from address %q: %v", from, err)
+	}
+
+	if cfg.Port == 0 {
+		cfg.Port = 587
+	}
+
+	return &SMTP{
+		cfg:      cfg,
+		from:     from,
+		fromAddr: addr.Address,
+	}, nil
+}
+
+// Send uses the bare addresses of From and To for the envelope, the
+// headers keep them as they are, display names included.
+func (s *SMTP) Send(msg Message) error {
+	envelopeFrom := s.fromAddr
+	if msg.From == "" {
+		msg.From = s.from
+	} else {
+		addr, err := mail.ParseAddress(msg.From)
+		if err != nil {
+			return fmt.Errorf("email: invalid from address %q: %v", msg.From, err)
+		}
+		envelopeFrom = addr.Address
+	}
+
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("email: invalid to address %q: %v", msg.To, err)
+	}
+
+	// header injection through the addresses or the subject
+	for _, v := range []string{msg.From, msg.To, msg.Subject} {
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("email: header contains a line break")
+		}
+	}
+
+	var auth smtp.Auth
+	if s.cfg.Username != "" {
+		auth = smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)
+	}
+
+	addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+	return smtp.SendMail(addr, auth, envelopeFrom, []string{to.Address}, msg.bytes(time.Now()))
+}
@@ -0,0 +1,161 @@
+package email
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeSMTP accepts one message and records the commands it was sent and
+// the message itself.
+type fakeSMTP struct {
+	commands []string
+	data     string
+	done     chan struct{}
+}
+
+func newFakeSMTP(t *testing.T) (*fakeSMTP, SMTPConfig) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	f := &fakeSMTP{done: make(chan struct{})}
+	go f.serve(l)
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	return f, SMTPConfig{Host: host, Port: p}
+}
+
+func (f *fakeSMTP) serve(l net.Listener) {
+	defer close(f.done)
+
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		f.commands = append(f.commands, line)
+
+		switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			f.data = data.String()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestNewSMTPInvalidFrom(t *testing.T) {
+	for _, from := range []string{"Gallery", "Gallery <no-reply", "no-reply@localhost\r\nBcc: x@example.com"} {
+		if _, err := NewSMTP(SMTPConfig{Host: "localhost"}, from); err == nil {
+			t.Errorf("NewSMTP(%q) succeeded, want an error", from)
+		}
+	}
+}
+
+func TestSMTPSendEnvelope(t *testing.T) {
+	cases := []struct {
+		name       string
+		from       string
+		wantMail   string
+		wantHeader string
+	}{
+		{"default", "", "MAIL FROM:<no-reply@localhost>", "From: Gallery <no-reply@localhost>\r\n"},
+		{"own", "Support <help@example.com>", "MAIL FROM:<help@example.com>", "From: Support <help@example.com>\r\n"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, cfg := newFakeSMTP(t)
+
+			s, err := NewSMTP(cfg, "Gallery <no-reply@localhost>")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.Send(Message{
+				From:    tc.from,
+				To:      "Alice <alice@example.com>",
+				Subject: "hi",
+				Text:    "hello\r\n",
+			})
+			if err != nil {
+				t.Fatalf("Send() = %v", err)
+			}
+			<-f.done
+
+			var mail, rcpt string
+			for _, cmd := range f.commands {
+				switch {
+				case strings.HasPrefix(cmd, "MAIL FROM:"):
+					mail = cmd
+				case strings.HasPrefix(cmd, "RCPT TO:"):
+					rcpt = cmd
+				}
+			}
+			if !strings.HasPrefix(mail, tc.wantMail) {
+				t.Errorf("MAIL command = %q, want %q", mail, tc.wantMail)
+			}
+			if rcpt != "RCPT TO:<alice@example.com>" {
+				t.Errorf("RCPT command = %q, want the bare address", rcpt)
+			}
+			if !strings.Contains(f.data, tc.wantHeader) {
+				t.Errorf("message has no %q header:\n%s", tc.wantHeader, f.data)
+			}
+		})
+	}
+}
+
+func TestSMTPSendInvalidAddress(t *testing.T) {
+	s, err := NewSMTP(SMTPConfig{Host: "localhost"}, "no-reply@localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rejected before connecting to the server
+	for _, msg := range []Message{
+		{To: "not an address"},
+		{From: "Gallery", To: "alice@example.com"},
+	} {
+		if err := s.Send(msg); err == nil {
+			t.Errorf("Send(%+v) succeeded, want an error", msg)
+		}
+	}
+}
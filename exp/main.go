@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/iamtraining/gallery/hash"
 	"github.com/iamtraining/gallery/models"
 )
 
@@ -15,16 +17,30 @@ const (
 )
 
 func main() {
-	psql := fmt.Sprintf("host=%s port =%d user=%s "+
+	psql := fmt.Sprintf("host=%s port=%d user=%s "+
 		"password=%s dbname=%s sslmode=disable",
 		host, port, user, password, dbname)
 
-	us, err := models.NewUserService(psql)
+	serv, err := models.NewServices(
+		models.WithGorm("postgres", psql),
+		models.WithUser(
+			[]hash.Key{{Secret: "secret-random-string"}},
+			[]hash.Key{{Secret: "secret-hmac-key"}},
+		),
+		models.WithSession([]hash.Key{{Secret: "secret-hmac-key"}}, models.SessionTimeouts{
+			Absolute: 30 * 24 * time.Hour,
+			Idle:     7 * 24 * time.Hour,
+			Renew:    24 * time.Hour,
+		}),
+	)
 	if err != nil {
 		panic(err)
 	}
-	defer us.Close()
-	us.AutoMigrate()
+	defer serv.Close()
+	if _, err := serv.MigrateUp(); err != nil {
+		panic(err)
+	}
+	us := serv.User
 
 	user := models.User{
 		Name:     "Michael Scott",
@@ -37,13 +53,15 @@ func main() {
 	}
 
 	fmt.Printf("%+v\n", user)
-	if user.Remember == "" {
-		panic("invalid remember token")
+
+	session := models.Session{UserID: user.ID}
+	if err = serv.Session.Create(&session); err != nil {
+		panic(err)
 	}
 
-	user2, err := us.ByRemember(user.Remember)
+	session2, err := serv.Session.ByToken(session.Token)
 	if err != nil {
 		panic(err)
 	}
-	fmt.Printf("%+v\n", user2)
+	fmt.Printf("%+v\n", session2)
 }
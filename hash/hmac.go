@@ -4,23 +4,55 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
-	"hash"
 )
 
+// Key is a secret with an ID, so that secrets can be rotated while the
+// values made with older ones stay usable.
+type Key struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+// HMAC hashes with the first of its keys. The others are previous keys:
+// hashes made with them are still found through Hashes and Verify.
 type HMAC struct {
-	hmac hash.Hash
+	keys []Key
 }
 
-func NewHMAC(key string) HMAC {
-	h := hmac.New(sha256.New, []byte(key))
+func NewHMAC(keys ...Key) HMAC {
 	return HMAC{
-		hmac: h,
+		keys: keys,
 	}
 }
 
+// Hash returns the hash of input under the current key.
 func (h HMAC) Hash(input string) string {
-	h.hmac.Reset()
-	h.hmac.Write([]byte(input))
-	b := h.hmac.Sum(nil)
-	return base64.URLEncoding.EncodeToString(b)
+	return hashWith(h.keys[0], input)
+}
+
+// Hashes returns the hash of input under every key, the current one first.
+func (h HMAC) Hashes(input string) []string {
+	hashes := make([]string, len(h.keys))
+	for i, key := range h.keys {
+		hashes[i] = hashWith(key, input)
+	}
+
+	return hashes
+}
+
+// Verify reports whether sum is the hash of input under any of the keys.
+func (h HMAC) Verify(input, sum string) bool {
+	for _, hash := range h.Hashes(input) {
+		if hmac.Equal([]byte(hash), []byte(sum)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hashWith(key Key, input string) string {
+	m := hmac.New(sha256.New, []byte(key.Secret))
+	m.Write([]byte(input))
+	return base64.URLEncoding.EncodeToString(m.Sum(nil))
 }
@@ -0,0 +1,64 @@
+package hash
+
+import (
+	"testing"
+)
+
+var (
+	current  = Key{ID: "2", Secret: "current"}
+	previous = Key{ID: "1", Secret: "previous"}
+)
+
+func TestHMACHashUsesCurrentKey(t *testing.T) {
+	h := NewHMAC(current, previous)
+
+	if got, want := h.Hash("input"), NewHMAC(current).Hash("input"); got != want {
+		t.Errorf("Hash() = %q, want the hash under the current key %q", got, want)
+	}
+
+	if h.Hash("input") == NewHMAC(previous).Hash("input") {
+		t.Error("the keys give the same hash")
+	}
+
+	if h.Hash("input") == h.Hash("other input") {
+		t.Error("different inputs give the same hash")
+	}
+}
+
+func TestHMACHashes(t *testing.T) {
+	h := NewHMAC(current, previous)
+
+	hashes := h.Hashes("input")
+	want := []string{NewHMAC(current).Hash("input"), NewHMAC(previous).Hash("input")}
+	if len(hashes) != len(want) || hashes[0] != want[0] || hashes[1] != want[1] {
+		t.Errorf("Hashes() = %v, want %v, the current key first", hashes, want)
+	}
+}
+
+func TestHMACVerify(t *testing.T) {
+	rotated := NewHMAC(current, previous)
+
+	cases := []struct {
+		name string
+		sum  string
+		want bool
+	}{
+		{"current key", NewHMAC(current).Hash("input"), true},
+		{"previous key", NewHMAC(previous).Hash("input"), true},
+		{"removed key", NewHMAC(Key{ID: "0", Secret: "removed"}).Hash("input"), false},
+		{"other input", NewHMAC(current).Hash("other input"), false},
+		{"empty", "", false},
+	}
+
+	for _, tc := range cases {
+		if got := rotated.Verify("input", tc.sum); got != tc.want {
+			t.Errorf("%s: Verify() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// the ID is only a label, hashes depend on the secret alone
+	renamed := NewHMAC(Key{ID: "renamed", Secret: current.Secret})
+	if !renamed.Verify("input", NewHMAC(current).Hash("input")) {
+		t.Error("Verify() depends on the ID of the key")
+	}
+}
@@ -0,0 +1,206 @@
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ Provider = &OIDC{}
+
+var validName = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+type OIDCConfig struct {
+	// Name is used in the callback URL, /auth/<name>/callback, which has to
+	// be registered with the provider.
+	Name         string   `json:"name"`
+	DisplayName  string   `json:"display_name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+}
+
+// OIDC is an OpenID Connect provider using the authorization code flow.
+// The endpoints are discovered from the issuer on first use, so the server
+// starts even while the provider is unreachable.
+type OIDC struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+	keys      *keySet
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func NewOIDC(cfg OIDCConfig) (*OIDC, error) {
+	if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientID == "" {
+		return nil, fmt.Errorf("idp: oidc provider needs a name, an issuer and a client id")
+	}
+
+	if !validName.MatchString(cfg.Name) {
+		return nil, fmt.Errorf("idp: oidc provider name %q may only contain a-z, 0-9 and -", cfg.Name)
+	}
+
+	if cfg.DisplayName == "" {
+		cfg.DisplayName = cfg.Name
+	}
+
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	return &OIDC{
+		cfg:    cfg,
+		client: client,
+	}, nil
+}
+
+func (o *OIDC) Name() string {
+	return o.cfg.Name
+}
+
+func (o *OIDC) DisplayName() string {
+	return o.cfg.DisplayName
+}
+
+func (o *OIDC) AuthURL(ctx context.Context, state, nonce, redirectURI string) (string, error) {
+	d, err := o.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", o.cfg.ClientID)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("scope", strings.Join(o.cfg.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+func (o *OIDC) Identify(ctx context.Context, code, nonce, redirectURI string) (*Identity, error) {
+	d, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURI},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(o.cfg.ClientSecret))
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := doJSON(o.client, req, &token); err != nil {
+		return nil, fmt.Errorf("idp: exchanging the code: %v", err)
+	}
+
+	if token.IDToken == "" {
+		return nil, fmt.Errorf("idp: the token response has no id token")
+	}
+
+	claims, err := o.verify(ctx, token.IDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Nonce != nonce {
+		return nil, ErrInvalidToken
+	}
+
+	return &Identity{
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		Name:          claims.Name,
+	}, nil
+}
+
+// discover loads the provider metadata once. Failures are not cached so a
+// provider that was down is tried again on the next login.
+func (o *OIDC) discover(ctx context.Context) (*discovery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+
+	issuer := strings.TrimSuffix(o.cfg.Issuer, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var d discovery
+	if err := doJSON(o.client, req, &d); err != nil {
+		return nil, fmt.Errorf("idp: discovering %s: %v", o.cfg.Issuer, err)
+	}
+
+	if strings.TrimSuffix(d.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("idp: %s reports the issuer %q", o.cfg.Issuer, d.Issuer)
+	}
+
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("idp: the metadata of %s is incomplete", o.cfg.Issuer)
+	}
+
+	o.discovery = &d
+	o.keys = newKeySet(o.client, d.JWKSURI)
+
+	return o.discovery, nil
+}
+
+// doJSON sends req and decodes the JSON response into v.
+func doJSON(client *http.Client, req *http.Request, v interface{}) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body := io.LimitReader(res.Body, 1<<20)
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(body)
+		return fmt.Errorf("%s responded %d: %s", req.URL, res.StatusCode, msg)
+	}
+
+	return json.NewDecoder(body).Decode(v)
+}
@@ -0,0 +1,354 @@
+package idp
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "gallery"
+	testClientSecret = "client-secret"
+	testCode         = "the-code"
+	testNonce        = "the-nonce"
+	testRedirectURI  = "https://gallery.example.com/auth/test/callback"
+)
+
+var (
+	rsaKeyOnce sync.Once
+	rsaKeys    [2]*rsa.PrivateKey
+)
+
+// testRSAKeys returns two RSA keys, generated once for all tests.
+func testRSAKeys(t *testing.T) (*rsa.PrivateKey, *rsa.PrivateKey) {
+	rsaKeyOnce.Do(func() {
+		for i := range rsaKeys {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rsaKeys[i] = key
+		}
+	})
+
+	return rsaKeys[0], rsaKeys[1]
+}
+
+// fakeIssuer serves the discovery document, the signing keys and the
+// token endpoint of an OpenID Connect provider.
+type fakeIssuer struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	mu         sync.Mutex
+	keys       map[string]crypto.PublicKey
+	idToken    string
+	keyFetches int
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	f := &fakeIssuer{
+		t:    t,
+		keys: make(map[string]crypto.PublicKey),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", f.discovery)
+	mux.HandleFunc("/keys", f.jwks)
+	mux.HandleFunc("/token", f.token)
+
+	f.srv = httptest.NewServer(mux)
+	t.Cleanup(f.srv.Close)
+
+	return f
+}
+
+func (f *fakeIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(discovery{
+		Issuer:                f.srv.URL,
+		AuthorizationEndpoint: f.srv.URL + "/authorize",
+		TokenEndpoint:         f.srv.URL + "/token",
+		JWKSURI:               f.srv.URL + "/keys",
+	})
+}
+
+func (f *fakeIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.keyFetches++
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	for kid, key := range f.keys {
+		k := jwk{Kid: kid, Use: "sig"}
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			k.Kty = "RSA"
+			k.N = encodeBigInt(key.N)
+			k.E = encodeBigInt(big.NewInt(int64(key.E)))
+		case *ecdsa.PublicKey:
+			k.Kty = "EC"
+			k.Crv = "P-256"
+			k.X = encodeBigInt(key.X)
+			k.Y = encodeBigInt(key.Y)
+		}
+		set.Keys = append(set.Keys, k)
+	}
+
+	json.NewEncoder(w).Encode(set)
+}
+
+func (f *fakeIssuer) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if r.Method != http.MethodPost || !ok || id != testClientID || secret != testClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("code") != testCode ||
+		r.PostFormValue("redirect_uri") != testRedirectURI {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]string{"id_token": f.idToken})
+}
+
+// setKeys replaces the signing keys, by kid.
+func (f *fakeIssuer) setKeys(keys map[string]crypto.PublicKey) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.keys = keys
+}
+
+func (f *fakeIssuer) issue(token string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.idToken = token
+}
+
+func (f *fakeIssuer) fetches() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.keyFetches
+}
+
+// claims returns valid claims for the test client.
+func (f *fakeIssuer) claims() map[string]interface{} {
+	now := time.Now()
+
+	return map[string]interface{}{
+		"iss":            f.srv.URL,
+		"sub":            "user-1",
+		"aud":            testClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          testNonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+	}
+}
+
+func (f *fakeIssuer) provider(t *testing.T) *OIDC {
+	o, err := NewOIDC(OIDCConfig{
+		Name:         "test",
+		Issuer:       f.srv.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return o
+}
+
+// signToken makes a JWT of header and claims signed with key, which may
+// be nil for an unsigned token.
+func signToken(t *testing.T, header, claims map[string]interface{}, key crypto.Signer) string {
+	t.Helper()
+
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func TestOIDCIdentify(t *testing.T) {
+	key, otherKey := testRSAKeys(t)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "rsa"}
+
+	cases := []struct {
+		name   string
+		header map[string]interface{}
+		claims func(c map[string]interface{})
+		key    crypto.Signer
+		want   error
+	}{
+		{"valid", rs256, nil, key, nil},
+		{"valid es256", map[string]interface{}{"alg": "ES256", "kid": "ec"}, nil, ecKey, nil},
+		{"audience list", rs256, func(c map[string]interface{}) {
+			c["aud"] = []string{"other", testClientID}
+		}, key, nil},
+		{"email verified as string", rs256, func(c map[string]interface{}) {
+			c["email_verified"] = "true"
+		}, key, nil},
+		{"bad signature", rs256, nil, otherKey, ErrInvalidToken},
+		{"alg none", map[string]interface{}{"alg": "none", "kid": "rsa"}, nil, nil, ErrInvalidToken},
+		{"alg none without kid", map[string]interface{}{"alg": "none"}, nil, nil, ErrInvalidToken},
+		{"alg hs256", map[string]interface{}{"alg": "HS256", "kid": "rsa"}, nil, key, ErrInvalidToken},
+		{"es256 alg with rsa key", map[string]interface{}{"alg": "ES256", "kid": "rsa"}, nil, key, ErrInvalidToken},
+		{"wrong audience", rs256, func(c map[string]interface{}) {
+			c["aud"] = "other"
+		}, key, ErrInvalidToken},
+		{"wrong issuer", rs256, func(c map[string]interface{}) {
+			c["iss"] = "https://evil.example.com"
+		}, key, ErrInvalidToken},
+		{"expired", rs256, func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-2 * clockSkew).Unix()
+		}, key, ErrInvalidToken},
+		{"issued in the future", rs256, func(c map[string]interface{}) {
+			c["iat"] = time.Now().Add(2 * clockSkew).Unix()
+		}, key, ErrInvalidToken},
+		{"no subject", rs256, func(c map[string]interface{}) {
+			delete(c, "sub")
+		}, key, ErrInvalidToken},
+		{"nonce mismatch", rs256, func(c map[string]interface{}) {
+			c["nonce"] = "another-nonce"
+		}, key, ErrInvalidToken},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeIssuer(t)
+			f.setKeys(map[string]crypto.PublicKey{
+				"rsa": &key.PublicKey,
+				"ec":  &ecKey.PublicKey,
+			})
+
+			claims := f.claims()
+			if tc.claims != nil {
+				tc.claims(claims)
+			}
+			f.issue(signToken(t, tc.header, claims, tc.key))
+
+			id, err := f.provider(t).Identify(context.Background(), testCode, testNonce, testRedirectURI)
+			if err != tc.want {
+				t.Fatalf("Identify() = %v, want %v", err, tc.want)
+			}
+			if err != nil {
+				return
+			}
+
+			want := Identity{Subject: "user-1", Email: "alice@example.com", EmailVerified: true, Name: "Alice"}
+			if *id != want {
+				t.Errorf("Identify() = %+v, want %+v", *id, want)
+			}
+		})
+	}
+}
+
+func TestOIDCUnknownKeyRefetch(t *testing.T) {
+	key, rotated := testRSAKeys(t)
+
+	f := newFakeIssuer(t)
+	f.setKeys(map[string]crypto.PublicKey{"old": &key.PublicKey})
+	o := f.provider(t)
+
+	identify := func(kid string, key *rsa.PrivateKey) error {
+		f.issue(signToken(t, map[string]interface{}{"alg": "RS256", "kid": kid}, f.claims(), key))
+		_, err := o.Identify(context.Background(), testCode, testNonce, testRedirectURI)
+		return err
+	}
+
+	if err := identify("old", key); err != nil {
+		t.Fatalf("Identify() with the first key = %v", err)
+	}
+	if n := f.fetches(); n != 1 {
+		t.Fatalf("keys fetched %d times, want 1", n)
+	}
+
+	// the provider rotates its key
+	f.setKeys(map[string]crypto.PublicKey{"new": &rotated.PublicKey})
+
+	// right after a fetch an unknown kid does not make the keys be fetched
+	// again, so tokens with made up kids cannot flood the provider
+	if err := identify("new", rotated); err != ErrInvalidToken {
+		t.Fatalf("Identify() with an unknown kid right after a fetch = %v, want ErrInvalidToken", err)
+	}
+	if n := f.fetches(); n != 1 {
+		t.Fatalf("keys fetched %d times, want 1", n)
+	}
+
+	o.keys.mu.Lock()
+	o.keys.fetched = time.Now().Add(-refetchInterval)
+	o.keys.mu.Unlock()
+
+	if err := identify("new", rotated); err != nil {
+		t.Fatalf("Identify() with the rotated key = %v", err)
+	}
+	if n := f.fetches(); n != 2 {
+		t.Errorf("keys fetched %d times, want 2", n)
+	}
+
+	// the old key is gone with the refetch
+	if err := identify("old", key); err != ErrInvalidToken {
+		t.Errorf("Identify() with the removed key = %v, want ErrInvalidToken", err)
+	}
+}
@@ -0,0 +1,37 @@
+// Package idp signs users in through external identity providers. Every
+// provider implements Provider; OIDC is a generic OpenID Connect provider.
+package idp
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrInvalidToken is returned for ID tokens that fail verification.
+var ErrInvalidToken = errors.New("idp: invalid id token")
+
+// Identity is a user as the provider knows them.
+type Identity struct {
+	// Subject identifies the user at the provider and never changes.
+	Subject string
+	Email   string
+	// EmailVerified is set if the provider confirmed that Email belongs
+	// to the user.
+	EmailVerified bool
+	Name          string
+}
+
+// Provider is an identity provider that signs users in with a browser
+// redirect and an authorization code.
+type Provider interface {
+	// Name identifies the provider in URLs and the database.
+	Name() string
+	// DisplayName is shown on the login page.
+	DisplayName() string
+	// AuthURL returns where to send the user to sign in. state and nonce
+	// must come back unchanged to the callback at redirectURI.
+	AuthURL(ctx context.Context, state, nonce, redirectURI string) (string, error)
+	// Identify exchanges the code the provider sent to the callback for
+	// the identity of the user.
+	Identify(ctx context.Context, code, nonce, redirectURI string) (*Identity, error)
+}
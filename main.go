@@ -1,47 +1,111 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net/http"
+	"os"
 
 	"github.com/gorilla/mux"
 	"github.com/iamtraining/gallery/controllers"
 	"github.com/iamtraining/gallery/middleware"
 	"github.com/iamtraining/gallery/models"
+	"github.com/iamtraining/gallery/ratelimit"
 )
 
 //601-627
 //pagination?
-const (
-	host     = "localhost"
-	port     = 5432
-	user     = "postgres"
-	password = "1111"
-	dbname   = "gallery_dev"
-)
-
 func main() {
-	psql := fmt.Sprintf("host=%s port =%d user=%s "+
-		"password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
+	env := flag.String("env", envFromEnviron(), "configuration profile: dev or prod")
+	cfgPath := flag.String("config", "", "path to the JSON config file (default config.<env>.json)")
+	flag.Parse()
+
+	if *cfgPath == "" {
+		*cfgPath = fmt.Sprintf("config.%s.json", *env)
+	}
+
+	cfg, err := LoadConfig(*env, *cfgPath)
+	if err != nil {
+		panic(err)
+	}
+	dbCfg := cfg.Database
+
+	store, err := cfg.Storage.Open()
+	if err != nil {
+		panic(err)
+	}
 
-	serv, err := models.NewServices(psql)
+	emailer, err := cfg.Email.Open()
+	if err != nil {
+		panic(err)
+	}
+
+	providers, err := cfg.IdentityProviders()
+	if err != nil {
+		panic(err)
+	}
+
+	serv, err := models.NewServices(
+		models.WithGorm(dbCfg.Dialect(), dbCfg.ConnectionInfo()),
+		models.WithLogMode(cfg.LogSQL),
+		models.WithUser(cfg.PepperKeyring(), cfg.HMACKeyring()),
+		models.WithSession(cfg.HMACKeyring(), cfg.Session.Timeouts()),
+		models.WithIdentity(),
+		models.WithTwoFactor(cfg.HMACKeyring()),
+		models.WithAPIToken(cfg.HMACKeyring()),
+		models.WithGallery(),
+		models.WithCollaborator(),
+		models.WithImg(store, cfg.Upload.MaxFileSize, cfg.Upload.MaxPixels),
+	)
 	if err != nil {
 		panic(err)
 	}
 	defer serv.Close()
-	serv.DestructiveReset()
+
+	if flag.NArg() > 0 {
+		if err := runCommand(serv, flag.Args()); err != nil {
+			serv.Close()
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cfg.AutoMigrate {
+		if _, err := serv.MigrateUp(); err != nil {
+			panic(err)
+		}
+	}
 
 	r := mux.NewRouter()
 
+	cookie := cfg.Session.Cookie()
+
+	// a nil limiter allows everything
+	var ipLimiter *ratelimit.Limiter
+	var limits controllers.Limits
+	if rl := cfg.RateLimit; rl.Enabled {
+		// idle buckets are full again by the time they are dropped
+		limitStore := ratelimit.NewMemoryStore(rl.MaxIdle())
+		ipLimiter = ratelimit.New(limitStore, "ip", rl.IP.Limit())
+		limits = controllers.Limits{
+			LoginFailures: ratelimit.New(limitStore, "login", rl.LoginFailures.Limit()),
+			ResetEmails:   ratelimit.New(limitStore, "reset", rl.ResetEmails.Limit()),
+		}
+	}
+	throttle := middleware.NewRateLimit(ipLimiter)
+
 	static := controllers.NewStatic()
-	uc := controllers.NewUsers(serv.User)
-	gc := controllers.NewGalleries(serv.Gallery, serv.Img, r)
+	uc := controllers.NewUsers(serv.User, serv.Session, serv.TwoFactor, serv, cookie, emailer, cfg.BaseURL, limits)
+	gc := controllers.NewGalleries(serv.Gallery, serv.Img, serv.Collaborator, r)
 
 	require := middleware.RequireUser{}
 
 	mw := middleware.User{
 		UserService: serv.User,
+		Sessions:    serv.Session,
+		APITokens:   serv.APIToken,
+		Cookie:      cookie,
 	}
 
 	//newGallery := userMw1.Apply(gc.New)
@@ -54,18 +118,49 @@ func main() {
 
 	// user
 	r.HandleFunc("/signup", uc.New).Methods("GET")
-	r.HandleFunc("/signup", uc.Create).Methods("POST")
-	r.Handle("/login", uc.LoginView).Methods("GET")
-	r.HandleFunc("/login", uc.Login).Methods("POST")
-	r.HandleFunc("/cookietest", uc.CookieTest).Methods("GET")
+	r.HandleFunc("/signup", throttle.ApplyFn(uc.Create)).Methods("POST")
+	r.HandleFunc("/login", uc.LoginPage).Methods("GET")
+	r.HandleFunc("/login", throttle.ApplyFn(uc.Login)).Methods("POST")
+	r.HandleFunc("/login/2fa", uc.TwoFactorLogin).Methods("GET")
+	r.HandleFunc("/login/2fa", throttle.ApplyFn(uc.CompleteTwoFactorLogin)).Methods("POST")
+	r.HandleFunc("/forgot", uc.ForgotPw).Methods("GET")
+	r.HandleFunc("/forgot", throttle.ApplyFn(uc.InitiateReset)).Methods("POST")
+	r.HandleFunc("/reset", uc.ResetPw).Methods("GET")
+	r.HandleFunc("/reset", throttle.ApplyFn(uc.CompleteReset)).Methods("POST")
+	r.HandleFunc("/verify", uc.Verify).Methods("GET")
+	r.HandleFunc("/verify/resend", require.ApplyFn(uc.ResendVerification)).Methods("POST")
+	r.HandleFunc("/account", require.ApplyFn(uc.Account)).Methods("GET")
+	r.HandleFunc("/account/profile", require.ApplyFn(uc.UpdateAccount)).Methods("POST")
+	r.HandleFunc("/account/password", require.ApplyFn(uc.UpdatePassword)).Methods("POST")
+	r.HandleFunc("/account/delete", require.ApplyFn(uc.DeleteAccount)).Methods("POST")
+	r.HandleFunc("/account/2fa", require.ApplyFn(uc.TwoFactor)).Methods("GET")
+	r.HandleFunc("/account/2fa/enroll", require.ApplyFn(uc.EnrollTwoFactor)).Methods("POST")
+	r.HandleFunc("/account/2fa/enable", require.ApplyFn(uc.EnableTwoFactor)).Methods("POST")
+	r.HandleFunc("/account/2fa/disable", require.ApplyFn(uc.DisableTwoFactor)).Methods("POST")
+	tc := controllers.NewAPITokens(serv.APIToken)
+	r.HandleFunc("/account/tokens", require.ApplyFn(tc.Index)).Methods("GET")
+	r.HandleFunc("/account/tokens", require.ApplyFn(tc.Create)).Methods("POST")
+	r.HandleFunc("/account/tokens/{id:[0-9]+}/revoke", require.ApplyFn(tc.Revoke)).
+		Methods("POST")
+	r.HandleFunc("/logout", require.ApplyFn(uc.Logout)).Methods("POST")
+	r.HandleFunc("/logout/all", require.ApplyFn(uc.LogoutAll)).Methods("POST")
+	r.HandleFunc("/sessions", require.ApplyFn(uc.Sessions)).Methods("GET")
+	r.HandleFunc("/sessions/{id:[0-9]+}/revoke", require.ApplyFn(uc.RevokeSession)).
+		Methods("POST")
+
+	// external identity providers
+	oc := controllers.NewOAuth(providers, serv, uc, cfg.BaseURL)
+	r.HandleFunc("/auth/{provider}/login", oc.Login).Methods("GET")
+	r.HandleFunc("/auth/{provider}/callback", oc.Callback).Methods("GET")
 
 	// gallery
-	r.Handle("/galleries/new", require.Apply(gc.New)).Methods("GET")
+	verified := middleware.RequireVerified{Enabled: cfg.RequireVerifiedEmail}
+	r.Handle("/galleries/new", require.ApplyFn(verified.Apply(gc.New))).Methods("GET")
 	r.Handle("/galleries", require.ApplyFn(gc.Index)).
 		Methods("GET").Name(controllers.IndexGallery)
 	r.HandleFunc("/galleries/{id:[0-9]+}", gc.Show).
 		Methods("GET").Name(controllers.ShowGallery)
-	r.Handle("/galleries", require.ApplyFn(gc.Create)).
+	r.Handle("/galleries", require.ApplyFn(verified.ApplyFn(gc.Create))).
 		Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/edit", require.ApplyFn(gc.Edit)).
 		Methods("GET").Name(controllers.EditGallery)
@@ -73,17 +168,85 @@ func main() {
 		Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/delete", require.ApplyFn(gc.Delete)).
 		Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}/images", require.ApplyFn(gc.UploadImg)).
+	r.HandleFunc("/galleries/{id:[0-9]+}/images", require.ApplyFn(verified.ApplyFn(gc.UploadImg))).
 		Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete",
 		require.ApplyFn(gc.ImgDelete)).
 		Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/collaborators", require.ApplyFn(gc.InviteCollaborator)).
+		Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/collaborators/{collaboratorID:[0-9]+}/remove",
+		require.ApplyFn(gc.RemoveCollaborator)).
+		Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/share/regenerate", require.ApplyFn(gc.RegenerateShareLink)).
+		Methods("POST")
+
+	r.HandleFunc("/g/{slug}", gc.ShowShared).Methods("GET")
+
+	// json api
+	api := controllers.NewAPI(serv.Gallery, serv.Img, serv.Collaborator, cfg.Upload.MaxRequestSize)
+	requireAPI := middleware.RequireAPIUser{}
+	verifiedAPI := middleware.RequireAPIVerified{Enabled: cfg.RequireVerifiedEmail}
+	// requests with an API token are limited to its scopes
+	readGalleries := middleware.RequireScope{Scope: models.ScopeGalleriesRead}
+	writeGalleries := middleware.RequireScope{Scope: models.ScopeGalleriesWrite}
+	writeImages := middleware.RequireScope{Scope: models.ScopeImagesWrite}
+	ar := r.PathPrefix("/api/v1").Subrouter()
+	ar.NotFoundHandler = http.HandlerFunc(api.NotFound)
+	ar.HandleFunc("/galleries", requireAPI.ApplyFn(readGalleries.ApplyFn(api.Index))).Methods("GET")
+	ar.HandleFunc("/galleries", requireAPI.ApplyFn(writeGalleries.ApplyFn(verifiedAPI.ApplyFn(api.Create)))).
+		Methods("POST")
+	ar.HandleFunc("/galleries/{id:[0-9]+}", readGalleries.ApplyFn(api.Show)).Methods("GET")
+	ar.HandleFunc("/galleries/{id:[0-9]+}", requireAPI.ApplyFn(writeGalleries.ApplyFn(api.Update))).
+		Methods("PATCH", "PUT")
+	ar.HandleFunc("/galleries/{id:[0-9]+}", requireAPI.ApplyFn(writeGalleries.ApplyFn(api.Delete))).
+		Methods("DELETE")
+	ar.HandleFunc("/galleries/{id:[0-9]+}/images", readGalleries.ApplyFn(api.Images)).Methods("GET")
+	ar.HandleFunc("/galleries/{id:[0-9]+}/images",
+		requireAPI.ApplyFn(writeImages.ApplyFn(verifiedAPI.ApplyFn(api.UploadImg)))).
+		Methods("POST")
+	ar.HandleFunc("/galleries/{id:[0-9]+}/images/{imageID:[0-9]+}",
+		requireAPI.ApplyFn(writeImages.ApplyFn(api.ImgDelete))).
+		Methods("DELETE")
+
+	// images
+	ic := controllers.NewImages(store, serv.Gallery, serv.Collaborator)
+	r.HandleFunc("/images/galleries/{id:[0-9]+}/{file:.+}", ic.Show).
+		Methods("GET", "HEAD")
+	r.HandleFunc("/g/{slug}/images/{file:.+}", ic.ShowShared).
+		Methods("GET", "HEAD")
+
+	// admin area
+	ac := controllers.NewAdmin(serv.User, serv.Session, serv.Gallery)
+	moderator := middleware.RequireRole{Role: models.RoleModerator}
+	admin := middleware.RequireRole{Role: models.RoleAdmin}
+	r.Handle("/admin", moderator.Apply(http.RedirectHandler("/admin/users", http.StatusFound))).
+		Methods("GET")
+	r.HandleFunc("/admin/users", moderator.ApplyFn(ac.Users)).Methods("GET")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/disable", moderator.ApplyFn(ac.DisableUser)).
+		Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/enable", moderator.ApplyFn(ac.EnableUser)).
+		Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/role", admin.ApplyFn(ac.SetRole)).
+		Methods("POST")
+	r.HandleFunc("/admin/galleries", moderator.ApplyFn(ac.Galleries)).Methods("GET")
+	r.HandleFunc("/admin/galleries/{id:[0-9]+}/takedown", moderator.ApplyFn(ac.TakeDownGallery)).
+		Methods("POST")
+	r.HandleFunc("/admin/galleries/{id:[0-9]+}/restore", moderator.ApplyFn(ac.RestoreGallery)).
+		Methods("POST")
+
+	csrf := middleware.NewCSRF(cfg.Upload.MaxRequestSize, cfg.Session.Secure, cfg.HMACKeyring())
 
-	// fileserver
-	imgHandler := http.FileServer(http.Dir("./images/"))
-	r.PathPrefix("/images").Handler(http.StripPrefix("/images", imgHandler))
+	fmt.Printf("starting the server on %s (%s)\n", cfg.Addr(), cfg.Env)
+	http.ListenAndServe(cfg.Addr(), mw.Apply(csrf.Apply(r)))
+}
+
+func envFromEnviron() string {
+	if env := os.Getenv("GALLERY_ENV"); env != "" {
+		return env
+	}
 
-	http.ListenAndServe(":3000", mw.Apply(r))
+	return envDev
 }
 
 func faq(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/iamtraining/gallery/context"
+	"github.com/iamtraining/gallery/models"
+)
+
+// RequireScope rejects requests made with an API token that lacks Scope,
+// with 403 and a JSON error. Requests without a token pass, signed in
+// browsers are not limited to scopes.
+type RequireScope struct {
+	Scope string
+}
+
+func (mw *RequireScope) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := context.GetAPIToken(r.Context())
+		if token != nil && !token.HasScope(mw.Scope) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `{"error":{"status":403,"message":"the API token needs the %s scope"}}`+"\n", mw.Scope)
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+func (mw *RequireScope) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// BearerToken returns the token of an "Authorization: Bearer" header.
+func BearerToken(r *http.Request) (string, bool) {
+	const prefix = "bearer "
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len(prefix) || strings.ToLower(auth[:len(prefix)]) != prefix {
+		return "", false
+	}
+
+	return strings.TrimSpace(auth[len(prefix):]), true
+}
+
+// bearerAPIRequest reports whether r is an API request that carries an API
+// token. Tokens are only accepted by the API: the pages of the site are
+// not limited to scopes.
+func bearerAPIRequest(r *http.Request) bool {
+	_, ok := BearerToken(r)
+	return ok && strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+// applyAPIToken authenticates r by its API token alone, the session cookie
+// is not looked at. Invalid and revoked tokens get 401.
+func (mw *User) applyAPIToken(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	bearer, _ := BearerToken(r)
+
+	var token *models.APIToken
+	var err error
+	if mw.APITokens == nil {
+		err = models.ErrAPITokenInvalid
+	} else {
+		token, err = mw.APITokens.ByToken(bearer)
+	}
+
+	var user *models.User
+	if err == nil {
+		user, err = mw.UserService.ByID(token.UserID)
+		if err == models.ErrNotFound {
+			err = models.ErrAPITokenInvalid
+		}
+	}
+	if err == nil && user.Disabled {
+		err = models.ErrAccountDisabled
+	}
+
+	switch err {
+	case nil:
+	case models.ErrAPITokenInvalid:
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, `{"error":{"status":401,"message":"the API token is invalid or has been revoked"}}`)
+		return
+	case models.ErrAccountDisabled:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, `{"error":{"status":403,"message":"the account of this API token has been disabled"}}`)
+		return
+	default:
+		log.Printf("authenticating API token: %v", err)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, `{"error":{"status":500,"message":"Something went wrong. Please try again."}}`)
+		return
+	}
+
+	if time.Since(token.LastUsedAt) > touchInterval {
+		if err := mw.APITokens.Touch(token); err != nil {
+			log.Printf("touching API token %d: %v", token.ID, err)
+		}
+	}
+
+	ctx := r.Context()
+	ctx = context.WithUser(ctx, user)
+	ctx = context.WithAPIToken(ctx, token)
+
+	next(w, r.WithContext(ctx))
+}
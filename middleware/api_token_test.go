@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/iamtraining/gallery/context"
+	"github.com/iamtraining/gallery/models"
+	"github.com/jinzhu/gorm"
+)
+
+// apiTokensStub knows the token "api-token" of user 7.
+type apiTokensStub struct {
+	models.APITokenService
+	token *models.APIToken
+}
+
+func (as *apiTokensStub) ByToken(token string) (*models.APIToken, error) {
+	if token != "api-token" {
+		return nil, models.ErrAPITokenInvalid
+	}
+
+	t := *as.token
+	return &t, nil
+}
+
+func (as *apiTokensStub) Touch(t *models.APIToken) error {
+	return nil
+}
+
+func TestRequireScope(t *testing.T) {
+	mw := RequireScope{Scope: models.ScopeGalleriesWrite}
+
+	cases := []struct {
+		name  string
+		token *models.APIToken
+		want  int
+	}{
+		{"browser", nil, http.StatusNoContent},
+		{"token with the scope", &models.APIToken{Scopes: "galleries:read galleries:write"}, http.StatusNoContent},
+		{"token without the scope", &models.APIToken{Scopes: "galleries:read images:write"}, http.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		h := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		r := httptest.NewRequest(http.MethodPost, "/api/galleries", nil)
+		if tc.token != nil {
+			r = r.WithContext(context.WithAPIToken(r.Context(), tc.token))
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		if w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}
+
+func TestUserAPIToken(t *testing.T) {
+	token := &models.APIToken{ID: 3, UserID: 7, Scopes: models.ScopeGalleriesRead, LastUsedAt: time.Now()}
+	user := &models.User{Model: gorm.Model{ID: 7}}
+
+	cases := []struct {
+		name     string
+		path     string
+		auth     string
+		disabled bool
+		want     int
+		wantUser bool
+	}{
+		{"valid", "/api/galleries", "Bearer api-token", false, http.StatusOK, true},
+		{"lower case scheme", "/api/galleries", "bearer api-token", false, http.StatusOK, true},
+		{"invalid", "/api/galleries", "Bearer other-token", false, http.StatusUnauthorized, false},
+		{"disabled account", "/api/galleries", "Bearer api-token", true, http.StatusForbidden, false},
+		// the pages of the site do not take API tokens
+		{"outside the API", "/galleries", "Bearer api-token", false, http.StatusOK, false},
+	}
+
+	for _, tc := range cases {
+		u := *user
+		u.Disabled = tc.disabled
+		mw, _ := newTestUserMW(&models.Session{ID: 1, UserID: 7, LastSeenAt: time.Now()}, &u)
+		mw.APITokens = &apiTokensStub{token: token}
+
+		var got *models.User
+		var gotToken *models.APIToken
+		h := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+			got = context.GetUser(r.Context())
+			gotToken = context.GetAPIToken(r.Context())
+		})
+
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		r.Header.Set("Authorization", tc.auth)
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		if w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, w.Code, tc.want)
+		}
+		if (got != nil) != tc.wantUser || (gotToken != nil) != tc.wantUser {
+			t.Errorf("%s: user %+v and token %+v, want them set: %v", tc.name, got, gotToken, tc.wantUser)
+		}
+	}
+}
+
+func TestUserAPITokenIgnoresSessionCookie(t *testing.T) {
+	mw, _ := newTestUserMW(&models.Session{ID: 1, UserID: 7, LastSeenAt: time.Now()},
+		&models.User{Model: gorm.Model{ID: 7}})
+	mw.APITokens = &apiTokensStub{}
+
+	var got *models.User
+	h := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		got = context.GetUser(r.Context())
+	})
+
+	// a valid session does not make up for an invalid API token
+	r := httptest.NewRequest(http.MethodGet, "/api/galleries", nil)
+	r.Header.Set("Authorization", "Bearer other-token")
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "token"})
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	if w.Code != http.StatusUnauthorized || got != nil {
+		t.Errorf("status %d and user %+v, want 401 and nobody", w.Code, got)
+	}
+}
@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/iamtraining/gallery/context"
+	"github.com/iamtraining/gallery/hash"
+	"github.com/iamtraining/gallery/rand"
+	"github.com/iamtraining/gallery/views"
+)
+
+const (
+	csrfCookie     = "csrf_id"
+	csrfHeader     = "X-CSRF-Token"
+	csrfIDBytes    = 32
+	csrfFormMemory = 1 << 20
+)
+
+// CSRF protects state changing requests with a token bound to the session.
+// The token is the HMAC of the ID of the session the user signed in with;
+// visitors who are not signed in get a random ID in a cookie instead. Forms
+// send the token back in a hidden field added by the csrfField template
+// function, scripts in the X-CSRF-Token header. Requests without the token
+// of their own session are rejected.
+// API requests with a bearer token are exempt: they do not use the cookies
+// of the browser, so they cannot be forged by another site.
+//
+// CSRF has to run after User, which finds the session.
+type CSRF struct {
+	// MaxBodySize bounds the body of the requests that need a token,
+	// uploads included.
+	MaxBodySize int64
+	// Secure marks the cookie as HTTPS only.
+	Secure    bool
+	ErrorView *views.View
+
+	hmac hash.HMAC
+}
+
+// NewCSRF makes tokens with the first of hmacKeys. Tokens made with the
+// others are still accepted, so pages that are open when a key is rotated
+// can be submitted.
+func NewCSRF(maxBodySize int64, secure bool, hmacKeys []hash.Key) *CSRF {
+	return &CSRF{
+		MaxBodySize: maxBodySize,
+		Secure:      secure,
+		ErrorView:   views.NewView("bootstrap", "static/error"),
+		hmac:        hash.NewHMAC(hmacKeys...),
+	}
+}
+
+func (mw *CSRF) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *CSRF) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		binding, err := mw.binding(w, r)
+		if err != nil {
+			http.Error(w, "something goes wrong", http.StatusInternalServerError)
+			return
+		}
+
+		r = r.WithContext(context.WithCSRFToken(r.Context(), mw.hmac.Hash(binding)))
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next(w, r)
+			return
+		}
+
+		if bearerAPIRequest(r) {
+			next(w, r)
+			return
+		}
+
+		// the upload forms are the largest, their handlers get no chance to
+		// explain the limit as the form is parsed here
+		if r.ContentLength > mw.MaxBodySize {
+			mw.fail(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf(
+				"the request is too large, at most %d MB can be sent at once", mw.MaxBodySize>>20))
+			return
+		}
+
+		sent, err := mw.sentToken(w, r)
+		if err != nil {
+			mw.fail(w, r, http.StatusBadRequest, "the request is too large or malformed")
+			return
+		}
+
+		if sent == "" || !mw.hmac.Verify(binding, sent) {
+			mw.fail(w, r, http.StatusForbidden, "this form has expired or was not sent "+
+				"from this site, please go back, reload the page and try again")
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// binding returns what the token of r is the HMAC of: the ID of its
+// session, or the ID in the CSRF cookie, which is set if it is missing.
+// The prefixes keep the tokens apart from other HMACs made with the same
+// keys.
+func (mw *CSRF) binding(w http.ResponseWriter, r *http.Request) (string, error) {
+	if session := context.GetSession(r.Context()); session != nil {
+		return fmt.Sprintf("csrf:session:%d", session.ID), nil
+	}
+
+	id := ""
+	if cookie, err := r.Cookie(csrfCookie); err == nil {
+		id = cookie.Value
+	}
+
+	if n, err := rand.NBytes(id); err != nil || n != csrfIDBytes {
+		var err error
+		id, err = rand.String(csrfIDBytes)
+		if err != nil {
+			return "", err
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    id,
+			Path:     "/",
+			Secure:   mw.Secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	return "csrf:anonymous:" + id, nil
+}
+
+func (mw *CSRF) fail(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]interface{}{
+				"status":  status,
+				"message": msg,
+			},
+		})
+		return
+	}
+
+	var data views.Data
+	data.CreateErrorAlert(msg)
+	mw.ErrorView.RenderStatus(w, r, status, data)
+}
+
+// sentToken reads the token from the header or, for form posts, from the
+// form. The body size limit applies either way. The form is parsed here,
+// so the handler finds it already parsed.
+func (mw *CSRF) sentToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, mw.MaxBodySize)
+
+	if token := r.Header.Get(csrfHeader); token != "" {
+		return token, nil
+	}
+
+	ct := r.Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(ct, "multipart/form-data"):
+		if err := r.ParseMultipartForm(csrfFormMemory); err != nil {
+			return "", err
+		}
+	case strings.HasPrefix(ct, "application/x-www-form-urlencoded"):
+		if err := r.ParseForm(); err != nil {
+			return "", err
+		}
+	default:
+		return "", nil
+	}
+
+	return r.PostFormValue(views.CSRFField), nil
+}
@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/iamtraining/gallery/context"
+	"github.com/iamtraining/gallery/hash"
+	"github.com/iamtraining/gallery/models"
+)
+
+var (
+	csrfKey    = hash.Key{ID: "2", Secret: "current-key"}
+	csrfOldKey = hash.Key{ID: "1", Secret: "previous-key"}
+)
+
+func newTestCSRF() *CSRF {
+	return &CSRF{
+		MaxBodySize: 1 << 20,
+		hmac:        hash.NewHMAC(csrfKey, csrfOldKey),
+	}
+}
+
+// csrfToken returns the token that mw hands to the pages of session, or of
+// the visitor with the cookie if session is nil.
+func csrfToken(t *testing.T, mw *CSRF, session *models.Session, cookie *http.Cookie) string {
+	t.Helper()
+
+	var token string
+	h := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		token = context.GetCSRFToken(r.Context())
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/galleries", nil)
+	if session != nil {
+		r = r.WithContext(context.WithSession(r.Context(), session))
+	}
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	h(httptest.NewRecorder(), r)
+
+	if token == "" {
+		t.Fatal("no CSRF token in the context")
+	}
+
+	return token
+}
+
+// post sends a form with token to an API path, where failures are
+// reported as JSON, and returns the status.
+func post(mw *CSRF, session *models.Session, cookie *http.Cookie, token string) int {
+	h := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	form := url.Values{"csrf_token": {token}}
+	r := httptest.NewRequest(http.MethodPost, "/api/galleries", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if session != nil {
+		r = r.WithContext(context.WithSession(r.Context(), session))
+	}
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	return w.Code
+}
+
+func TestCSRFSessionBound(t *testing.T) {
+	mw := newTestCSRF()
+	alice := &models.Session{ID: 1}
+	bob := &models.Session{ID: 2}
+
+	token := csrfToken(t, mw, alice, nil)
+
+	if got := post(mw, alice, nil, token); got != http.StatusNoContent {
+		t.Errorf("own token: status %d, want %d", got, http.StatusNoContent)
+	}
+	if got := post(mw, bob, nil, token); got != http.StatusForbidden {
+		t.Errorf("token of another session: status %d, want %d", got, http.StatusForbidden)
+	}
+	if got := post(mw, nil, nil, token); got != http.StatusForbidden {
+		t.Errorf("session token without the session: status %d, want %d", got, http.StatusForbidden)
+	}
+	if got := post(mw, alice, nil, ""); got != http.StatusForbidden {
+		t.Errorf("no token: status %d, want %d", got, http.StatusForbidden)
+	}
+
+	// the token of a renewed session stays the same, the ID does not change
+	renewed := &models.Session{ID: 1, Token: "renewed"}
+	if got := post(mw, renewed, nil, token); got != http.StatusNoContent {
+		t.Errorf("renewed session: status %d, want %d", got, http.StatusNoContent)
+	}
+}
+
+func TestCSRFAnonymous(t *testing.T) {
+	mw := newTestCSRF()
+
+	h := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookie || !cookies[0].HttpOnly {
+		t.Fatalf("cookies = %v, want one HttpOnly %s cookie", cookies, csrfCookie)
+	}
+	cookie := cookies[0]
+	token := csrfToken(t, mw, nil, cookie)
+
+	if token == cookie.Value {
+		t.Error("the token is the value of the cookie")
+	}
+	if got := post(mw, nil, cookie, token); got != http.StatusNoContent {
+		t.Errorf("own token: status %d, want %d", got, http.StatusNoContent)
+	}
+
+	other := &http.Cookie{Name: csrfCookie, Value: strings.Repeat("A", len(cookie.Value))}
+	if got := post(mw, nil, other, token); got != http.StatusForbidden {
+		t.Errorf("token of another visitor: status %d, want %d", got, http.StatusForbidden)
+	}
+
+	// sending the cookie value itself, as a double submit token, fails
+	if got := post(mw, nil, cookie, cookie.Value); got != http.StatusForbidden {
+		t.Errorf("cookie as token: status %d, want %d", got, http.StatusForbidden)
+	}
+}
+
+func TestCSRFKeyRotation(t *testing.T) {
+	session := &models.Session{ID: 7}
+	old := &CSRF{MaxBodySize: 1 << 20, hmac: hash.NewHMAC(csrfOldKey)}
+	token := csrfToken(t, old, session, nil)
+
+	if got := post(newTestCSRF(), session, nil, token); got != http.StatusNoContent {
+		t.Errorf("token of the previous key: status %d, want %d", got, http.StatusNoContent)
+	}
+
+	removed := &CSRF{MaxBodySize: 1 << 20, hmac: hash.NewHMAC(csrfKey)}
+	if got := post(removed, session, nil, token); got != http.StatusForbidden {
+		t.Errorf("token of a removed key: status %d, want %d", got, http.StatusForbidden)
+	}
+}
+
+func TestCSRFBearerExempt(t *testing.T) {
+	mw := newTestCSRF()
+	h := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/api/galleries", strings.NewReader("{}"))
+	r.Header.Set("Authorization", "Bearer some-token")
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("bearer API request: status %d, want %d", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestCSRFTooLarge(t *testing.T) {
+	mw := newTestCSRF()
+	mw.ErrorView = errorView
+	session := &models.Session{ID: 1}
+	token := csrfToken(t, mw, session, nil)
+
+	var read error
+	h := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		_, read = ioutil.ReadAll(r.Body)
+	})
+
+	// an upload form over the limit is refused with the limit
+	body := strings.Repeat("a", int(mw.MaxBodySize)+1)
+	r := httptest.NewRequest(http.MethodPost, "/galleries/1/images", strings.NewReader(body))
+	r.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	r = r.WithContext(context.WithSession(r.Context(), session))
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "at most 1 MB") {
+		t.Errorf("upload over the limit: status %d, body %q; want 413 with the limit", w.Code, w.Body.String())
+	}
+
+	// scripts sending the token in the header are held to the limit too
+	r = httptest.NewRequest(http.MethodPost, "/galleries/1/images", strings.NewReader(body))
+	r.ContentLength = -1
+	r.Header.Set(csrfHeader, token)
+	r = r.WithContext(context.WithSession(r.Context(), session))
+	h(httptest.NewRecorder(), r)
+	if read == nil {
+		t.Error("the handler read a body over the limit")
+	}
+}
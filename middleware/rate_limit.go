@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/iamtraining/gallery/ratelimit"
+	"github.com/iamtraining/gallery/views"
+)
+
+// RateLimit throttles requests per client IP address. Requests over the
+// limit get 429 with a Retry-After header. If the store fails the request
+// is let through.
+type RateLimit struct {
+	Limiter   *ratelimit.Limiter
+	ErrorView *views.View
+}
+
+func NewRateLimit(limiter *ratelimit.Limiter) *RateLimit {
+	return &RateLimit{
+		Limiter:   limiter,
+		ErrorView: views.NewView("bootstrap", "static/error"),
+	}
+}
+
+func (mw *RateLimit) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *RateLimit) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, wait, err := mw.Limiter.Allow(ClientIP(r))
+		if err != nil {
+			log.Printf("rate limit: %v", err)
+		}
+
+		if err == nil && !ok {
+			var data views.Data
+			data.CreateErrorAlert(TooManyAttemptsMsg(wait))
+			SetRetryAfter(w, wait)
+			mw.ErrorView.RenderStatus(w, r, http.StatusTooManyRequests, data)
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// ClientIP returns the IP address the request came from.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func SetRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+}
+
+// TooManyAttemptsMsg tells the user how long to wait, rounded up to whole
+// minutes, or seconds below a minute.
+func TooManyAttemptsMsg(wait time.Duration) string {
+	n, unit := int(wait/time.Minute)+1, "minute"
+	if wait < time.Minute {
+		n, unit = int(wait/time.Second)+1, "second"
+	}
+	if n > 1 {
+		unit += "s"
+	}
+
+	return fmt.Sprintf("Too many attempts. Please try again in %d %s.", n, unit)
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iamtraining/gallery/ratelimit"
+	"github.com/iamtraining/gallery/views"
+)
+
+// errorView renders only the alert, the layouts are not parsed in tests.
+var errorView = &views.View{
+	Tmpl: template.Must(template.New("").Parse(
+		`{{define "bootstrap"}}{{with .Alert}}{{.Message}}{{end}}{{end}}`)),
+	Layout: "bootstrap",
+}
+
+// brokenStore fails every update.
+type brokenStore struct{}
+
+func (brokenStore) Update(key string, fn func(b *ratelimit.Bucket)) error {
+	return errors.New("store is down")
+}
+
+func (brokenStore) Delete(key string) error {
+	return errors.New("store is down")
+}
+
+func serveRateLimited(mw *RateLimit, remoteAddr string) (*httptest.ResponseRecorder, bool) {
+	var served bool
+	h := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		served = true
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	return w, served
+}
+
+func TestRateLimit(t *testing.T) {
+	limit := ratelimit.Limit{Burst: 2, Refill: time.Minute}
+	mw := &RateLimit{
+		Limiter:   ratelimit.New(ratelimit.NewMemoryStore(time.Hour), "ip", limit),
+		ErrorView: errorView,
+	}
+
+	for i := 0; i < limit.Burst; i++ {
+		if _, served := serveRateLimited(mw, "192.0.2.1:1234"); !served {
+			t.Fatalf("request %d of the burst was refused", i+1)
+		}
+	}
+
+	// the port changes from one connection to the next
+	w, served := serveRateLimited(mw, "192.0.2.1:5678")
+	if served || w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the limit: served %v, status %d; want 429", served, w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+	if got := w.Body.String(); !strings.HasPrefix(got, "Too many attempts.") {
+		t.Errorf("body = %q, want the too many attempts alert", got)
+	}
+
+	if _, served := serveRateLimited(mw, "192.0.2.2:1234"); !served {
+		t.Error("a request of another address was refused")
+	}
+}
+
+func TestRateLimitOpen(t *testing.T) {
+	limit := ratelimit.Limit{Burst: 1, Refill: time.Minute}
+
+	for name, limiter := range map[string]*ratelimit.Limiter{
+		"nil limiter":  nil,
+		"broken store": ratelimit.New(brokenStore{}, "ip", limit),
+	} {
+		mw := &RateLimit{Limiter: limiter, ErrorView: errorView}
+		for i := 0; i < 3; i++ {
+			if _, served := serveRateLimited(mw, "192.0.2.1:1234"); !served {
+				t.Errorf("%s: request %d was refused", name, i+1)
+			}
+		}
+	}
+}
+
+func TestTooManyAttemptsMsg(t *testing.T) {
+	cases := []struct {
+		wait time.Duration
+		want string
+	}{
+		{0, "Too many attempts. Please try again in 1 second."},
+		{1500 * time.Millisecond, "Too many attempts. Please try again in 2 seconds."},
+		{59 * time.Second, "Too many attempts. Please try again in 60 seconds."},
+		{time.Minute, "Too many attempts. Please try again in 2 minutes."},
+		{14*time.Minute + 30*time.Second, "Too many attempts. Please try again in 15 minutes."},
+	}
+
+	for _, tc := range cases {
+		if got := TooManyAttemptsMsg(tc.wait); got != tc.want {
+			t.Errorf("TooManyAttemptsMsg(%v) = %q, want %q", tc.wait, got, tc.want)
+		}
+	}
+}
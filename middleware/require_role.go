@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/iamtraining/gallery/context"
+)
+
+// RequireRole lets only users with Role, or a role above it, through.
+// Like RequireUser it sends visitors who are not signed in to the login
+// page; signed in users without the role get 404, so the pages are not
+// advertised.
+type RequireRole struct {
+	Role string
+}
+
+func (mw *RequireRole) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.GetUser(r.Context())
+		if user == nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		if !user.HasRole(mw.Role) {
+			http.NotFound(w, r)
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+func (mw *RequireRole) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
@@ -1,7 +1,10 @@
 package middleware
 
 import (
+	"fmt"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/iamtraining/gallery/context"
 	"github.com/iamtraining/gallery/models"
@@ -9,10 +12,26 @@ import (
 
 type RequireUser struct{}
 
+// RequireAPIUser is RequireUser for the JSON API: instead of redirecting
+// to the login page it responds 401 with a JSON error.
+type RequireAPIUser struct{}
+
+// User loads the signed in user from the session cookie. Expired and idle
+// sessions are ignored, and the token of a session in use is replaced once
+// it gets old. API requests with an "Authorization: Bearer" header are
+// authenticated by the API token instead. Users whose account is disabled
+// are not signed in either way.
 type User struct {
 	models.UserService
+	Sessions  models.SessionService
+	APITokens models.APITokenService
+	Cookie    *SessionCookie
 }
 
+// touchInterval limits how often the last seen time of a session is
+// written.
+const touchInterval = time.Minute
+
 func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := context.GetUser(r.Context())
@@ -29,26 +48,80 @@ func (mw *RequireUser) Apply(next http.Handler) http.HandlerFunc {
 	return mw.ApplyFn(next.ServeHTTP)
 }
 
+func (mw *RequireAPIUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.GetUser(r.Context())
+		if user == nil {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, `{"error":{"status":401,"message":"authentication required"}}`)
+			return
+		}
+
+		next(w, r)
+	})
+}
+
 func (mw *User) Apply(next http.Handler) http.HandlerFunc {
 	return mw.ApplyFn(next.ServeHTTP)
 }
 
 func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("remember_token")
+		if bearerAPIRequest(r) {
+			mw.applyAPIToken(w, r, next)
+			return
+		}
+
+		token, ok := mw.Cookie.Token(r)
+		if !ok {
+			next(w, r)
+			return
+		}
+
+		session, err := mw.Sessions.ByToken(token)
+		if err == models.ErrNotFound {
+			mw.Cookie.Clear(w)
+			next(w, r)
+			return
+		}
 		if err != nil {
 			next(w, r)
 			return
 		}
 
-		user, err := mw.UserService.ByRemember(cookie.Value)
+		user, err := mw.UserService.ByID(session.UserID)
 		if err != nil {
 			next(w, r)
 			return
 		}
 
+		if user.Disabled {
+			mw.Cookie.Clear(w)
+			next(w, r)
+			return
+		}
+
+		if time.Since(session.LastSeenAt) > touchInterval {
+			if err := mw.Sessions.Touch(session); err != nil {
+				log.Printf("touching session %d: %v", session.ID, err)
+			}
+		}
+
+		// requests that still carry the previous token of a renewed session
+		// are accepted for a short while and never renew it again, its
+		// token is fresh
+		if mw.Sessions.ShouldRenew(session) {
+			if err := mw.Sessions.Renew(session); err != nil {
+				log.Printf("renewing session %d: %v", session.ID, err)
+			} else {
+				mw.Cookie.Set(w, session)
+			}
+		}
+
 		ctx := r.Context()
 		ctx = context.WithUser(ctx, user)
+		ctx = context.WithSession(ctx, session)
 
 		r = r.WithContext(ctx)
 
@@ -0,0 +1,173 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/iamtraining/gallery/context"
+	"github.com/iamtraining/gallery/models"
+	"github.com/jinzhu/gorm"
+)
+
+// sessionsStub serves a single session for the token "token".
+type sessionsStub struct {
+	models.SessionService
+	session *models.Session
+	renew   bool
+	renewed int
+	touched int
+}
+
+func (ss *sessionsStub) ByToken(token string) (*models.Session, error) {
+	if ss.session == nil || token != "token" {
+		return nil, models.ErrNotFound
+	}
+
+	s := *ss.session
+	return &s, nil
+}
+
+func (ss *sessionsStub) ShouldRenew(s *models.Session) bool {
+	return ss.renew
+}
+
+func (ss *sessionsStub) Renew(s *models.Session) error {
+	ss.renewed++
+	s.Token = "renewed"
+	return nil
+}
+
+func (ss *sessionsStub) Touch(s *models.Session) error {
+	ss.touched++
+	return nil
+}
+
+type usersStub struct {
+	models.UserService
+	user *models.User
+}
+
+func (us *usersStub) ByID(id uint) (*models.User, error) {
+	if us.user == nil || us.user.ID != id {
+		return nil, models.ErrNotFound
+	}
+
+	return us.user, nil
+}
+
+func serveUser(mw *User, cookie string) (*httptest.ResponseRecorder, *models.User) {
+	var user *models.User
+	h := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		user = context.GetUser(r.Context())
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/galleries", nil)
+	if cookie != "" {
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: cookie})
+	}
+
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	return w, user
+}
+
+func sessionCookieOf(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			return c
+		}
+	}
+
+	return nil
+}
+
+func newTestUserMW(session *models.Session, user *models.User) (*User, *sessionsStub) {
+	sessions := &sessionsStub{session: session}
+
+	return &User{
+		UserService: &usersStub{user: user},
+		Sessions:    sessions,
+		Cookie:      &SessionCookie{Secure: true, SameSite: http.SameSiteLaxMode},
+	}, sessions
+}
+
+func TestUserSession(t *testing.T) {
+	session := &models.Session{
+		ID:         1,
+		UserID:     7,
+		LastSeenAt: time.Now(),
+		ExpiresAt:  time.Now().Add(time.Hour),
+	}
+	mw, sessions := newTestUserMW(session, &models.User{Model: gorm.Model{ID: 7}})
+
+	w, user := serveUser(mw, "token")
+	if user == nil || user.ID != 7 {
+		t.Fatalf("user = %+v, want user 7", user)
+	}
+	if c := sessionCookieOf(w); c != nil {
+		t.Errorf("cookie %v set for a session that needs no renewal", c)
+	}
+	if sessions.touched != 0 {
+		t.Errorf("session touched %d times, it was seen just now", sessions.touched)
+	}
+}
+
+func TestUserSessionRenewal(t *testing.T) {
+	session := &models.Session{
+		ID:         1,
+		UserID:     7,
+		LastSeenAt: time.Now().Add(-time.Hour),
+		ExpiresAt:  time.Now().Add(time.Hour),
+	}
+	mw, sessions := newTestUserMW(session, &models.User{Model: gorm.Model{ID: 7}})
+	sessions.renew = true
+
+	w, user := serveUser(mw, "token")
+	if user == nil {
+		t.Fatal("not signed in")
+	}
+	if sessions.renewed != 1 || sessions.touched != 1 {
+		t.Errorf("renewed %d and touched %d times, want once each", sessions.renewed, sessions.touched)
+	}
+
+	c := sessionCookieOf(w)
+	if c == nil || c.Value != "renewed" {
+		t.Fatalf("cookie = %v, want the renewed token", c)
+	}
+	if !c.HttpOnly || !c.Secure || c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("cookie = %v, want HttpOnly, Secure and SameSite=Lax", c)
+	}
+
+	// the cookie expires with the session, renewal does not extend it
+	if c.MaxAge <= 0 || c.MaxAge > int(time.Hour.Seconds()) {
+		t.Errorf("cookie MaxAge = %d, want at most the hour the session has left", c.MaxAge)
+	}
+}
+
+func TestUserSessionEnded(t *testing.T) {
+	mw, _ := newTestUserMW(nil, nil)
+
+	w, user := serveUser(mw, "token")
+	if user != nil {
+		t.Errorf("user = %+v, want nobody signed in", user)
+	}
+	if c := sessionCookieOf(w); c == nil || c.MaxAge >= 0 {
+		t.Errorf("cookie = %v, want the cookie of the ended session cleared", c)
+	}
+}
+
+func TestUserSessionDisabled(t *testing.T) {
+	session := &models.Session{ID: 1, UserID: 7, LastSeenAt: time.Now()}
+	mw, _ := newTestUserMW(session, &models.User{Model: gorm.Model{ID: 7}, Disabled: true})
+
+	w, user := serveUser(mw, "token")
+	if user != nil {
+		t.Errorf("user = %+v, want a disabled user not signed in", user)
+	}
+	if c := sessionCookieOf(w); c == nil || c.MaxAge >= 0 {
+		t.Errorf("cookie = %v, want it cleared", c)
+	}
+}
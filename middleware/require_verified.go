@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/iamtraining/gallery/context"
+)
+
+// RequireVerified sends users whose email address is not confirmed yet to
+// /verify, where they can ask for a new link. It must run after
+// RequireUser. With Enabled unset every user passes.
+type RequireVerified struct {
+	Enabled bool
+}
+
+// RequireAPIVerified is RequireVerified for the JSON API: it responds 403
+// with a JSON error instead of redirecting.
+type RequireAPIVerified struct {
+	Enabled bool
+}
+
+func (mw *RequireVerified) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.GetUser(r.Context())
+		if mw.Enabled && (user == nil || !user.EmailVerified) {
+			http.Redirect(w, r, "/verify", http.StatusFound)
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+func (mw *RequireVerified) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *RequireAPIVerified) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.GetUser(r.Context())
+		if mw.Enabled && (user == nil || !user.EmailVerified) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, `{"error":{"status":403,"message":"the email address of the account must be verified first"}}`)
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+func (mw *RequireAPIVerified) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/iamtraining/gallery/models"
+)
+
+const sessionCookie = "remember_token"
+
+// SessionCookie writes the cookie that carries the session token. The
+// cookie lives as long as the session does and is never readable by
+// scripts.
+type SessionCookie struct {
+	Domain string
+	// Secure marks the cookie as HTTPS only.
+	Secure   bool
+	SameSite http.SameSite
+}
+
+// Token returns the session token sent with r, if any.
+func (c *SessionCookie) Token(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+
+	return cookie.Value, true
+}
+
+func (c *SessionCookie) Set(w http.ResponseWriter, s *models.Session) {
+	cookie := c.cookie()
+	cookie.Value = s.Token
+	cookie.Expires = s.ExpiresAt
+	cookie.MaxAge = int(time.Until(s.ExpiresAt).Seconds())
+	if cookie.MaxAge <= 0 {
+		cookie.MaxAge = -1
+	}
+
+	http.SetCookie(w, cookie)
+}
+
+func (c *SessionCookie) Clear(w http.ResponseWriter) {
+	cookie := c.cookie()
+	cookie.MaxAge = -1
+	cookie.Expires = time.Unix(0, 0)
+
+	http.SetCookie(w, cookie)
+}
+
+func (c *SessionCookie) cookie() *http.Cookie {
+	return &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		Domain:   c.Domain,
+		Secure:   c.Secure,
+		HttpOnly: true,
+		SameSite: c.SameSite,
+	}
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"log"
+
+	"github.com/jinzhu/gorm"
+)
+
+// DeleteUser deletes the account of a user with everything that belongs to
+// it: their galleries with their images and collaborators, their sessions,
+// API tokens, pending password resets and recovery codes, and their places
+// as collaborator of other galleries. The user row itself is removed for
+// good so no personal data is left behind and the email address can be
+// used again. Linked identities are removed too, so signing in with the
+// provider again creates a new account.
+//
+// The records are deleted in one transaction, so a failure leaves the
+// account as it was. The image files are deleted once it has committed;
+// files that fail to delete are logged and left for images reconcile.
+func (s *Services) DeleteUser(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	var galleries []Gallery
+	err := s.inTx(func(tx *gorm.DB) error {
+		var err error
+		galleries, err = deleteUserRecords(tx, id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, g := range galleries {
+		if err := s.Img.DeleteByGalleryID(g.ID); err != nil {
+			log.Printf("models: images of gallery %d of deleted user %d: %v", g.ID, id, err)
+		}
+	}
+
+	return nil
+}
+
+// deleteUserRecords deletes the rows of DeleteUser through tx and returns
+// the galleries that were deleted.
+func deleteUserRecords(tx *gorm.DB, id uint) ([]Gallery, error) {
+	// signed out and tokens revoked first, so nothing can be added while
+	// the galleries are being deleted
+	if err := (&sessionGorm{db: tx}).DeleteByUserID(id); err != nil {
+		return nil, err
+	}
+
+	if err := (&apiTokenGorm{db: tx}).DeleteByUserID(id); err != nil {
+		return nil, err
+	}
+
+	gg := &galleryGorm{db: tx}
+	galleries, err := gg.ByUserID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ig := &imgGorm{db: tx}
+	cg := &collaboratorGorm{db: tx}
+	for _, g := range galleries {
+		if err := gg.Delete(g.ID); err != nil {
+			return nil, err
+		}
+
+		if err := ig.DeleteByGalleryID(g.ID); err != nil {
+			return nil, err
+		}
+
+		if err := cg.DeleteByGalleryID(g.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cg.DeleteByUserID(id); err != nil {
+		return nil, err
+	}
+
+	if err := (&identityGorm{db: tx}).DeleteByUserID(id); err != nil {
+		return nil, err
+	}
+
+	if err := (&recoveryCodeGorm{db: tx}).DeleteByUserID(id); err != nil {
+		return nil, err
+	}
+
+	if err := (&pwResetGorm{db: tx}).DeleteByUserID(id); err != nil {
+		return nil, err
+	}
+
+	if err := (&userGorm{db: tx}).Delete(id); err != nil {
+		return nil, err
+	}
+
+	return galleries, nil
+}
@@ -0,0 +1,286 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/iamtraining/gallery/hash"
+	"github.com/iamtraining/gallery/rand"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	ErrTokenNameRequired modelError = "models: token name is required"
+	ErrScopesRequired    modelError = "models: choose at least one scope for the token"
+	ErrScopeInvalid      modelError = "models: unknown token scope"
+	ErrAPITokenInvalid   modelError = "models: the API token is invalid or has been revoked"
+)
+
+// The scopes of API tokens. A token can only use the parts of the API its
+// scopes allow; sessions of the web site are not limited.
+const (
+	ScopeGalleriesRead  = "galleries:read"
+	ScopeGalleriesWrite = "galleries:write"
+	ScopeImagesWrite    = "images:write"
+)
+
+// Scopes lists every scope, in the order they are offered.
+var Scopes = []string{ScopeGalleriesRead, ScopeGalleriesWrite, ScopeImagesWrite}
+
+var _ APITokenDB = &apiTokenGorm{}
+var _ APITokenService = &apiTokenService{}
+
+// APIToken lets scripts use the API on behalf of a user. Like sessions
+// only the HMAC of the token is stored, the token itself is shown once
+// when it is created.
+type APIToken struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null;index"`
+	Name      string `gorm:"not null"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	// Scopes is the space separated list of scopes.
+	Scopes     string `gorm:"not null"`
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
+
+func (APIToken) TableName() string {
+	return "api_tokens"
+}
+
+// HasScope reports whether the token was given scope.
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *APIToken) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
+
+type APITokenService interface {
+	APITokenDB
+}
+
+type APITokenDB interface {
+	// ByToken returns the API token with the given token.
+	ByToken(token string) (*APIToken, error)
+	ByUserID(userID uint) ([]APIToken, error)
+
+	// Create generates the token of a new API token.
+	Create(t *APIToken) error
+	// Touch records that the token has just been used.
+	Touch(t *APIToken) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+type apiTokenGorm struct {
+	db *gorm.DB
+}
+
+type apiTokenValidator struct {
+	APITokenDB
+	hmac hash.HMAC
+}
+
+type apiTokenService struct {
+	APITokenDB
+}
+
+type apiTokenValFunc func(*APIToken) error
+
+// NewAPITokenService hashes tokens with the first of hmacKeys, tokens
+// hashed with one of the other keys keep working.
+func NewAPITokenService(db *gorm.DB, hmacKeys []hash.Key) APITokenService {
+	return &apiTokenService{
+		APITokenDB: &apiTokenValidator{
+			APITokenDB: &apiTokenGorm{db},
+			hmac:       hash.NewHMAC(hmacKeys...),
+		},
+	}
+}
+
+func (atg *apiTokenGorm) ByToken(tokenHash string) (*APIToken, error) {
+	var t APIToken
+	if err := first(atg.db.Where("token_hash = ?", tokenHash), &t); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func (atg *apiTokenGorm) ByUserID(userID uint) ([]APIToken, error) {
+	var tokens []APIToken
+
+	db := atg.db.Where("user_id = ?", userID).Order("created_at DESC")
+	if err := db.Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+func (atg *apiTokenGorm) Create(t *APIToken) error {
+	return atg.db.Create(t).Error
+}
+
+func (atg *apiTokenGorm) Touch(t *APIToken) error {
+	return atg.db.Model(t).UpdateColumn("last_used_at", t.LastUsedAt).Error
+}
+
+func (atg *apiTokenGorm) Delete(id uint) error {
+	return atg.db.Delete(&APIToken{ID: id}).Error
+}
+
+func (atg *apiTokenGorm) DeleteByUserID(userID uint) error {
+	return atg.db.Where("user_id = ?", userID).Delete(&APIToken{}).Error
+}
+
+func runAPITokenValFuncs(t *APIToken, funcs ...apiTokenValFunc) error {
+	for _, fn := range funcs {
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ByToken reports malformed, unknown and revoked tokens alike as
+// ErrAPITokenInvalid.
+func (atv *apiTokenValidator) ByToken(token string) (*APIToken, error) {
+	t := APIToken{
+		Token: token,
+	}
+	if err := runAPITokenValFuncs(&t, atv.tokenMinBytes); err != nil {
+		return nil, err
+	}
+
+	for _, tokenHash := range atv.hmac.Hashes(t.Token) {
+		found, err := atv.APITokenDB.ByToken(tokenHash)
+		if err != ErrNotFound {
+			return found, err
+		}
+	}
+
+	return nil, ErrAPITokenInvalid
+}
+
+func (atv *apiTokenValidator) Create(t *APIToken) error {
+	err := runAPITokenValFuncs(t,
+		atv.userIDRequired,
+		atv.nameRequired,
+		atv.scopesValid,
+		atv.setToken,
+		atv.hmacToken,
+	)
+	if err != nil {
+		return err
+	}
+
+	return atv.APITokenDB.Create(t)
+}
+
+func (atv *apiTokenValidator) Touch(t *APIToken) error {
+	if t.ID <= 0 {
+		return ErrIDInvalid
+	}
+	t.LastUsedAt = time.Now()
+
+	return atv.APITokenDB.Touch(t)
+}
+
+func (atv *apiTokenValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return atv.APITokenDB.Delete(id)
+}
+
+func (atv *apiTokenValidator) DeleteByUserID(userID uint) error {
+	if userID <= 0 {
+		return ErrUserIDReq
+	}
+
+	return atv.APITokenDB.DeleteByUserID(userID)
+}
+
+func (atv *apiTokenValidator) userIDRequired(t *APIToken) error {
+	if t.UserID <= 0 {
+		return ErrUserIDReq
+	}
+
+	return nil
+}
+
+func (atv *apiTokenValidator) nameRequired(t *APIToken) error {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		return ErrTokenNameRequired
+	}
+
+	return nil
+}
+
+// scopesValid also normalizes the list: known scopes only, each once, in
+// the order of Scopes.
+func (atv *apiTokenValidator) scopesValid(t *APIToken) error {
+	given := make(map[string]bool)
+	for _, s := range t.ScopeList() {
+		given[s] = true
+	}
+
+	var scopes []string
+	for _, s := range Scopes {
+		if given[s] {
+			scopes = append(scopes, s)
+			delete(given, s)
+		}
+	}
+
+	if len(given) > 0 {
+		return ErrScopeInvalid
+	}
+
+	if len(scopes) == 0 {
+		return ErrScopesRequired
+	}
+	t.Scopes = strings.Join(scopes, " ")
+
+	return nil
+}
+
+// setToken always makes a new token, tokens are never chosen by the user.
+func (atv *apiTokenValidator) setToken(t *APIToken) error {
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	t.Token = token
+
+	return nil
+}
+
+// tokenMinBytes rejects malformed tokens before they are looked up.
+func (atv *apiTokenValidator) tokenMinBytes(t *APIToken) error {
+	n, err := rand.NBytes(t.Token)
+	if err != nil || n < rand.RememberTokenBytes {
+		return ErrAPITokenInvalid
+	}
+
+	return nil
+}
+
+func (atv *apiTokenValidator) hmacToken(t *APIToken) error {
+	t.TokenHash = atv.hmac.Hash(t.Token)
+
+	return nil
+}
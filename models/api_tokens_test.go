@@ -0,0 +1,96 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/iamtraining/gallery/hash"
+)
+
+func TestAPITokenHasScope(t *testing.T) {
+	token := &APIToken{Scopes: "galleries:read images:write"}
+
+	for scope, want := range map[string]bool{
+		ScopeGalleriesRead:  true,
+		ScopeImagesWrite:    true,
+		ScopeGalleriesWrite: false,
+		"galleries":         false,
+		"":                  false,
+	} {
+		if got := token.HasScope(scope); got != want {
+			t.Errorf("HasScope(%q) = %v, want %v", scope, got, want)
+		}
+	}
+}
+
+func TestAPITokenCreateScopes(t *testing.T) {
+	cases := []struct {
+		name   string
+		scopes string
+		want   string
+		err    error
+	}{
+		{"one", "galleries:read", "galleries:read", nil},
+		{"ordered and once", " images:write galleries:read  images:write ", "galleries:read images:write", nil},
+		{"all", "galleries:write images:write galleries:read", "galleries:read galleries:write images:write", nil},
+		{"unknown", "galleries:read admin", "", ErrScopeInvalid},
+		{"none", "  ", "", ErrScopesRequired},
+	}
+
+	for _, tc := range cases {
+		atv := newTestStores().services(testHMACKey).APIToken
+
+		token := &APIToken{UserID: 1, Name: "script", Scopes: tc.scopes}
+		err := atv.Create(token)
+		if err != tc.err {
+			t.Errorf("%s: Create() = %v, want %v", tc.name, err, tc.err)
+			continue
+		}
+		if err == nil && token.Scopes != tc.want {
+			t.Errorf("%s: Scopes = %q, want %q", tc.name, token.Scopes, tc.want)
+		}
+	}
+}
+
+func TestAPITokenCreateInvalid(t *testing.T) {
+	atv := newTestStores().services(testHMACKey).APIToken
+
+	if err := atv.Create(&APIToken{Name: "script", Scopes: ScopeGalleriesRead}); err != ErrUserIDReq {
+		t.Errorf("Create() without a user = %v, want ErrUserIDReq", err)
+	}
+	if err := atv.Create(&APIToken{UserID: 1, Name: "  ", Scopes: ScopeGalleriesRead}); err != ErrTokenNameRequired {
+		t.Errorf("Create() without a name = %v, want ErrTokenNameRequired", err)
+	}
+}
+
+func TestAPITokenByToken(t *testing.T) {
+	ts := newTestStores()
+	atv := ts.services(testHMACKey).APIToken
+
+	// a token chosen by the caller is replaced
+	token := &APIToken{UserID: 1, Name: "script", Scopes: ScopeGalleriesRead, Token: "chosen"}
+	if err := atv.Create(token); err != nil {
+		t.Fatal(err)
+	}
+	if token.Token == "chosen" {
+		t.Fatal("Create() kept the token of the caller")
+	}
+	if _, ok := ts.apiTokens.tokens[token.Token]; ok {
+		t.Fatal("the token is stored in clear")
+	}
+
+	found, err := atv.ByToken(token.Token)
+	if err != nil || found.ID != token.ID || !found.HasScope(ScopeGalleriesRead) {
+		t.Fatalf("ByToken() = %+v, %v; want token %d", found, err, token.ID)
+	}
+
+	for _, bad := range []string{"", "chosen", "c2hvcnQ=", token.Token[:len(token.Token)-4] + "AAA="} {
+		if _, err := atv.ByToken(bad); err != ErrAPITokenInvalid {
+			t.Errorf("ByToken(%q) = %v, want ErrAPITokenInvalid", bad, err)
+		}
+	}
+
+	rotated := ts.services(hash.Key{ID: "3", Secret: "newer-hmac-key"}, testHMACKey).APIToken
+	if _, err := rotated.ByToken(token.Token); err != nil {
+		t.Errorf("ByToken() after the key was rotated = %v", err)
+	}
+}
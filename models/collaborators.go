@@ -0,0 +1,344 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	ErrCollaboratorRoleInvalid modelError = "models: collaborator role must be viewer, contributor or editor"
+	ErrCollaboratorUnknown     modelError = "models: there is no user with that email address"
+	ErrCollaboratorIsOwner     modelError = "models: the owner of a gallery cannot be a collaborator"
+)
+
+// Viewers can see a gallery, contributors can also upload images and
+// editors can also rename the gallery and delete images.
+const (
+	CollaboratorViewer      = "viewer"
+	CollaboratorContributor = "contributor"
+	CollaboratorEditor      = "editor"
+)
+
+// CollaboratorRoles lists the roles of collaborators, in the order they
+// are offered.
+var CollaboratorRoles = []string{CollaboratorViewer, CollaboratorContributor, CollaboratorEditor}
+
+// Access is what a user may do with a gallery. Every level allows what the
+// levels below it allow.
+type Access int
+
+const (
+	AccessNone Access = iota
+	AccessView
+	// AccessUpload adds uploading images.
+	AccessUpload
+	// AccessEdit adds renaming the gallery and deleting images.
+	AccessEdit
+	// AccessOwner adds changing the visibility, deleting the gallery and
+	// managing its collaborators.
+	AccessOwner
+)
+
+func (a Access) CanView() bool {
+	return a >= AccessView
+}
+
+func (a Access) CanUpload() bool {
+	return a >= AccessUpload
+}
+
+func (a Access) CanEdit() bool {
+	return a >= AccessEdit
+}
+
+func (a Access) IsOwner() bool {
+	return a >= AccessOwner
+}
+
+var _ CollaboratorDB = &collaboratorGorm{}
+var _ CollaboratorService = &collaboratorService{}
+
+// Collaborator gives a user other than the owner access to a gallery.
+type Collaborator struct {
+	ID        uint   `gorm:"primary_key"`
+	GalleryID uint   `gorm:"not null;unique_index:uix_collaborators_gallery_user"`
+	UserID    uint   `gorm:"not null;unique_index:uix_collaborators_gallery_user;index"`
+	Role      string `gorm:"not null"`
+	// Email is the address of the user, set by the service for listing.
+	Email     string `gorm:"-"`
+	CreatedAt time.Time
+}
+
+// Access is what the role of the collaborator allows.
+func (c *Collaborator) Access() Access {
+	switch c.Role {
+	case CollaboratorViewer:
+		return AccessView
+	case CollaboratorContributor:
+		return AccessUpload
+	case CollaboratorEditor:
+		return AccessEdit
+	}
+
+	return AccessNone
+}
+
+type CollaboratorService interface {
+	CollaboratorDB
+
+	// Access returns what user, who may be nil, may do with the gallery.
+	// Every check of permissions on a gallery goes through it.
+	Access(g *Gallery, user *User) (Access, error)
+	// Invite makes the registered user with the email address a
+	// collaborator of the gallery, or changes their role if they are one
+	// already.
+	Invite(g *Gallery, email, role string) (*Collaborator, error)
+}
+
+type CollaboratorDB interface {
+	ByGalleryUser(galleryID, userID uint) (*Collaborator, error)
+	ByGalleryID(galleryID uint) ([]Collaborator, error)
+	ByUserID(userID uint) ([]Collaborator, error)
+
+	Create(c *Collaborator) error
+	Update(c *Collaborator) error
+	Delete(id uint) error
+	DeleteByGalleryID(galleryID uint) error
+	DeleteByUserID(userID uint) error
+}
+
+type collaboratorGorm struct {
+	db *gorm.DB
+}
+
+type collaboratorValidator struct {
+	CollaboratorDB
+}
+
+type collaboratorService struct {
+	CollaboratorDB
+	users UserDB
+}
+
+type collaboratorValFunc func(*Collaborator) error
+
+func NewCollaboratorService(db *gorm.DB, users UserDB) CollaboratorService {
+	return &collaboratorService{
+		CollaboratorDB: &collaboratorValidator{
+			CollaboratorDB: &collaboratorGorm{db},
+		},
+		users: users,
+	}
+}
+
+// Access gives the owner full access and collaborators what their role
+// allows. Collaborators lose their access while the gallery is taken down;
+// everyone else can view it if ViewableBy says so.
+func (cs *collaboratorService) Access(g *Gallery, user *User) (Access, error) {
+	if user != nil && user.ID == g.UserID {
+		return AccessOwner, nil
+	}
+
+	if user != nil && !g.TakenDown {
+		c, err := cs.ByGalleryUser(g.ID, user.ID)
+		switch err {
+		case nil:
+			return c.Access(), nil
+		case ErrNotFound:
+		default:
+			return AccessNone, err
+		}
+	}
+
+	if g.ViewableBy(user) {
+		return AccessView, nil
+	}
+
+	return AccessNone, nil
+}
+
+func (cs *collaboratorService) Invite(g *Gallery, email, role string) (*Collaborator, error) {
+	user, err := cs.users.ByEmail(email)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		return nil, ErrCollaboratorUnknown
+	default:
+		return nil, err
+	}
+
+	if user.ID == g.UserID {
+		return nil, ErrCollaboratorIsOwner
+	}
+
+	c, err := cs.ByGalleryUser(g.ID, user.ID)
+	switch err {
+	case nil:
+		c.Role = role
+		err = cs.Update(c)
+	case ErrNotFound:
+		c = &Collaborator{
+			GalleryID: g.ID,
+			UserID:    user.ID,
+			Role:      role,
+		}
+		err = cs.Create(c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.Email = user.Email
+
+	return c, nil
+}
+
+// ByGalleryID also sets the email addresses of the collaborators.
+func (cs *collaboratorService) ByGalleryID(galleryID uint) ([]Collaborator, error) {
+	collaborators, err := cs.CollaboratorDB.ByGalleryID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range collaborators {
+		user, err := cs.users.ByID(collaborators[i].UserID)
+		if err != nil {
+			return nil, err
+		}
+		collaborators[i].Email = user.Email
+	}
+
+	return collaborators, nil
+}
+
+func (cg *collaboratorGorm) ByGalleryUser(galleryID, userID uint) (*Collaborator, error) {
+	var c Collaborator
+	db := cg.db.Where("gallery_id = ? AND user_id = ?", galleryID, userID)
+	if err := first(db, &c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func (cg *collaboratorGorm) ByGalleryID(galleryID uint) ([]Collaborator, error) {
+	var collaborators []Collaborator
+	if err := cg.db.Where("gallery_id = ?", galleryID).Order("id").Find(&collaborators).Error; err != nil {
+		return nil, err
+	}
+
+	return collaborators, nil
+}
+
+func (cg *collaboratorGorm) ByUserID(userID uint) ([]Collaborator, error) {
+	var collaborators []Collaborator
+	if err := cg.db.Where("user_id = ?", userID).Order("id").Find(&collaborators).Error; err != nil {
+		return nil, err
+	}
+
+	return collaborators, nil
+}
+
+func (cg *collaboratorGorm) Create(c *Collaborator) error {
+	return cg.db.Create(c).Error
+}
+
+func (cg *collaboratorGorm) Update(c *Collaborator) error {
+	return cg.db.Save(c).Error
+}
+
+func (cg *collaboratorGorm) Delete(id uint) error {
+	return cg.db.Delete(&Collaborator{ID: id}).Error
+}
+
+func (cg *collaboratorGorm) DeleteByGalleryID(galleryID uint) error {
+	return cg.db.Where("gallery_id = ?", galleryID).Delete(&Collaborator{}).Error
+}
+
+func (cg *collaboratorGorm) DeleteByUserID(userID uint) error {
+	return cg.db.Where("user_id = ?", userID).Delete(&Collaborator{}).Error
+}
+
+func runCollaboratorValFuncs(c *Collaborator, funcs ...collaboratorValFunc) error {
+	for _, fn := range funcs {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cv *collaboratorValidator) Create(c *Collaborator) error {
+	err := runCollaboratorValFuncs(c,
+		cv.galleryIDRequired,
+		cv.userIDRequired,
+		cv.roleValid,
+	)
+	if err != nil {
+		return err
+	}
+
+	return cv.CollaboratorDB.Create(c)
+}
+
+func (cv *collaboratorValidator) Update(c *Collaborator) error {
+	err := runCollaboratorValFuncs(c,
+		cv.galleryIDRequired,
+		cv.userIDRequired,
+		cv.roleValid,
+	)
+	if err != nil {
+		return err
+	}
+
+	return cv.CollaboratorDB.Update(c)
+}
+
+func (cv *collaboratorValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return cv.CollaboratorDB.Delete(id)
+}
+
+func (cv *collaboratorValidator) DeleteByGalleryID(galleryID uint) error {
+	if galleryID <= 0 {
+		return ErrIDInvalid
+	}
+
+	return cv.CollaboratorDB.DeleteByGalleryID(galleryID)
+}
+
+func (cv *collaboratorValidator) DeleteByUserID(userID uint) error {
+	if userID <= 0 {
+		return ErrUserIDReq
+	}
+
+	return cv.CollaboratorDB.DeleteByUserID(userID)
+}
+
+func (cv *collaboratorValidator) galleryIDRequired(c *Collaborator) error {
+	if c.GalleryID <= 0 {
+		return ErrIDInvalid
+	}
+
+	return nil
+}
+
+func (cv *collaboratorValidator) userIDRequired(c *Collaborator) error {
+	if c.UserID <= 0 {
+		return ErrUserIDReq
+	}
+
+	return nil
+}
+
+func (cv *collaboratorValidator) roleValid(c *Collaborator) error {
+	if c.Access() == AccessNone {
+		return ErrCollaboratorRoleInvalid
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package models
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestCollaboratorAccess(t *testing.T) {
+	owner := &User{Model: gorm.Model{ID: 1}}
+	viewer := &User{Model: gorm.Model{ID: 2}}
+	contributor := &User{Model: gorm.Model{ID: 3}}
+	editor := &User{Model: gorm.Model{ID: 4}}
+	stranger := &User{Model: gorm.Model{ID: 5}}
+	moderator := &User{Model: gorm.Model{ID: 6}, Role: RoleModerator}
+
+	ts := newTestStores()
+	ts.collaborators.collaborators = []Collaborator{
+		{ID: 1, GalleryID: 10, UserID: viewer.ID, Role: CollaboratorViewer},
+		{ID: 2, GalleryID: 10, UserID: contributor.ID, Role: CollaboratorContributor},
+		{ID: 3, GalleryID: 10, UserID: editor.ID, Role: CollaboratorEditor},
+		// a collaborator of another gallery
+		{ID: 4, GalleryID: 11, UserID: stranger.ID, Role: CollaboratorEditor},
+	}
+	cs := ts.services(testHMACKey).Collaborator
+
+	gallery := func(visibility string, takenDown bool) *Gallery {
+		return &Gallery{
+			Model:      gorm.Model{ID: 10},
+			UserID:     owner.ID,
+			Visibility: visibility,
+			TakenDown:  takenDown,
+		}
+	}
+
+	cases := []struct {
+		name    string
+		gallery *Gallery
+		user    *User
+		want    Access
+	}{
+		{"owner", gallery(VisibilityPrivate, false), owner, AccessOwner},
+		{"viewer", gallery(VisibilityPrivate, false), viewer, AccessView},
+		{"contributor", gallery(VisibilityPrivate, false), contributor, AccessUpload},
+		{"editor", gallery(VisibilityPrivate, false), editor, AccessEdit},
+		{"editor of a public gallery", gallery(VisibilityPublic, false), editor, AccessEdit},
+		{"stranger, private", gallery(VisibilityPrivate, false), stranger, AccessNone},
+		{"stranger, unlisted", gallery(VisibilityUnlisted, false), stranger, AccessNone},
+		{"stranger, public", gallery(VisibilityPublic, false), stranger, AccessView},
+		{"anonymous, private", gallery(VisibilityPrivate, false), nil, AccessNone},
+		{"anonymous, public", gallery(VisibilityPublic, false), nil, AccessView},
+		{"moderator, private", gallery(VisibilityPrivate, false), moderator, AccessNone},
+		{"moderator, unlisted", gallery(VisibilityUnlisted, false), moderator, AccessView},
+
+		// taken down: the owner keeps full access, collaborators lose theirs
+		{"owner, taken down", gallery(VisibilityPublic, true), owner, AccessOwner},
+		{"editor, taken down", gallery(VisibilityPrivate, true), editor, AccessNone},
+		{"viewer, taken down and public", gallery(VisibilityPublic, true), viewer, AccessNone},
+		{"anonymous, taken down and public", gallery(VisibilityPublic, true), nil, AccessNone},
+		{"moderator, taken down and public", gallery(VisibilityPublic, true), moderator, AccessView},
+	}
+
+	for _, tc := range cases {
+		got, err := cs.Access(tc.gallery, tc.user)
+		if err != nil {
+			t.Errorf("%s: Access() = %v", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: Access() = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCollaboratorAccessError(t *testing.T) {
+	want := errors.New("database is down")
+	ts := newTestStores()
+	ts.collaborators.err = want
+	cs := ts.services(testHMACKey).Collaborator
+
+	g := &Gallery{Model: gorm.Model{ID: 10}, UserID: 1, Visibility: VisibilityPublic}
+
+	// a failed lookup is not mistaken for no access
+	if got, err := cs.Access(g, &User{Model: gorm.Model{ID: 2}}); err != want || got != AccessNone {
+		t.Errorf("Access() = %d, %v; want AccessNone, %v", got, err, want)
+	}
+
+	// owners and visitors are not looked up
+	if got, err := cs.Access(g, &User{Model: gorm.Model{ID: 1}}); err != nil || got != AccessOwner {
+		t.Errorf("Access() of the owner = %d, %v; want AccessOwner", got, err)
+	}
+	if got, err := cs.Access(g, nil); err != nil || got != AccessView {
+		t.Errorf("Access() of a visitor = %d, %v; want AccessView", got, err)
+	}
+}
+
+func TestAccessLevels(t *testing.T) {
+	cases := []struct {
+		access                        Access
+		view, upload, edit, ownerOnly bool
+	}{
+		{AccessNone, false, false, false, false},
+		{AccessView, true, false, false, false},
+		{AccessUpload, true, true, false, false},
+		{AccessEdit, true, true, true, false},
+		{AccessOwner, true, true, true, true},
+	}
+
+	for _, tc := range cases {
+		a := tc.access
+		if a.CanView() != tc.view || a.CanUpload() != tc.upload || a.CanEdit() != tc.edit || a.IsOwner() != tc.ownerOnly {
+			t.Errorf("Access %d: view %v, upload %v, edit %v, owner %v", a, a.CanView(), a.CanUpload(), a.CanEdit(), a.IsOwner())
+		}
+	}
+}
+
+func TestCollaboratorInvite(t *testing.T) {
+	alice := testUser()
+	bob := User{Model: gorm.Model{ID: 2}, Email: "bob@example.com"}
+	ts := newTestStores(alice, bob)
+	cs := ts.services(testHMACKey).Collaborator
+
+	g := &Gallery{Model: gorm.Model{ID: 10}, UserID: alice.ID}
+
+	c, err := cs.Invite(g, "bob@example.com", CollaboratorViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UserID != bob.ID || c.Email != bob.Email || c.Role != CollaboratorViewer {
+		t.Errorf("Invite() = %+v, want bob as viewer", c)
+	}
+
+	// inviting again changes the role
+	if _, err := cs.Invite(g, "bob@example.com", CollaboratorEditor); err != nil {
+		t.Fatal(err)
+	}
+	if len(ts.collaborators.collaborators) != 1 || ts.collaborators.collaborators[0].Role != CollaboratorEditor {
+		t.Errorf("collaborators = %+v, want bob once as editor", ts.collaborators.collaborators)
+	}
+
+	cases := []struct {
+		email, role string
+		want        error
+	}{
+		{"carol@example.com", CollaboratorViewer, ErrCollaboratorUnknown},
+		{"alice@example.com", CollaboratorViewer, ErrCollaboratorIsOwner},
+		{"bob@example.com", "owner", ErrCollaboratorRoleInvalid},
+	}
+	for _, tc := range cases {
+		if _, err := cs.Invite(g, tc.email, tc.role); err != tc.want {
+			t.Errorf("Invite(%q, %q) = %v, want %v", tc.email, tc.role, err, tc.want)
+		}
+	}
+}
@@ -1,28 +1,54 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"github.com/iamtraining/gallery/rand"
+	"github.com/jinzhu/gorm"
+)
 
 var _ GalleryDB = &galleryGorm{}
 
 const (
-	ErrTitleReq  modelError = "models: title is required"
-	ErrUserIDReq modelError = "models: user ID is required"
+	ErrTitleReq          modelError = "models: title is required"
+	ErrUserIDReq         modelError = "models: user ID is required"
+	ErrVisibilityInvalid modelError = "models: visibility must be private, unlisted or public"
+)
+
+// A private gallery is only visible to its owner and collaborators, an
+// unlisted one also to anyone who has its share link and a public one to
+// everybody.
+const (
+	VisibilityPrivate  = "private"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPublic   = "public"
 )
 
 type Gallery struct {
 	gorm.Model
-	UserID uint   `gorm:"not_null;index"`
-	Title  string `gorm:"not_null"`
-	Img    []Img  `gorm:"-"`
+	UserID     uint   `gorm:"not_null;index"`
+	Title      string `gorm:"not_null"`
+	Visibility string `gorm:"not null;default:'private'"`
+	ShareSlug  string `gorm:"not null;unique_index"`
+	// TakenDown galleries were hidden by a moderator. Only the owner and
+	// moderators can still see them, whatever the visibility.
+	TakenDown bool  `gorm:"not null;default:false"`
+	Img       []Img `gorm:"-"`
 }
 
 type GalleryService interface {
 	GalleryDB
+
+	// RegenerateShareSlug gives the gallery a new share slug, so links
+	// handed out before stop working.
+	RegenerateShareSlug(gallery *Gallery) error
 }
 
 type GalleryDB interface {
 	ByID(id uint) (*Gallery, error)
+	ByShareSlug(slug string) (*Gallery, error)
 	ByUserID(userID uint) ([]Gallery, error)
+	// List returns up to limit galleries, the newest first, skipping the
+	// first offset.
+	List(offset, limit int) ([]Gallery, error)
 	Create(gallery *Gallery) error
 	Update(gallery *Gallery) error
 	Delete(id uint) error
@@ -52,6 +78,18 @@ func NewGalleryService(db *gorm.DB) GalleryService {
 	}
 }
 
+func (g *galleryService) RegenerateShareSlug(gallery *Gallery) error {
+	old := gallery.ShareSlug
+	gallery.ShareSlug = ""
+
+	if err := g.Update(gallery); err != nil {
+		gallery.ShareSlug = old
+		return err
+	}
+
+	return nil
+}
+
 func (g *galleryGorm) Create(gallery *Gallery) error {
 	return g.db.Create(gallery).Error
 }
@@ -67,6 +105,17 @@ func (g *galleryGorm) ByID(id uint) (*Gallery, error) {
 	return &gal, nil
 }
 
+func (g *galleryGorm) ByShareSlug(slug string) (*Gallery, error) {
+	var gal Gallery
+	db := g.db.Where("share_slug = ?", slug)
+	err := first(db, &gal)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gal, nil
+}
+
 func runGalValFuncs(g *Gallery, funcs ...galValFunc) error {
 	for _, fn := range funcs {
 		if err := fn(g); err != nil {
@@ -93,10 +142,38 @@ func (g *galleryValidator) userIDCheck(gal *Gallery) error {
 	return nil
 }
 
+func (g *galleryValidator) visibilityCheck(gal *Gallery) error {
+	switch gal.Visibility {
+	case "":
+		gal.Visibility = VisibilityPrivate
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+	default:
+		return ErrVisibilityInvalid
+	}
+
+	return nil
+}
+
+func (g *galleryValidator) setShareSlugUnset(gal *Gallery) error {
+	if gal.ShareSlug != "" {
+		return nil
+	}
+
+	slug, err := rand.ShareSlug()
+	if err != nil {
+		return err
+	}
+	gal.ShareSlug = slug
+
+	return nil
+}
+
 func (g *galleryValidator) Create(gal *Gallery) error {
 	err := runGalValFuncs(gal,
 		g.userIDCheck,
 		g.titleCheck,
+		g.visibilityCheck,
+		g.setShareSlugUnset,
 	)
 	if err != nil {
 		return err
@@ -113,6 +190,8 @@ func (g *galleryValidator) Update(gallery *Gallery) error {
 	err := runGalValFuncs(gallery,
 		g.userIDCheck,
 		g.titleCheck,
+		g.visibilityCheck,
+		g.setShareSlugUnset,
 	)
 	if err != nil {
 		return err
@@ -159,6 +238,61 @@ func (g *galleryGorm) ByUserID(userID uint) ([]Gallery, error) {
 	return galleries, nil
 }
 
+func (g *galleryGorm) List(offset, limit int) ([]Gallery, error) {
+	var galleries []Gallery
+
+	db := g.db.Order("id DESC").Offset(offset).Limit(limit)
+	if err := db.Find(&galleries).Error; err != nil {
+		return nil, err
+	}
+
+	return galleries, nil
+}
+
+// ViewableBy reports whether user, who may be nil, can open the gallery by
+// its ID. Unlisted galleries are only reachable by their share slug.
+// Moderators can open every gallery that is not private, also the ones
+// that were taken down. Collaborators are let in by
+// CollaboratorService.Access, which falls back to ViewableBy.
+func (g *Gallery) ViewableBy(user *User) bool {
+	if user != nil && user.ID == g.UserID {
+		return true
+	}
+
+	if user != nil && user.HasRole(RoleModerator) && g.Visibility != VisibilityPrivate {
+		return true
+	}
+
+	return g.Public()
+}
+
+// Public reports whether everybody can see the gallery.
+func (g *Gallery) Public() bool {
+	return !g.TakenDown && g.Visibility == VisibilityPublic
+}
+
+// Shared reports whether the gallery can be opened by its share slug.
+func (g *Gallery) Shared() bool {
+	if g.TakenDown {
+		return false
+	}
+
+	return g.Visibility == VisibilityUnlisted || g.Visibility == VisibilityPublic
+}
+
+// SharePath is the link for unlisted galleries.
+func (g *Gallery) SharePath() string {
+	return "/g/" + g.ShareSlug
+}
+
+// ShareImgs points the image paths to the share link, so the images of an
+// unlisted gallery can be loaded without the gallery ID.
+func (g *Gallery) ShareImgs() {
+	for i := range g.Img {
+		g.Img[i].ShareSlug = g.ShareSlug
+	}
+}
+
 func (g *Gallery) Split(n int) [][]Img {
 	dd := make([][]Img, n)
 
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestRegenerateShareSlug(t *testing.T) {
+	ts := newTestStores()
+	gs := ts.services(testHMACKey).Gallery
+
+	gallery := &Gallery{
+		UserID:     1,
+		Title:      "holiday",
+		Visibility: VisibilityUnlisted,
+		ShareSlug:  "old-slug",
+	}
+
+	if err := gs.RegenerateShareSlug(gallery); err != nil {
+		t.Fatal(err)
+	}
+	if gallery.ShareSlug == "" || gallery.ShareSlug == "old-slug" {
+		t.Errorf("ShareSlug = %q, want a new slug", gallery.ShareSlug)
+	}
+	if ts.galleries.updated == nil || ts.galleries.updated.ShareSlug != gallery.ShareSlug {
+		t.Errorf("saved %+v, want the new slug %q saved", ts.galleries.updated, gallery.ShareSlug)
+	}
+}
+
+func TestRegenerateShareSlugInvalid(t *testing.T) {
+	gs := newTestStores().services(testHMACKey).Gallery
+
+	// a gallery without a title fails validation and keeps its slug
+	gallery := &Gallery{UserID: 1, ShareSlug: "old-slug"}
+
+	if err := gs.RegenerateShareSlug(gallery); err != ErrTitleReq {
+		t.Errorf("RegenerateShareSlug() = %v, want ErrTitleReq", err)
+	}
+	if gallery.ShareSlug != "old-slug" {
+		t.Errorf("ShareSlug = %q, want the old slug kept", gallery.ShareSlug)
+	}
+}
@@ -0,0 +1,244 @@
+package models
+
+import (
+	"time"
+
+	"github.com/iamtraining/gallery/idp"
+	"github.com/iamtraining/gallery/rand"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	ErrProviderRequired        modelError = "models: identity provider is required"
+	ErrSubjectRequired         modelError = "models: identity subject is required"
+	ErrIdentityEmailUnverified modelError = "models: the identity provider has not confirmed your email address, please sign up with a password"
+)
+
+var _ IdentityDB = &identityGorm{}
+var _ IdentityService = &identityService{}
+
+// Identity links a user to their account at an external identity
+// provider.
+type Identity struct {
+	ID       uint   `gorm:"primary_key"`
+	UserID   uint   `gorm:"not null;index"`
+	Provider string `gorm:"not null;unique_index:uix_identities_provider_subject"`
+	Subject  string `gorm:"not null;unique_index:uix_identities_provider_subject"`
+	// Email is the address the provider reported when the identity was
+	// linked.
+	Email     string
+	CreatedAt time.Time
+}
+
+type IdentityService interface {
+	IdentityDB
+}
+
+type IdentityDB interface {
+	ByProviderSubject(provider, subject string) (*Identity, error)
+	ByUserID(userID uint) ([]Identity, error)
+
+	Create(i *Identity) error
+	DeleteByUserID(userID uint) error
+}
+
+type identityGorm struct {
+	db *gorm.DB
+}
+
+type identityValidator struct {
+	IdentityDB
+}
+
+type identityService struct {
+	IdentityDB
+}
+
+type identityValFunc func(*Identity) error
+
+func NewIdentityService(db *gorm.DB) IdentityService {
+	return &identityService{
+		IdentityDB: &identityValidator{
+			IdentityDB: &identityGorm{db},
+		},
+	}
+}
+
+func (ig *identityGorm) ByProviderSubject(provider, subject string) (*Identity, error) {
+	var i Identity
+	db := ig.db.Where("provider = ? AND subject = ?", provider, subject)
+	if err := first(db, &i); err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+func (ig *identityGorm) ByUserID(userID uint) ([]Identity, error) {
+	var identities []Identity
+	if err := ig.db.Where("user_id = ?", userID).Order("id").Find(&identities).Error; err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+func (ig *identityGorm) Create(i *Identity) error {
+	return ig.db.Create(i).Error
+}
+
+func (ig *identityGorm) DeleteByUserID(userID uint) error {
+	return ig.db.Where("user_id = ?", userID).Delete(&Identity{}).Error
+}
+
+func runIdentityValFuncs(i *Identity, funcs ...identityValFunc) error {
+	for _, fn := range funcs {
+		if err := fn(i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (iv *identityValidator) Create(i *Identity) error {
+	err := runIdentityValFuncs(i,
+		iv.userIDRequired,
+		iv.providerRequired,
+		iv.subjectRequired,
+	)
+	if err != nil {
+		return err
+	}
+
+	return iv.IdentityDB.Create(i)
+}
+
+func (iv *identityValidator) DeleteByUserID(userID uint) error {
+	if userID <= 0 {
+		return ErrUserIDReq
+	}
+
+	return iv.IdentityDB.DeleteByUserID(userID)
+}
+
+func (iv *identityValidator) userIDRequired(i *Identity) error {
+	if i.UserID <= 0 {
+		return ErrUserIDReq
+	}
+
+	return nil
+}
+
+func (iv *identityValidator) providerRequired(i *Identity) error {
+	if i.Provider == "" {
+		return ErrProviderRequired
+	}
+
+	return nil
+}
+
+func (iv *identityValidator) subjectRequired(i *Identity) error {
+	if i.Subject == "" {
+		return ErrSubjectRequired
+	}
+
+	return nil
+}
+
+// UserByIdentity returns the user to sign in for an identity confirmed by
+// provider. An identity seen before signs in the user it was linked to.
+// Otherwise it is linked to the user with the same email address, or to a
+// new user, but only if the provider verified the address.
+func (s *Services) UserByIdentity(provider string, id *idp.Identity) (*User, error) {
+	linked, err := s.Identity.ByProviderSubject(provider, id.Subject)
+	switch err {
+	case nil:
+		return s.User.ByID(linked.UserID)
+	case ErrNotFound:
+	default:
+		return nil, err
+	}
+
+	if !id.EmailVerified {
+		return nil, ErrIdentityEmailUnverified
+	}
+
+	user, err := s.User.ByEmail(id.Email)
+	switch err {
+	case nil:
+		if !user.EmailVerified {
+			if err := s.claimUnverified(user); err != nil {
+				return nil, err
+			}
+		}
+	case ErrNotFound:
+		user, err = s.createExternalUser(id)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	err = s.Identity.Create(&Identity{
+		UserID:   user.ID,
+		Provider: provider,
+		Subject:  id.Subject,
+		Email:    id.Email,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// claimUnverified hands an account whose address was never confirmed to
+// the owner of the address. Whoever signed up with it may not be them, so
+// their password, second factor, sessions and API tokens stop working.
+func (s *Services) claimUnverified(user *User) error {
+	pw, err := rand.String(rand.RememberTokenBytes)
+	if err != nil {
+		return err
+	}
+
+	user.Password = pw
+	user.EmailVerified = true
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	if err := s.User.Update(user); err != nil {
+		return err
+	}
+
+	if err := s.TwoFactor.Disable(user.ID); err != nil {
+		return err
+	}
+
+	if err := s.Session.DeleteByUserID(user.ID); err != nil {
+		return err
+	}
+
+	return s.APIToken.DeleteByUserID(user.ID)
+}
+
+// createExternalUser signs up the user of an identity. They get a random
+// password and can set their own through a password reset.
+func (s *Services) createExternalUser(id *idp.Identity) (*User, error) {
+	pw, err := rand.String(rand.RememberTokenBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	user := User{
+		Name:          id.Name,
+		Email:         id.Email,
+		Password:      pw,
+		EmailVerified: true,
+	}
+	if err := s.User.Create(&user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/iamtraining/gallery/idp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var aliceAtProvider = &idp.Identity{
+	Subject:       "alice-subject",
+	Email:         "alice@example.com",
+	EmailVerified: true,
+	Name:          "Alice",
+}
+
+func TestUserByIdentityClaimsUnverified(t *testing.T) {
+	ts := newTestStores(userWithPassword(t, "password", testPepper))
+	s := ts.services(testHMACKey)
+
+	if err := s.Session.Create(&Session{UserID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	token := &APIToken{UserID: 1, Name: "script", Scopes: ScopeGalleriesRead}
+	if err := s.APIToken.Create(token); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := s.UserByIdentity("example", aliceAtProvider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != 1 || !ts.users.users[1].EmailVerified {
+		t.Fatalf("UserByIdentity() = %+v, want user 1 with a verified address", user)
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(ts.users.users[1].PasswordHash),
+		[]byte("password"+testPepper.Secret)); err == nil {
+		t.Error("the password of whoever signed up still works")
+	}
+	if sessions, _ := ts.sessions.ByUserID(1); len(sessions) != 0 {
+		t.Errorf("%d sessions left, want none", len(sessions))
+	}
+	if _, err := s.APIToken.ByToken(token.Token); err != ErrAPITokenInvalid {
+		t.Errorf("ByToken() of an API token made before = %v, want ErrAPITokenInvalid", err)
+	}
+	if identities, _ := ts.identities.ByUserID(1); len(identities) != 1 {
+		t.Errorf("%d identities linked, want 1", len(identities))
+	}
+}
+
+func TestUserByIdentityClaimsUnverifiedTwoFactor(t *testing.T) {
+	ts := newTestStores(userWithPassword(t, "password", testPepper))
+	s := ts.services(testHMACKey)
+	enabledUser(t, s)
+
+	user, err := s.UserByIdentity("example", aliceAtProvider)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := ts.users.users[1]
+	if user.TOTPEnabled || saved.TOTPEnabled || saved.TOTPSecret != "" {
+		t.Error("the second factor of whoever signed up is still asked for")
+	}
+	if left, _ := s.TwoFactor.RecoveryCodesLeft(1); left != 0 {
+		t.Errorf("%d recovery codes left, want none", left)
+	}
+}
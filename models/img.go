@@ -1,93 +1,520 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/iamtraining/gallery/rand"
+	"github.com/iamtraining/gallery/storage"
+	"github.com/jinzhu/gorm"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	ErrImgExists          modelError = "models: could not find a free name for the image"
+	ErrImgType            modelError = "models: only JPEG, PNG, GIF and WebP images are allowed"
+	ErrImgTooLarge        modelError = "models: image is too large"
+	ErrImgTooManyPixels   modelError = "models: image width and height are too large"
+	ErrImgFilenameInvalid modelError = "models: image filename is invalid"
 )
 
+const (
+	imgNameBytes       = 16
+	imgNameAttempts    = 5
+	maxOriginalNameLen = 255
+)
+
+// imgTypes maps the accepted content types to the image package format
+// name their content has to decode as.
+var imgTypes = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+var imgExts = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+var _ ImgDB = &imgGorm{}
+var _ ImgDB = &imgValidator{}
+
 type ImgService interface {
-	Create(galleryID uint, r io.Reader, filename string) error
+	Create(galleryID uint, r io.Reader, filename string) (*Img, error)
+	ByID(id uint) (*Img, error)
 	ByGalleryID(galleryID uint) ([]Img, error)
+	ByFilename(galleryID uint, filename string) (*Img, error)
 	Delete(i *Img) error
+	// DeleteByGalleryID removes every image of a gallery, including files
+	// that have no record.
+	DeleteByGalleryID(galleryID uint) error
+	// StoredGalleryIDs returns the IDs of all galleries that have images,
+	// either as records or as files in storage.
+	StoredGalleryIDs() ([]uint, error)
+	GenerateRenditions(i *Img) error
+	BackfillRenditions() (int, error)
 }
 
-type imgService struct{}
+type ImgDB interface {
+	ByID(id uint) (*Img, error)
+	ByGalleryID(galleryID uint) ([]Img, error)
+	ByFilename(galleryID uint, filename string) (*Img, error)
+	WithoutRenditions() ([]Img, error)
+	GalleryIDs() ([]uint, error)
+	Create(i *Img) error
+	Update(i *Img) error
+	Delete(id uint) error
+	DeleteByGalleryID(galleryID uint) error
+}
 
+// Img is the metadata of an uploaded image. The image itself is kept in
+// storage at Key.
 type Img struct {
-	GalleryID uint
-	Filename  string
+	ID            uint   `gorm:"primary_key"`
+	GalleryID     uint   `gorm:"not null;index"`
+	Filename      string `gorm:"not null"`
+	OriginalName  string
+	Size          int64
+	MimeType      string
+	Width         int
+	Height        int
+	Checksum      string
+	Position      int
+	HasRenditions bool `gorm:"not null"`
+	CreatedAt     time.Time
+	// ShareSlug is set when the image is shown through a gallery share
+	// link, its paths then go through that link.
+	ShareSlug string `gorm:"-"`
 }
 
-func NewImgService() ImgService {
-	return &imgService{}
+func (Img) TableName() string {
+	return "images"
 }
 
-func (s *imgService) Create(galleryID uint, r io.Reader, filename string) error {
-	path, err := s.mkImgDir(galleryID)
+type imgGorm struct {
+	db *gorm.DB
+}
+
+type imgValidator struct {
+	ImgDB
+}
+
+type imgService struct {
+	ImgDB
+	store     storage.Storage
+	maxSize   int64
+	maxPixels int64
+}
+
+// NewImgService returns an ImgService that keeps the images in store and
+// rejects files larger than maxSize bytes or with more than maxPixels
+// pixels. A limit of zero is disabled.
+func NewImgService(db *gorm.DB, store storage.Storage, maxSize, maxPixels int64) ImgService {
+	return &imgService{
+		ImgDB: &imgValidator{
+			ImgDB: &imgGorm{
+				db: db,
+			},
+		},
+		store:     store,
+		maxSize:   maxSize,
+		maxPixels: maxPixels,
+	}
+}
+
+func (ig *imgGorm) ByID(id uint) (*Img, error) {
+	var img Img
+	err := first(ig.db.Where("id = ?", id), &img)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	name, err := os.Create(filepath.Join(path, filename))
+	return &img, nil
+}
+
+func (ig *imgGorm) ByGalleryID(galleryID uint) ([]Img, error) {
+	var imgs []Img
+
+	db := ig.db.Where("gallery_id = ?", galleryID).Order("position, id")
+	if err := db.Find(&imgs).Error; err != nil {
+		return nil, err
+	}
+
+	return imgs, nil
+}
+
+func (ig *imgGorm) ByFilename(galleryID uint, filename string) (*Img, error) {
+	var img Img
+	db := ig.db.Where("gallery_id = ? AND filename = ?", galleryID, filename)
+	err := first(db, &img)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	defer name.Close()
+	return &img, nil
+}
 
-	_, err = io.Copy(name, r)
+func (iv *imgValidator) ByFilename(galleryID uint, filename string) (*Img, error) {
+	if err := checkImgFilename(filename); err != nil {
+		return nil, err
+	}
+
+	return iv.ImgDB.ByFilename(galleryID, filename)
+}
+
+// Create appends the image at the end of its gallery.
+func (ig *imgGorm) Create(i *Img) error {
+	var last struct {
+		Position int
+	}
+	err := ig.db.Table(Img{}.TableName()).
+		Select("COALESCE(MAX(position), 0) AS position").
+		Where("gallery_id = ?", i.GalleryID).
+		Scan(&last).Error
 	if err != nil {
 		return err
 	}
 
-	return nil
+	i.Position = last.Position + 1
+
+	return ig.db.Create(i).Error
 }
 
-func (s *imgService) mkImgDir(galleryID uint) (string, error) {
-	path := s.imgDir(galleryID)
+func (ig *imgGorm) WithoutRenditions() ([]Img, error) {
+	var imgs []Img
 
-	err := os.MkdirAll(path, 0755)
+	if err := ig.db.Where("NOT has_renditions").Order("id").Find(&imgs).Error; err != nil {
+		return nil, err
+	}
+
+	return imgs, nil
+}
+
+func (ig *imgGorm) GalleryIDs() ([]uint, error) {
+	var ids []uint
+
+	err := ig.db.Table(Img{}.TableName()).Order("gallery_id").Pluck("DISTINCT gallery_id", &ids).Error
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return path, nil
+	return ids, nil
 }
 
-func (i *imgService) imgDir(galleryID uint) string {
-	return filepath.Join("images", "galleries", fmt.Sprintf("%v", galleryID))
+func (ig *imgGorm) Update(i *Img) error {
+	return ig.db.Save(i).Error
 }
 
-func (i *imgService) ByGalleryID(galleryID uint) ([]Img, error) {
-	path := i.imgDir(galleryID)
+func (ig *imgGorm) Delete(id uint) error {
+	return ig.db.Delete(&Img{ID: id}).Error
+}
+
+func (ig *imgGorm) DeleteByGalleryID(galleryID uint) error {
+	return ig.db.Where("gallery_id = ?", galleryID).Delete(&Img{}).Error
+}
 
-	s, err := filepath.Glob(filepath.Join(path, "*"))
+func (s *imgService) Create(galleryID uint, r io.Reader, filename string) (*Img, error) {
+	// the upload is written to a temporary file first because it has to be
+	// read several times and the final name depends on the content type
+	f, err := ioutil.TempFile("", "gallery-upload-*")
 	if err != nil {
 		return nil, err
 	}
 
-	img := make([]Img, len(s))
-	for i, str := range s {
-		img[i] = Img{
-			Filename:  filepath.Base(str),
-			GalleryID: galleryID,
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if s.maxSize > 0 {
+		r = io.LimitReader(r, s.maxSize+1)
+	}
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.maxSize > 0 && n > s.maxSize {
+		return nil, ErrImgTooLarge
+	}
+
+	img := Img{
+		GalleryID:    galleryID,
+		OriginalName: originalImgName(filename),
+	}
+
+	if err = readImgMetadata(f, &img); err != nil {
+		return nil, err
+	}
+
+	if err = checkImgType(f, &img, s.maxPixels); err != nil {
+		return nil, err
+	}
+
+	img.Filename, err = s.freeImgName(galleryID, imgExts[img.MimeType])
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if err = s.store.Put(img.Key(), f); err != nil {
+		return nil, err
+	}
+
+	if err = s.ImgDB.Create(&img); err != nil {
+		s.store.Delete(img.Key())
+		return nil, err
+	}
+
+	// the original is already saved, missing renditions can be made later
+	// with the backfill command
+	if err = s.GenerateRenditions(&img); err != nil {
+		log.Printf("models: renditions of image %d: %v", img.ID, err)
+	}
+
+	return &img, nil
+}
+
+// freeImgName returns a random name that is not used in the gallery yet.
+// With 128 random bits a clash is not expected, but an existing image must
+// never be overwritten, so it is checked anyway.
+func (s *imgService) freeImgName(galleryID uint, ext string) (string, error) {
+	for i := 0; i < imgNameAttempts; i++ {
+		b, err := rand.Bytes(imgNameBytes)
+		if err != nil {
+			return "", err
+		}
+
+		name := hex.EncodeToString(b) + ext
+		_, err = s.store.Stat(path.Join(imgPrefix(galleryID), name))
+		if err == storage.ErrNotExist {
+			return name, nil
+		}
+		if err != nil {
+			return "", err
 		}
 	}
 
-	return img, nil
+	return "", ErrImgExists
 }
 
+// originalImgName keeps the client supplied name for display only. It is
+// never used to build a path.
+func originalImgName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, path.Base(strings.Replace(name, "\\", "/", -1)))
+
+	if name == "." || name == ".." {
+		return ""
+	}
+
+	if len(name) > maxOriginalNameLen {
+		name = name[:maxOriginalNameLen]
+	}
+
+	return name
+}
+
+// checkImgFilename rejects names that could point outside of the gallery
+// directory.
+func checkImgFilename(name string) error {
+	if name == "" || name == "." || name == ".." ||
+		strings.ContainsAny(name, "/\\\x00") ||
+		name != filepath.Base(name) {
+		return ErrImgFilenameInvalid
+	}
+
+	return nil
+}
+
+// readImgMetadata fills the size, checksum, content type and dimensions of
+// img from f. Dimensions are left at zero for formats that cannot be decoded.
+func readImgMetadata(f *os.File, img *Img) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+
+	img.Size = size
+	img.Checksum = hex.EncodeToString(h.Sum(nil))
+
+	head := make([]byte, 512)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	img.MimeType = http.DetectContentType(head[:n])
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if cfg, _, err := image.DecodeConfig(f); err == nil {
+		img.Width = cfg.Width
+		img.Height = cfg.Height
+	}
+
+	return nil
+}
+
+// checkImgType accepts img only if its magic bytes match one of imgTypes
+// and the content also decodes as that format, with at most maxPixels
+// pixels. The dimensions are checked before anything decodes the pixels.
+func checkImgType(f *os.File, img *Img, maxPixels int64) error {
+	format, ok := imgTypes[img.MimeType]
+	if !ok {
+		return ErrImgType
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	cfg, decoded, err := image.DecodeConfig(f)
+	if err != nil || decoded != format || cfg.Width <= 0 || cfg.Height <= 0 {
+		return ErrImgType
+	}
+
+	if !withinPixels(cfg, maxPixels) {
+		return ErrImgTooManyPixels
+	}
+
+	return nil
+}
+
+// withinPixels reports whether an image of cfg has at most maxPixels
+// pixels, any size does if maxPixels is zero.
+func withinPixels(cfg image.Config, maxPixels int64) bool {
+	return maxPixels <= 0 || int64(cfg.Width)*int64(cfg.Height) <= maxPixels
+}
+
+func imgPrefix(galleryID uint) string {
+	return path.Join("galleries", fmt.Sprintf("%v", galleryID))
+}
+
+// Path is the URL the image is served at.
 func (i *Img) Path() string {
-	return "/" + i.RelativePath()
+	return i.url(i.Key())
+}
+
+func (i *Img) url(key string) string {
+	if i.ShareSlug != "" {
+		return "/g/" + i.ShareSlug + "/images/" + strings.TrimPrefix(key, imgPrefix(i.GalleryID)+"/")
+	}
+
+	return "/images/" + key
 }
 
-func (i *Img) RelativePath() string {
-	galleryID := fmt.Sprintf("%v", i.GalleryID)
-	return filepath.Join("images", "galleries", galleryID, i.Filename)
+// Key is where the image is kept in storage.
+func (i *Img) Key() string {
+	return path.Join(imgPrefix(i.GalleryID), i.Filename)
 }
 
-func (is *imgService) Delete(i *Img) error {
-	return os.Remove(i.RelativePath())
+// Delete removes the image record and then its files. Files that are
+// already gone are not an error, so a half finished delete can be retried.
+func (s *imgService) Delete(i *Img) error {
+	if i.ID <= 0 {
+		return ErrIDInvalid
+	}
+
+	if err := checkImgFilename(i.Filename); err != nil {
+		return err
+	}
+
+	if err := s.ImgDB.Delete(i.ID); err != nil {
+		return err
+	}
+
+	if err := s.deleteRenditions(i); err != nil {
+		return err
+	}
+
+	return s.store.Delete(i.Key())
+}
+
+// DeleteByGalleryID removes the files first and the records last, so if it
+// fails half way the remaining images are still listed and a retry picks
+// them up.
+func (s *imgService) DeleteByGalleryID(galleryID uint) error {
+	if galleryID <= 0 {
+		return ErrIDInvalid
+	}
+
+	keys, err := s.store.List(imgPrefix(galleryID) + "/")
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := s.store.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return s.ImgDB.DeleteByGalleryID(galleryID)
+}
+
+func (s *imgService) StoredGalleryIDs() ([]uint, error) {
+	ids, err := s.ImgDB.GalleryIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		seen[id] = true
+	}
+
+	keys, err := s.store.List("galleries/")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		parts := strings.SplitN(key, "/", 3)
+		if len(parts) < 3 {
+			continue
+		}
+
+		id, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil || seen[uint(id)] {
+			continue
+		}
+
+		seen[uint(id)] = true
+		ids = append(ids, uint(id))
+	}
+
+	return ids, nil
 }
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func tempPNG(t *testing.T, w, h int) *os.File {
+	t.Helper()
+
+	f, err := ioutil.TempFile("", "gallery-test-*.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.Close()
+		os.Remove(f.Name())
+	})
+
+	if err := png.Encode(f, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func TestCheckImgTypePixelLimit(t *testing.T) {
+	cases := []struct {
+		name      string
+		maxPixels int64
+		want      error
+	}{
+		{"within the limit", 300 * 200, nil},
+		{"above the limit", 300*200 - 1, ErrImgTooManyPixels},
+		{"no limit", 0, nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := tempPNG(t, 300, 200)
+			img := Img{MimeType: "image/png"}
+
+			if err := checkImgType(f, &img, tc.maxPixels); err != tc.want {
+				t.Errorf("checkImgType() = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckImgTypeMismatch(t *testing.T) {
+	f := tempPNG(t, 10, 10)
+	img := Img{MimeType: "image/jpeg"}
+
+	if err := checkImgType(f, &img, 0); err != ErrImgType {
+		t.Errorf("checkImgType() = %v, want %v", err, ErrImgType)
+	}
+}
@@ -0,0 +1,552 @@
+package models
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iamtraining/gallery/rand"
+	"github.com/iamtraining/gallery/storage"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	ErrNoMigrationApplied modelError = "models: no migration has been applied"
+	ErrNoImgStorage       modelError = "models: the migration needs the image storage"
+)
+
+// Migration is one versioned schema change. Versions must be unique and
+// migrations are applied in the order they appear in the migrations slice.
+type Migration struct {
+	Version int
+	Name    string
+	Up      migrateFunc
+	Down    migrateFunc
+}
+
+// migrateFunc changes the schema within tx. Migrations that move data
+// read the images from store.
+type migrateFunc func(tx *gorm.DB, store storage.Storage) error
+
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+type schemaMigration struct {
+	Version   int `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// The first migrations use IF NOT EXISTS so databases that were created by
+// AutoMigrate before the migration system existed are adopted as they are.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_users",
+		Up: execSQL(
+			`CREATE TABLE IF NOT EXISTS users (
+				id serial PRIMARY KEY,
+				created_at timestamp with time zone,
+				updated_at timestamp with time zone,
+				deleted_at timestamp with time zone,
+				name text,
+				email text NOT NULL,
+				password_hash text NOT NULL,
+				remember_hash text NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS uix_users_email ON users (email)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS uix_users_remember_hash ON users (remember_hash)`,
+		),
+		Down: execSQL(`DROP TABLE IF EXISTS users`),
+	},
+	{
+		Version: 2,
+		Name:    "create_galleries",
+		Up: execSQL(
+			`CREATE TABLE IF NOT EXISTS galleries (
+				id serial PRIMARY KEY,
+				created_at timestamp with time zone,
+				updated_at timestamp with time zone,
+				deleted_at timestamp with time zone,
+				user_id integer,
+				title text
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_galleries_deleted_at ON galleries (deleted_at)`,
+			`CREATE INDEX IF NOT EXISTS idx_galleries_user_id ON galleries (user_id)`,
+		),
+		Down: execSQL(`DROP TABLE IF EXISTS galleries`),
+	},
+	{
+		Version: 3,
+		Name:    "create_images",
+		Up: func(tx *gorm.DB, store storage.Storage) error {
+			err := execSQL(
+				`CREATE TABLE images (
+					id serial PRIMARY KEY,
+					gallery_id integer NOT NULL,
+					filename text NOT NULL,
+					original_name text,
+					size bigint,
+					mime_type text,
+					width integer,
+					height integer,
+					checksum text,
+					position integer,
+					created_at timestamp with time zone
+				)`,
+				`CREATE INDEX idx_images_gallery_id ON images (gallery_id)`,
+				`CREATE UNIQUE INDEX uix_images_gallery_id_filename ON images (gallery_id, filename)`,
+			)(tx, store)
+			if err != nil {
+				return err
+			}
+
+			return importImgFiles(tx, store)
+		},
+		Down: execSQL(`DROP TABLE images`),
+	},
+	{
+		Version: 4,
+		Name:    "add_images_has_renditions",
+		Up:      execSQL(`ALTER TABLE images ADD COLUMN has_renditions boolean NOT NULL DEFAULT false`),
+		Down:    execSQL(`ALTER TABLE images DROP COLUMN has_renditions`),
+	},
+	{
+		Version: 5,
+		Name:    "add_galleries_visibility",
+		Up: func(tx *gorm.DB, store storage.Storage) error {
+			err := execSQL(
+				`ALTER TABLE galleries ADD COLUMN visibility text NOT NULL DEFAULT 'private'`,
+				`ALTER TABLE galleries ADD COLUMN share_slug text`,
+			)(tx, store)
+			if err != nil {
+				return err
+			}
+
+			if err := setShareSlugs(tx); err != nil {
+				return err
+			}
+
+			return execSQL(
+				`ALTER TABLE galleries ALTER COLUMN share_slug SET NOT NULL`,
+				`CREATE UNIQUE INDEX uix_galleries_share_slug ON galleries (share_slug)`,
+			)(tx, store)
+		},
+		Down: execSQL(
+			`ALTER TABLE galleries DROP COLUMN share_slug`,
+			`ALTER TABLE galleries DROP COLUMN visibility`,
+		),
+	},
+	{
+		Version: 6,
+		Name:    "create_sessions",
+		Up: execSQL(
+			`CREATE TABLE sessions (
+				id serial PRIMARY KEY,
+				user_id integer NOT NULL,
+				token_hash text NOT NULL,
+				user_agent text,
+				ip text,
+				created_at timestamp with time zone,
+				last_seen_at timestamp with time zone,
+				expires_at timestamp with time zone
+			)`,
+			`CREATE INDEX idx_sessions_user_id ON sessions (user_id)`,
+			`CREATE UNIQUE INDEX uix_sessions_token_hash ON sessions (token_hash)`,
+			`ALTER TABLE users DROP COLUMN remember_hash`,
+		),
+		// the remember tokens cannot be restored, every user gets a random
+		// one and has to sign in again
+		Down: execSQL(
+			`ALTER TABLE users ADD COLUMN remember_hash text`,
+			`UPDATE users SET remember_hash = md5(random()::text || id::text)`,
+			`ALTER TABLE users ALTER COLUMN remember_hash SET NOT NULL`,
+			`CREATE UNIQUE INDEX uix_users_remember_hash ON users (remember_hash)`,
+			`DROP TABLE sessions`,
+		),
+	},
+	{
+		Version: 7,
+		Name:    "add_sessions_token_renewal",
+		Up: execSQL(
+			`ALTER TABLE sessions ADD COLUMN previous_token_hash text`,
+			`ALTER TABLE sessions ADD COLUMN token_issued_at timestamp with time zone`,
+			`UPDATE sessions SET token_issued_at = created_at`,
+			`CREATE INDEX idx_sessions_previous_token_hash ON sessions (previous_token_hash)`,
+		),
+		Down: execSQL(
+			`ALTER TABLE sessions DROP COLUMN token_issued_at`,
+			`ALTER TABLE sessions DROP COLUMN previous_token_hash`,
+		),
+	},
+	{
+		Version: 8,
+		Name:    "create_pw_resets",
+		Up: execSQL(
+			`CREATE TABLE pw_resets (
+				id serial PRIMARY KEY,
+				user_id integer NOT NULL,
+				token_hash text NOT NULL,
+				created_at timestamp with time zone,
+				expires_at timestamp with time zone
+			)`,
+			`CREATE INDEX idx_pw_resets_user_id ON pw_resets (user_id)`,
+			`CREATE UNIQUE INDEX uix_pw_resets_token_hash ON pw_resets (token_hash)`,
+		),
+		Down: execSQL(`DROP TABLE pw_resets`),
+	},
+	{
+		Version: 9,
+		Name:    "add_users_email_verified",
+		Up:      execSQL(`ALTER TABLE users ADD COLUMN email_verified boolean NOT NULL DEFAULT false`),
+		Down:    execSQL(`ALTER TABLE users DROP COLUMN email_verified`),
+	},
+	{
+		Version: 10,
+		Name:    "add_users_pepper_id",
+		// existing hashes were made with the single pepper of old configs,
+		// which has the empty ID
+		Up:   execSQL(`ALTER TABLE users ADD COLUMN pepper_id text NOT NULL DEFAULT ''`),
+		Down: execSQL(`ALTER TABLE users DROP COLUMN pepper_id`),
+	},
+	{
+		Version: 11,
+		Name:    "create_identities",
+		Up: execSQL(
+			`CREATE TABLE identities (
+				id serial PRIMARY KEY,
+				user_id integer NOT NULL,
+				provider text NOT NULL,
+				subject text NOT NULL,
+				email text,
+				created_at timestamp with time zone
+			)`,
+			`CREATE INDEX idx_identities_user_id ON identities (user_id)`,
+			`CREATE UNIQUE INDEX uix_identities_provider_subject ON identities (provider, subject)`,
+		),
+		Down: execSQL(`DROP TABLE identities`),
+	},
+	{
+		Version: 12,
+		Name:    "add_users_totp",
+		Up: execSQL(
+			`ALTER TABLE users ADD COLUMN totp_secret text NOT NULL DEFAULT ''`,
+			`ALTER TABLE users ADD COLUMN totp_enabled boolean NOT NULL DEFAULT false`,
+			`ALTER TABLE users ADD COLUMN totp_counter bigint NOT NULL DEFAULT 0`,
+			`CREATE TABLE recovery_codes (
+				id serial PRIMARY KEY,
+				user_id integer NOT NULL,
+				code_hash text NOT NULL,
+				created_at timestamp with time zone
+			)`,
+			`CREATE INDEX idx_recovery_codes_user_id ON recovery_codes (user_id)`,
+		),
+		Down: execSQL(
+			`DROP TABLE recovery_codes`,
+			`ALTER TABLE users DROP COLUMN totp_secret`,
+			`ALTER TABLE users DROP COLUMN totp_enabled`,
+			`ALTER TABLE users DROP COLUMN totp_counter`,
+		),
+	},
+	{
+		Version: 13,
+		Name:    "create_api_tokens",
+		Up: execSQL(
+			`CREATE TABLE api_tokens (
+				id serial PRIMARY KEY,
+				user_id integer NOT NULL,
+				name text NOT NULL,
+				token_hash text NOT NULL,
+				scopes text NOT NULL,
+				created_at timestamp with time zone,
+				last_used_at timestamp with time zone
+			)`,
+			`CREATE INDEX idx_api_tokens_user_id ON api_tokens (user_id)`,
+			`CREATE UNIQUE INDEX uix_api_tokens_token_hash ON api_tokens (token_hash)`,
+		),
+		Down: execSQL(`DROP TABLE api_tokens`),
+	},
+	{
+		Version: 14,
+		Name:    "add_roles_and_takedowns",
+		Up: execSQL(
+			`ALTER TABLE users ADD COLUMN role text NOT NULL DEFAULT 'user'`,
+			`ALTER TABLE users ADD COLUMN disabled boolean NOT NULL DEFAULT false`,
+			`ALTER TABLE galleries ADD COLUMN taken_down boolean NOT NULL DEFAULT false`,
+		),
+		Down: execSQL(
+			`ALTER TABLE users DROP COLUMN role`,
+			`ALTER TABLE users DROP COLUMN disabled`,
+			`ALTER TABLE galleries DROP COLUMN taken_down`,
+		),
+	},
+	{
+		Version: 15,
+		Name:    "create_collaborators",
+		Up: execSQL(
+			`CREATE TABLE collaborators (
+				id serial PRIMARY KEY,
+				gallery_id integer NOT NULL,
+				user_id integer NOT NULL,
+				role text NOT NULL,
+				created_at timestamp with time zone
+			)`,
+			`CREATE UNIQUE INDEX uix_collaborators_gallery_user ON collaborators (gallery_id, user_id)`,
+			`CREATE INDEX idx_collaborators_user_id ON collaborators (user_id)`,
+		),
+		Down: execSQL(`DROP TABLE collaborators`),
+	},
+}
+
+// setShareSlugs gives every existing gallery, deleted ones included, a
+// share slug.
+func setShareSlugs(tx *gorm.DB) error {
+	var ids []uint
+	if err := tx.Table("galleries").Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		slug, err := rand.ShareSlug()
+		if err != nil {
+			return err
+		}
+
+		err = tx.Exec(`UPDATE galleries SET share_slug = ? WHERE id = ?`, slug, id).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// importImgFiles records the images that were uploaded before image
+// metadata was stored in the database. It writes the columns of the
+// images table as this migration creates it, later migrations add more.
+func importImgFiles(tx *gorm.DB, store storage.Storage) error {
+	if store == nil {
+		return ErrNoImgStorage
+	}
+
+	keys, err := store.List("galleries/")
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+
+	positions := make(map[uint]int)
+	for _, key := range keys {
+		// galleries/<id>/<file>, anything deeper is not an original
+		parts := strings.Split(key, "/")
+		if len(parts) != 3 {
+			continue
+		}
+
+		id, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		img := Img{
+			GalleryID:    uint(id),
+			Filename:     parts[2],
+			OriginalName: parts[2],
+		}
+
+		if err := readStoredImgMetadata(store, key, &img); err != nil {
+			return err
+		}
+
+		positions[img.GalleryID]++
+		img.Position = positions[img.GalleryID]
+
+		err = tx.Exec(`INSERT INTO images (gallery_id, filename, original_name, size,
+				mime_type, width, height, checksum, position, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			img.GalleryID, img.Filename, img.OriginalName, img.Size,
+			img.MimeType, img.Width, img.Height, img.Checksum, img.Position, img.CreatedAt,
+		).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readStoredImgMetadata fills the metadata of img from the object at key.
+// It is copied to a temporary file first, reading the metadata needs to
+// seek.
+func readStoredImgMetadata(store storage.Storage, key string, img *Img) error {
+	rc, err := store.Get(key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	f, err := ioutil.TempFile("", "gallery-import-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := io.Copy(f, rc); err != nil {
+		return err
+	}
+
+	if err := readImgMetadata(f, img); err != nil {
+		return err
+	}
+
+	if info, err := store.Stat(key); err == nil {
+		img.CreatedAt = info.ModTime
+	}
+
+	return nil
+}
+
+func execSQL(stmts ...string) migrateFunc {
+	return func(tx *gorm.DB, store storage.Storage) error {
+		for _, stmt := range stmts {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+func (s *Services) ensureMigrationTable() error {
+	return s.db.AutoMigrate(&schemaMigration{}).Error
+}
+
+func (s *Services) appliedMigrations() (map[int]schemaMigration, error) {
+	if err := s.ensureMigrationTable(); err != nil {
+		return nil, err
+	}
+
+	var rows []schemaMigration
+	if err := s.db.Order("version").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]schemaMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+
+	return applied, nil
+}
+
+// MigrateUp applies every pending migration, each in its own transaction,
+// and returns the ones that were applied.
+func (s *Services) MigrateUp() ([]Migration, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		err := s.inTx(func(tx *gorm.DB) error {
+			if err := m.Up(tx, s.store); err != nil {
+				return err
+			}
+
+			return tx.Create(&schemaMigration{
+				Version:   m.Version,
+				Name:      m.Name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return done, err
+		}
+
+		done = append(done, m)
+	}
+
+	return done, nil
+}
+
+// MigrateDown reverts the most recently applied migration.
+func (s *Services) MigrateDown() (*Migration, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+
+		err := s.inTx(func(tx *gorm.DB) error {
+			if err := m.Down(tx, s.store); err != nil {
+				return err
+			}
+
+			return tx.Delete(&schemaMigration{Version: m.Version}).Error
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return &m, nil
+	}
+
+	return nil, ErrNoMigrationApplied
+}
+
+func (s *Services) MigrationStatus() ([]MigrationStatus, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		row, ok := applied[m.Version]
+		status[i] = MigrationStatus{
+			Migration: m,
+			Applied:   ok,
+			AppliedAt: row.AppliedAt,
+		}
+	}
+
+	return status, nil
+}
+
+func (s *Services) inTx(fn func(tx *gorm.DB) error) error {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
@@ -0,0 +1,185 @@
+package models
+
+import (
+	"time"
+
+	"github.com/iamtraining/gallery/hash"
+	"github.com/iamtraining/gallery/rand"
+	"github.com/jinzhu/gorm"
+)
+
+const ErrTokenInvalid modelError = "models: the link is invalid or has expired, please request a new one"
+
+// pwResetLifetime is how long a password reset link can be used.
+const pwResetLifetime = time.Hour
+
+// pwReset is a pending password reset. Like sessions only the HMAC of the
+// token is stored; the token itself is sent to the user by email.
+type pwReset struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null;index"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func (pwReset) TableName() string {
+	return "pw_resets"
+}
+
+type pwResetDB interface {
+	// ByToken returns the reset of a token, unless it has expired.
+	ByToken(token string) (*pwReset, error)
+	Create(pwr *pwReset) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+type pwResetGorm struct {
+	db *gorm.DB
+}
+
+type pwResetValidator struct {
+	pwResetDB
+	hmac hash.HMAC
+}
+
+type pwResetValFunc func(*pwReset) error
+
+func newPwResetValidator(db pwResetDB, hmac hash.HMAC) *pwResetValidator {
+	return &pwResetValidator{
+		pwResetDB: db,
+		hmac:      hmac,
+	}
+}
+
+func (pwrg *pwResetGorm) ByToken(tokenHash string) (*pwReset, error) {
+	var pwr pwReset
+	db := pwrg.db.Where("token_hash = ? AND expires_at > ?", tokenHash, time.Now())
+	if err := first(db, &pwr); err != nil {
+		return nil, err
+	}
+
+	return &pwr, nil
+}
+
+func (pwrg *pwResetGorm) Create(pwr *pwReset) error {
+	return pwrg.db.Create(pwr).Error
+}
+
+func (pwrg *pwResetGorm) Delete(id uint) error {
+	return pwrg.db.Delete(&pwReset{ID: id}).Error
+}
+
+func (pwrg *pwResetGorm) DeleteByUserID(userID uint) error {
+	return pwrg.db.Where("user_id = ?", userID).Delete(&pwReset{}).Error
+}
+
+func runPwResetValFuncs(pwr *pwReset, funcs ...pwResetValFunc) error {
+	for _, fn := range funcs {
+		if err := fn(pwr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (pwrv *pwResetValidator) ByToken(token string) (*pwReset, error) {
+	pwr := pwReset{
+		Token: token,
+	}
+	err := runPwResetValFuncs(&pwr,
+		pwrv.tokenMinBytes,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tokenHash := range pwrv.hmac.Hashes(pwr.Token) {
+		found, err := pwrv.pwResetDB.ByToken(tokenHash)
+		if err != ErrNotFound {
+			return found, err
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (pwrv *pwResetValidator) Create(pwr *pwReset) error {
+	err := runPwResetValFuncs(pwr,
+		pwrv.userIDRequired,
+		pwrv.setTokenUnset,
+		pwrv.hmacToken,
+		pwrv.setExpiry,
+	)
+	if err != nil {
+		return err
+	}
+
+	return pwrv.pwResetDB.Create(pwr)
+}
+
+func (pwrv *pwResetValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return pwrv.pwResetDB.Delete(id)
+}
+
+func (pwrv *pwResetValidator) DeleteByUserID(userID uint) error {
+	if userID <= 0 {
+		return ErrUserIDReq
+	}
+
+	return pwrv.pwResetDB.DeleteByUserID(userID)
+}
+
+func (pwrv *pwResetValidator) userIDRequired(pwr *pwReset) error {
+	if pwr.UserID <= 0 {
+		return ErrUserIDReq
+	}
+
+	return nil
+}
+
+func (pwrv *pwResetValidator) setTokenUnset(pwr *pwReset) error {
+	if pwr.Token != "" {
+		return nil
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	pwr.Token = token
+
+	return nil
+}
+
+// tokenMinBytes rejects malformed tokens before they are looked up. They
+// are reported like unknown tokens.
+func (pwrv *pwResetValidator) tokenMinBytes(pwr *pwReset) error {
+	n, err := rand.NBytes(pwr.Token)
+	if err != nil || n < rand.RememberTokenBytes {
+		return ErrTokenInvalid
+	}
+
+	return nil
+}
+
+func (pwrv *pwResetValidator) hmacToken(pwr *pwReset) error {
+	pwr.TokenHash = pwrv.hmac.Hash(pwr.Token)
+
+	return nil
+}
+
+func (pwrv *pwResetValidator) setExpiry(pwr *pwReset) error {
+	if pwr.ExpiresAt.IsZero() {
+		pwr.ExpiresAt = time.Now().Add(pwResetLifetime)
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package models
+
+// OrphanedImgGalleries returns the IDs of galleries that no longer exist,
+// or were deleted, but still have image records or files. When remove is
+// set their images are deleted as well.
+func (s *Services) OrphanedImgGalleries(remove bool) ([]uint, error) {
+	ids, err := s.Img.StoredGalleryIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []uint
+	for _, id := range ids {
+		_, err := s.Gallery.ByID(id)
+		switch err {
+		case nil:
+			continue
+		case ErrNotFound:
+		default:
+			return orphans, err
+		}
+
+		if remove {
+			if err := s.Img.DeleteByGalleryID(id); err != nil {
+				return orphans, err
+			}
+		}
+
+		orphans = append(orphans, id)
+	}
+
+	return orphans, nil
+}
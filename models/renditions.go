@@ -0,0 +1,162 @@
+package models
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"path"
+	"strings"
+)
+
+const (
+	RenditionThumb  = "thumb"
+	RenditionMedium = "medium"
+)
+
+// renditions are the resized copies made of every uploaded image, stored
+// next to the original in a directory named after the rendition.
+var renditions = []struct {
+	name string
+	size int
+}{
+	{RenditionThumb, 200},
+	{RenditionMedium, 800},
+}
+
+// renditionTypes are the formats that can be decoded to make renditions.
+// Renditions keep the format of the original, except for WebP, which
+// cannot be encoded and is re-encoded as PNG.
+var renditionTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+func (i *Img) ThumbPath() string {
+	return i.renditionPath(RenditionThumb)
+}
+
+func (i *Img) MediumPath() string {
+	return i.renditionPath(RenditionMedium)
+}
+
+func (i *Img) renditionPath(name string) string {
+	if !i.HasRenditions {
+		return i.Path()
+	}
+
+	return i.url(i.renditionKey(name))
+}
+
+// renditionKey is where the rendition called name is kept. WebP cannot be
+// encoded, renditions of WebP images are PNG files.
+func (i *Img) renditionKey(name string) string {
+	filename := i.Filename
+	if i.MimeType == "image/webp" {
+		filename = strings.TrimSuffix(filename, path.Ext(filename)) + ".png"
+	}
+
+	return path.Join(imgPrefix(i.GalleryID), name, filename)
+}
+
+// GenerateRenditions writes every rendition of i and records that they
+// exist. Images with more pixels than the limit, such as ones stored
+// before it existed, are not decoded and fail with ErrImgTooManyPixels:
+// that could take more memory than the server has.
+func (s *imgService) GenerateRenditions(i *Img) error {
+	if !renditionTypes[i.MimeType] {
+		return nil
+	}
+
+	rc, err := s.store.Get(i.Key())
+	if err != nil {
+		return err
+	}
+
+	cfg, _, err := image.DecodeConfig(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+
+	if !withinPixels(cfg, s.maxPixels) {
+		return ErrImgTooManyPixels
+	}
+
+	rc, err = s.store.Get(i.Key())
+	if err != nil {
+		return err
+	}
+
+	src, _, err := image.Decode(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range renditions {
+		var buf bytes.Buffer
+		if err := encodeRendition(&buf, i.MimeType, resize(src, r.size)); err != nil {
+			return err
+		}
+
+		if err := s.store.Put(i.renditionKey(r.name), &buf); err != nil {
+			return err
+		}
+	}
+
+	i.HasRenditions = true
+
+	return s.ImgDB.Update(i)
+}
+
+// BackfillRenditions generates the renditions of every image that does not
+// have them yet. Images that fail are logged and skipped; the number of
+// images that succeeded is returned.
+func (s *imgService) BackfillRenditions() (int, error) {
+	imgs, err := s.ImgDB.WithoutRenditions()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, img := range imgs {
+		if !renditionTypes[img.MimeType] {
+			continue
+		}
+
+		if err := s.GenerateRenditions(&img); err != nil {
+			log.Printf("models: renditions of image %d: %v", img.ID, err)
+			continue
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+func encodeRendition(w io.Writer, mimeType string, img image.Image) error {
+	switch mimeType {
+	case "image/png", "image/webp":
+		return png.Encode(w, img)
+	case "image/gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	}
+}
+
+func (s *imgService) deleteRenditions(i *Img) error {
+	for _, r := range renditions {
+		if err := s.store.Delete(i.renditionKey(r.name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"image"
+	"image/color"
+)
+
+// resize scales src down so that neither side is longer than max, keeping
+// the aspect ratio. Every destination pixel is the average of the source
+// pixels it covers, which is good enough for downscaling photos. Images that
+// already fit are returned as they are.
+func resize(src image.Image, max int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= max && h <= max {
+		return src
+	}
+
+	nw, nh := max, max
+	if w >= h {
+		nh = h * max / w
+	} else {
+		nw = w * max / h
+	}
+	if nw < 1 {
+		nw = 1
+	}
+	if nh < 1 {
+		nh = 1
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, nw, nh))
+	for y := 0; y < nh; y++ {
+		y0, y1 := span(y, h, nh)
+		for x := 0; x < nw; x++ {
+			x0, x1 := span(x, w, nw)
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+
+	return dst
+}
+
+// span returns the source range [from, to) that destination index i covers
+// when a side of length src is scaled to dst.
+func span(i, src, dst int) (int, int) {
+	from := i * src / dst
+	to := (i + 1) * src / dst
+	if to <= from {
+		to = from + 1
+	}
+
+	return from, to
+}
@@ -0,0 +1,37 @@
+package models
+
+const (
+	ErrRoleInvalid     modelError = "models: role must be user, moderator or admin"
+	ErrAccountDisabled modelError = "models: this account has been disabled"
+)
+
+// Moderators can disable accounts and take down galleries, admins can
+// also change the roles of users. Every role can do what the roles before
+// it can.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Roles lists the roles from the least to the most privileged.
+var Roles = []string{RoleUser, RoleModerator, RoleAdmin}
+
+// HasRole reports whether the user has role or one above it. Nobody has
+// an unknown role.
+func (u *User) HasRole(role string) bool {
+	rank := roleRank(role)
+	return rank >= 0 && roleRank(u.Role) >= rank
+}
+
+// roleRank is the position of role in Roles, unknown roles rank below
+// every known one.
+func roleRank(role string) int {
+	for i, r := range Roles {
+		if r == role {
+			return i
+		}
+	}
+
+	return -1
+}
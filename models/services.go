@@ -1,43 +1,117 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"github.com/iamtraining/gallery/hash"
+	"github.com/iamtraining/gallery/storage"
+	"github.com/jinzhu/gorm"
+)
 
 type Services struct {
-	Gallery GalleryService
-	User    UserService
-	db      *gorm.DB
-	Img     ImgService
+	Gallery  GalleryService
+	User     UserService
+	Session  SessionService
+	Identity IdentityService
+	// TwoFactor needs User, WithTwoFactor goes after WithUser.
+	TwoFactor TwoFactorService
+	APIToken  APITokenService
+	// Collaborator needs User, WithCollaborator goes after WithUser.
+	Collaborator CollaboratorService
+	db           *gorm.DB
+	Img          ImgService
+	// store is the storage of Img, migrations read images from it.
+	store storage.Storage
 }
 
-func NewServices(connInfo string) (*Services, error) {
-	db, err := gorm.Open("postgres", connInfo)
-	if err != nil {
-		return nil, err
+type ServicesConfig func(*Services) error
+
+func WithGorm(dialect, connInfo string) ServicesConfig {
+	return func(s *Services) error {
+		db, err := gorm.Open(dialect, connInfo)
+		if err != nil {
+			return err
+		}
+
+		s.db = db
+		return nil
 	}
+}
 
-	db.LogMode(true)
+func WithLogMode(mode bool) ServicesConfig {
+	return func(s *Services) error {
+		s.db.LogMode(mode)
+		return nil
+	}
+}
 
-	return &Services{
-		User:    NewUserService(db),
-		Gallery: NewGalleryService(db),
-		db:      db,
-		Img:     NewImgService(),
-	}, nil
+func WithUser(peppers, hmacKeys []hash.Key) ServicesConfig {
+	return func(s *Services) error {
+		s.User = NewUserService(s.db, peppers, hmacKeys)
+		return nil
+	}
 }
 
-func (s *Services) Close() error {
-	return s.db.Close()
+func WithSession(hmacKeys []hash.Key, timeouts SessionTimeouts) ServicesConfig {
+	return func(s *Services) error {
+		s.Session = NewSessionService(s.db, hmacKeys, timeouts)
+		return nil
+	}
+}
+
+func WithIdentity() ServicesConfig {
+	return func(s *Services) error {
+		s.Identity = NewIdentityService(s.db)
+		return nil
+	}
+}
+
+func WithTwoFactor(hmacKeys []hash.Key) ServicesConfig {
+	return func(s *Services) error {
+		s.TwoFactor = NewTwoFactorService(s.db, s.User, hmacKeys)
+		return nil
+	}
 }
 
-func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}).Error
+func WithAPIToken(hmacKeys []hash.Key) ServicesConfig {
+	return func(s *Services) error {
+		s.APIToken = NewAPITokenService(s.db, hmacKeys)
+		return nil
+	}
+}
+
+func WithGallery() ServicesConfig {
+	return func(s *Services) error {
+		s.Gallery = NewGalleryService(s.db)
+		return nil
+	}
 }
 
-func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Gallery{}).Error
-	if err != nil {
-		return err
+func WithCollaborator() ServicesConfig {
+	return func(s *Services) error {
+		s.Collaborator = NewCollaboratorService(s.db, s.User)
+		return nil
 	}
+}
+
+func WithImg(store storage.Storage, maxSize, maxPixels int64) ServicesConfig {
+	return func(s *Services) error {
+		s.Img = NewImgService(s.db, store, maxSize, maxPixels)
+		s.store = store
+		return nil
+	}
+}
 
-	return s.AutoMigrate()
+func NewServices(cfgs ...ServicesConfig) (*Services, error) {
+	var s Services
+
+	for _, cfg := range cfgs {
+		if err := cfg(&s); err != nil {
+			return nil, err
+		}
+	}
+
+	return &s, nil
+}
+
+func (s *Services) Close() error {
+	return s.db.Close()
 }
@@ -0,0 +1,315 @@
+package models
+
+import (
+	"time"
+
+	"github.com/iamtraining/gallery/hash"
+	"github.com/iamtraining/gallery/rand"
+	"github.com/jinzhu/gorm"
+)
+
+// renewGrace is how long the previous token of a renewed session keeps
+// working, so requests that were already in flight with the old cookie do
+// not sign the user out.
+const renewGrace = time.Minute
+
+// SessionTimeouts configures how long sessions live. A session ends
+// Absolute after sign in, or earlier once it has not been used for Idle.
+// Its token is replaced once it is older than Renew.
+type SessionTimeouts struct {
+	Absolute time.Duration
+	Idle     time.Duration
+	Renew    time.Duration
+}
+
+var _ SessionDB = &sessionGorm{}
+var _ SessionService = &sessionService{}
+
+// Session is one signed in device. Only the HMAC of the token is stored,
+// the token itself lives in the remember_token cookie.
+type Session struct {
+	ID                uint   `gorm:"primary_key"`
+	UserID            uint   `gorm:"not null;index"`
+	Token             string `gorm:"-"`
+	TokenHash         string `gorm:"not null;unique_index"`
+	PreviousTokenHash string `gorm:"index"`
+	TokenIssuedAt     time.Time
+	UserAgent         string
+	IP                string
+	CreatedAt         time.Time
+	LastSeenAt        time.Time
+	ExpiresAt         time.Time
+}
+
+type SessionService interface {
+	SessionDB
+	// ShouldRenew reports whether the token of s is old enough to be
+	// replaced.
+	ShouldRenew(s *Session) bool
+}
+
+type SessionDB interface {
+	// ByToken returns the session of a token, unless it has expired.
+	ByToken(token string) (*Session, error)
+	ByUserID(userID uint) ([]Session, error)
+
+	// Create generates the token of a new session.
+	Create(s *Session) error
+	// Touch records that the session has just been used.
+	Touch(s *Session) error
+	// Renew replaces the token of s with a new one.
+	Renew(s *Session) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+type sessionGorm struct {
+	db   *gorm.DB
+	idle time.Duration
+}
+
+type sessionValidator struct {
+	SessionDB
+	hmac     hash.HMAC
+	timeouts SessionTimeouts
+}
+
+type sessionService struct {
+	SessionDB
+	timeouts SessionTimeouts
+}
+
+type sessionValFunc func(*Session) error
+
+// NewSessionService hashes tokens with the first of hmacKeys. Sessions
+// whose token was hashed with one of the other keys keep working and move to
+// the first key when their token is renewed.
+func NewSessionService(db *gorm.DB, hmacKeys []hash.Key, timeouts SessionTimeouts) SessionService {
+	return &sessionService{
+		SessionDB: &sessionValidator{
+			SessionDB: &sessionGorm{
+				db:   db,
+				idle: timeouts.Idle,
+			},
+			hmac:     hash.NewHMAC(hmacKeys...),
+			timeouts: timeouts,
+		},
+		timeouts: timeouts,
+	}
+}
+
+func (ss *sessionService) ShouldRenew(s *Session) bool {
+	return time.Since(s.TokenIssuedAt) > ss.timeouts.Renew
+}
+
+// active limits db to sessions that have neither expired nor been idle for
+// too long.
+func (sg *sessionGorm) active(db *gorm.DB) *gorm.DB {
+	now := time.Now()
+	return db.Where("expires_at > ? AND last_seen_at > ?", now, now.Add(-sg.idle))
+}
+
+func (sg *sessionGorm) ByToken(tokenHash string) (*Session, error) {
+	var s Session
+	db := sg.active(sg.db).Where(
+		"token_hash = ? OR (previous_token_hash = ? AND token_issued_at > ?)",
+		tokenHash, tokenHash, time.Now().Add(-renewGrace))
+	if err := first(db, &s); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (sg *sessionGorm) ByUserID(userID uint) ([]Session, error) {
+	var sessions []Session
+
+	db := sg.active(sg.db).Where("user_id = ?", userID).
+		Order("last_seen_at DESC")
+	if err := db.Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (sg *sessionGorm) Create(s *Session) error {
+	return sg.db.Create(s).Error
+}
+
+func (sg *sessionGorm) Touch(s *Session) error {
+	return sg.db.Model(s).UpdateColumn("last_seen_at", s.LastSeenAt).Error
+}
+
+func (sg *sessionGorm) Renew(s *Session) error {
+	return sg.db.Model(s).UpdateColumns(map[string]interface{}{
+		"token_hash":          s.TokenHash,
+		"previous_token_hash": s.PreviousTokenHash,
+		"token_issued_at":     s.TokenIssuedAt,
+	}).Error
+}
+
+func (sg *sessionGorm) Delete(id uint) error {
+	return sg.db.Delete(&Session{ID: id}).Error
+}
+
+func (sg *sessionGorm) DeleteByUserID(userID uint) error {
+	return sg.db.Where("user_id = ?", userID).Delete(&Session{}).Error
+}
+
+func runSessionValFuncs(s *Session, funcs ...sessionValFunc) error {
+	for _, fn := range funcs {
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sv *sessionValidator) ByToken(token string) (*Session, error) {
+	s := Session{
+		Token: token,
+	}
+	err := runSessionValFuncs(&s,
+		sv.tokenMinBytes,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// the current key first, it is the one almost every session uses
+	for _, tokenHash := range sv.hmac.Hashes(s.Token) {
+		session, err := sv.SessionDB.ByToken(tokenHash)
+		if err != ErrNotFound {
+			return session, err
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (sv *sessionValidator) Create(s *Session) error {
+	err := runSessionValFuncs(s,
+		sv.userIDRequired,
+		sv.setTokenUnset,
+		sv.tokenMinBytes,
+		sv.hmacToken,
+		sv.tokenHashRequired,
+		sv.setTimes,
+	)
+	if err != nil {
+		return err
+	}
+
+	return sv.SessionDB.Create(s)
+}
+
+func (sv *sessionValidator) Touch(s *Session) error {
+	if s.ID <= 0 {
+		return ErrIDInvalid
+	}
+	s.LastSeenAt = time.Now()
+
+	return sv.SessionDB.Touch(s)
+}
+
+func (sv *sessionValidator) Renew(s *Session) error {
+	if s.ID <= 0 {
+		return ErrIDInvalid
+	}
+
+	s.PreviousTokenHash = s.TokenHash
+	s.Token = ""
+	err := runSessionValFuncs(s,
+		sv.setTokenUnset,
+		sv.tokenMinBytes,
+		sv.hmacToken,
+		sv.tokenHashRequired,
+	)
+	if err != nil {
+		return err
+	}
+	s.TokenIssuedAt = time.Now()
+
+	return sv.SessionDB.Renew(s)
+}
+
+func (sv *sessionValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return sv.SessionDB.Delete(id)
+}
+
+func (sv *sessionValidator) DeleteByUserID(userID uint) error {
+	if userID <= 0 {
+		return ErrUserIDReq
+	}
+
+	return sv.SessionDB.DeleteByUserID(userID)
+}
+
+func (sv *sessionValidator) userIDRequired(s *Session) error {
+	if s.UserID <= 0 {
+		return ErrUserIDReq
+	}
+
+	return nil
+}
+
+func (sv *sessionValidator) setTokenUnset(s *Session) error {
+	if s.Token != "" {
+		return nil
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	s.Token = token
+
+	return nil
+}
+
+func (sv *sessionValidator) tokenMinBytes(s *Session) error {
+	n, err := rand.NBytes(s.Token)
+	if err != nil {
+		return ErrRememberTokenTooShort
+	}
+
+	if n < 32 {
+		return ErrRememberTokenTooShort
+	}
+
+	return nil
+}
+
+func (sv *sessionValidator) hmacToken(s *Session) error {
+	if s.Token == "" {
+		return nil
+	}
+	s.TokenHash = sv.hmac.Hash(s.Token)
+
+	return nil
+}
+
+func (sv *sessionValidator) tokenHashRequired(s *Session) error {
+	if s.TokenHash == "" {
+		return ErrRememberTokenRequired
+	}
+
+	return nil
+}
+
+func (sv *sessionValidator) setTimes(s *Session) error {
+	now := time.Now()
+	s.LastSeenAt = now
+	s.TokenIssuedAt = now
+	if s.ExpiresAt.IsZero() {
+		s.ExpiresAt = now.Add(sv.timeouts.Absolute)
+	}
+
+	return nil
+}
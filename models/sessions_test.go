@@ -0,0 +1,200 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iamtraining/gallery/hash"
+	"github.com/iamtraining/gallery/rand"
+)
+
+func TestSessionCreate(t *testing.T) {
+	ts := newTestStores()
+	ss := ts.services(testHMACKey).Session
+
+	before := time.Now()
+	s := &Session{UserID: 1, UserAgent: "test"}
+	if err := ss.Create(s); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := rand.NBytes(s.Token); err != nil || n < rand.RememberTokenBytes {
+		t.Errorf("token %q has %d bytes, want at least %d", s.Token, n, rand.RememberTokenBytes)
+	}
+
+	saved := ts.sessions.sessions[s.ID]
+	if saved.TokenHash != hash.NewHMAC(testHMACKey).Hash(s.Token) {
+		t.Error("the stored hash is not the HMAC of the token")
+	}
+	if saved.TokenHash == s.Token {
+		t.Error("the token is stored as it is")
+	}
+	if saved.LastSeenAt.Before(before) || !saved.TokenIssuedAt.Equal(saved.LastSeenAt) {
+		t.Errorf("LastSeenAt %v, TokenIssuedAt %v, want both set to now", saved.LastSeenAt, saved.TokenIssuedAt)
+	}
+	if want := saved.LastSeenAt.Add(testTimeouts.Absolute); !saved.ExpiresAt.Equal(want) {
+		t.Errorf("ExpiresAt = %v, want %v", saved.ExpiresAt, want)
+	}
+
+	// every session gets its own token
+	other := &Session{UserID: 1}
+	if err := ss.Create(other); err != nil {
+		t.Fatal(err)
+	}
+	if other.Token == s.Token {
+		t.Error("two sessions have the same token")
+	}
+}
+
+func TestSessionCreateInvalid(t *testing.T) {
+	ss := newTestStores().services(testHMACKey).Session
+
+	if err := ss.Create(&Session{}); err != ErrUserIDReq {
+		t.Errorf("Create() without a user = %v, want ErrUserIDReq", err)
+	}
+
+	if err := ss.Create(&Session{UserID: 1, Token: "c2hvcnQ="}); err != ErrRememberTokenTooShort {
+		t.Errorf("Create() with a short token = %v, want ErrRememberTokenTooShort", err)
+	}
+}
+
+func TestSessionByToken(t *testing.T) {
+	ss := newTestStores().services(testHMACKey).Session
+
+	s := &Session{UserID: 1}
+	if err := ss.Create(s); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := ss.ByToken(s.Token)
+	if err != nil || found.ID != s.ID {
+		t.Fatalf("ByToken() = %+v, %v; want session %d", found, err, s.ID)
+	}
+
+	other, err := rand.RememberToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.ByToken(other); err != ErrNotFound {
+		t.Errorf("ByToken() of an unknown token = %v, want ErrNotFound", err)
+	}
+
+	for _, token := range []string{"", "c2hvcnQ=", "not base64!"} {
+		if _, err := ss.ByToken(token); err != ErrRememberTokenTooShort {
+			t.Errorf("ByToken(%q) = %v, want ErrRememberTokenTooShort", token, err)
+		}
+	}
+}
+
+func TestSessionByTokenKeyRotation(t *testing.T) {
+	ts := newTestStores()
+
+	// created before the key was rotated
+	s := &Session{UserID: 1}
+	if err := ts.services(testOldHMACKey).Session.Create(s); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := ts.services(testHMACKey, testOldHMACKey).Session
+	found, err := rotated.ByToken(s.Token)
+	if err != nil || found.ID != s.ID {
+		t.Fatalf("ByToken() after the rotation = %+v, %v; want session %d", found, err, s.ID)
+	}
+
+	// once the old key is removed the session ends
+	removed := ts.services(testHMACKey).Session
+	if _, err := removed.ByToken(s.Token); err != ErrNotFound {
+		t.Errorf("ByToken() after the old key was removed = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSessionShouldRenew(t *testing.T) {
+	ss := newTestStores().services(testHMACKey).Session
+
+	fresh := &Session{TokenIssuedAt: time.Now().Add(-testTimeouts.Renew / 2)}
+	if ss.ShouldRenew(fresh) {
+		t.Error("ShouldRenew() of a fresh token = true")
+	}
+
+	old := &Session{TokenIssuedAt: time.Now().Add(-testTimeouts.Renew - time.Second)}
+	if !ss.ShouldRenew(old) {
+		t.Error("ShouldRenew() of an old token = false")
+	}
+}
+
+func TestSessionRenew(t *testing.T) {
+	ts := newTestStores()
+	ss := ts.services(testHMACKey).Session
+
+	s := &Session{UserID: 1}
+	if err := ss.Create(s); err != nil {
+		t.Fatal(err)
+	}
+	oldToken := s.Token
+	expires := s.ExpiresAt
+
+	if err := ss.Renew(s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Token == oldToken || s.Token == "" {
+		t.Fatal("Renew() kept the token")
+	}
+	if !s.ExpiresAt.Equal(expires) {
+		t.Errorf("Renew() moved ExpiresAt from %v to %v, renewal must not extend the session", expires, s.ExpiresAt)
+	}
+
+	if found, err := ss.ByToken(s.Token); err != nil || found.ID != s.ID {
+		t.Errorf("ByToken() of the new token = %+v, %v; want session %d", found, err, s.ID)
+	}
+
+	// requests already in flight with the old cookie keep working for a
+	// short while
+	if found, err := ss.ByToken(oldToken); err != nil || found.ID != s.ID {
+		t.Errorf("ByToken() of the old token within the grace period = %+v, %v", found, err)
+	}
+
+	ts.sessions.sessions[s.ID].TokenIssuedAt = time.Now().Add(-renewGrace - time.Second)
+	if _, err := ss.ByToken(oldToken); err != ErrNotFound {
+		t.Errorf("ByToken() of the old token after the grace period = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSessionRenewMovesToCurrentKey(t *testing.T) {
+	ts := newTestStores()
+
+	s := &Session{UserID: 1}
+	if err := ts.services(testOldHMACKey).Session.Create(s); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := ts.services(testHMACKey, testOldHMACKey).Session
+	if err := rotated.Renew(s); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ts.services(testHMACKey).Session.ByToken(s.Token); err != nil {
+		t.Errorf("ByToken() of the renewed token with the current key only = %v", err)
+	}
+}
+
+func TestSessionTouch(t *testing.T) {
+	ts := newTestStores()
+	ss := ts.services(testHMACKey).Session
+
+	s := &Session{UserID: 1}
+	if err := ss.Create(s); err != nil {
+		t.Fatal(err)
+	}
+	ts.sessions.sessions[s.ID].LastSeenAt = time.Now().Add(-time.Hour)
+
+	if err := ss.Touch(s); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(ts.sessions.sessions[s.ID].LastSeenAt) > time.Minute {
+		t.Errorf("LastSeenAt = %v, want now", ts.sessions.sessions[s.ID].LastSeenAt)
+	}
+
+	if err := ss.Touch(&Session{}); err != ErrIDInvalid {
+		t.Errorf("Touch() without an ID = %v, want ErrIDInvalid", err)
+	}
+}
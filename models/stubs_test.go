@@ -0,0 +1,482 @@
+package models
+
+import (
+	"time"
+
+	"github.com/iamtraining/gallery/hash"
+	"github.com/jinzhu/gorm"
+)
+
+// The stubs below stand in for the gorm layer of the services: they keep
+// the rows in memory and find them the way the queries of the gorm types
+// do. testStores.services wires the real validators and services on top
+// of them, so the tests exercise everything but the SQL.
+
+var (
+	testHMACKey    = hash.Key{ID: "2", Secret: "current-hmac-key"}
+	testOldHMACKey = hash.Key{ID: "1", Secret: "previous-hmac-key"}
+	testPepper     = hash.Key{ID: "1", Secret: "pepper"}
+)
+
+var testTimeouts = SessionTimeouts{
+	Absolute: 30 * 24 * time.Hour,
+	Idle:     7 * 24 * time.Hour,
+	Renew:    time.Hour,
+}
+
+// testStores holds the rows of every stub. Services made from the same
+// stores share them, e.g. to check tokens made with an older key.
+type testStores struct {
+	users         *userStub
+	resets        *pwResetStub
+	sessions      *sessionStub
+	codes         *recoveryCodeStub
+	apiTokens     *apiTokenStub
+	identities    *identityStub
+	galleries     *galleryStub
+	collaborators *collaboratorStub
+	// peppers are the peppers of the user service, the current one first.
+	peppers []hash.Key
+}
+
+func newTestStores(users ...User) *testStores {
+	us := &userStub{users: make(map[uint]*User)}
+	for i := range users {
+		us.users[users[i].ID] = &users[i]
+	}
+
+	return &testStores{
+		users:         us,
+		resets:        &pwResetStub{resets: make(map[uint]*pwReset)},
+		sessions:      &sessionStub{sessions: make(map[uint]*Session)},
+		codes:         &recoveryCodeStub{hashes: make(map[uint][]string)},
+		apiTokens:     &apiTokenStub{tokens: make(map[string]APIToken)},
+		identities:    &identityStub{},
+		galleries:     &galleryStub{},
+		collaborators: &collaboratorStub{},
+		peppers:       []hash.Key{testPepper},
+	}
+}
+
+// services returns the services over the stores, signing with the first of
+// hmacKeys like NewServices does.
+func (ts *testStores) services(hmacKeys ...hash.Key) *Services {
+	s := &Services{
+		User: &userService{
+			UserDB:    newUserValidator(ts.users, ts.peppers[0]),
+			peppers:   ts.peppers,
+			hmac:      hash.NewHMAC(hmacKeys...),
+			pwResetDB: newPwResetValidator(ts.resets, hash.NewHMAC(hmacKeys...)),
+		},
+		Session: &sessionService{
+			SessionDB: &sessionValidator{
+				SessionDB: ts.sessions,
+				hmac:      hash.NewHMAC(hmacKeys...),
+				timeouts:  testTimeouts,
+			},
+			timeouts: testTimeouts,
+		},
+		Identity: &identityService{
+			IdentityDB: &identityValidator{IdentityDB: ts.identities},
+		},
+		APIToken: &apiTokenService{
+			APITokenDB: &apiTokenValidator{
+				APITokenDB: ts.apiTokens,
+				hmac:       hash.NewHMAC(hmacKeys...),
+			},
+		},
+		Gallery: &galleryService{
+			GalleryDB: &galleryValidator{GalleryDB: ts.galleries},
+		},
+	}
+
+	s.TwoFactor = &twoFactorService{
+		users:  s.User,
+		totpDB: &totpStub{ts.users},
+		codes: &recoveryCodeValidator{
+			recoveryCodeDB: ts.codes,
+			hmac:           hash.NewHMAC(hmacKeys...),
+		},
+		hmac: hash.NewHMAC(hmacKeys...),
+	}
+	s.Collaborator = &collaboratorService{
+		CollaboratorDB: &collaboratorValidator{CollaboratorDB: ts.collaborators},
+		users:          s.User,
+	}
+
+	return s
+}
+
+// testUser is user 1, alice@example.com.
+func testUser() User {
+	return User{
+		Model:        gorm.Model{ID: 1},
+		Email:        "alice@example.com",
+		PasswordHash: "hash",
+	}
+}
+
+type userStub struct {
+	UserDB
+	users   map[uint]*User
+	updates int
+}
+
+func (us *userStub) ByID(id uint) (*User, error) {
+	user, ok := us.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	found := *user
+	return &found, nil
+}
+
+func (us *userStub) ByEmail(email string) (*User, error) {
+	for _, user := range us.users {
+		if user.Email == email {
+			found := *user
+			return &found, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (us *userStub) Create(user *User) error {
+	user.ID = uint(len(us.users) + 1)
+	saved := *user
+	us.users[user.ID] = &saved
+
+	return nil
+}
+
+func (us *userStub) Update(user *User) error {
+	us.updates++
+	saved := *user
+	us.users[user.ID] = &saved
+
+	return nil
+}
+
+// totpStub changes the two-factor columns of the users of a userStub.
+type totpStub struct {
+	users *userStub
+}
+
+func (ts *totpStub) SetTOTP(userID uint, secret string, enabled bool) error {
+	user := ts.users.users[userID]
+	user.TOTPSecret = secret
+	user.TOTPEnabled = enabled
+	user.TOTPCounter = 0
+
+	return nil
+}
+
+func (ts *totpStub) UseCounter(userID uint, counter int64) (bool, error) {
+	user := ts.users.users[userID]
+	if user.TOTPCounter >= counter {
+		return false, nil
+	}
+	user.TOTPCounter = counter
+
+	return true, nil
+}
+
+// pwResetStub does not find expired resets, like pwResetGorm.
+type pwResetStub struct {
+	resets map[uint]*pwReset
+	nextID uint
+}
+
+func (ps *pwResetStub) ByToken(tokenHash string) (*pwReset, error) {
+	for _, pwr := range ps.resets {
+		if pwr.TokenHash == tokenHash && pwr.ExpiresAt.After(time.Now()) {
+			found := *pwr
+			return &found, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (ps *pwResetStub) Create(pwr *pwReset) error {
+	ps.nextID++
+	pwr.ID = ps.nextID
+	saved := *pwr
+	saved.Token = ""
+	ps.resets[pwr.ID] = &saved
+
+	return nil
+}
+
+func (ps *pwResetStub) Delete(id uint) error {
+	delete(ps.resets, id)
+	return nil
+}
+
+func (ps *pwResetStub) DeleteByUserID(userID uint) error {
+	for id, pwr := range ps.resets {
+		if pwr.UserID == userID {
+			delete(ps.resets, id)
+		}
+	}
+
+	return nil
+}
+
+// sessionStub finds sessions by the current or, within the grace period,
+// the previous token hash, like sessionGorm.
+type sessionStub struct {
+	sessions map[uint]*Session
+	nextID   uint
+}
+
+func (ss *sessionStub) ByToken(tokenHash string) (*Session, error) {
+	for _, s := range ss.sessions {
+		if s.TokenHash == tokenHash || (s.PreviousTokenHash == tokenHash &&
+			time.Since(s.TokenIssuedAt) < renewGrace) {
+			found := *s
+			return &found, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (ss *sessionStub) ByUserID(userID uint) ([]Session, error) {
+	var sessions []Session
+	for _, s := range ss.sessions {
+		if s.UserID == userID {
+			sessions = append(sessions, *s)
+		}
+	}
+
+	return sessions, nil
+}
+
+func (ss *sessionStub) Create(s *Session) error {
+	ss.nextID++
+	s.ID = ss.nextID
+	saved := *s
+	saved.Token = ""
+	ss.sessions[s.ID] = &saved
+
+	return nil
+}
+
+func (ss *sessionStub) Touch(s *Session) error {
+	ss.sessions[s.ID].LastSeenAt = s.LastSeenAt
+	return nil
+}
+
+func (ss *sessionStub) Renew(s *Session) error {
+	saved := ss.sessions[s.ID]
+	saved.TokenHash = s.TokenHash
+	saved.PreviousTokenHash = s.PreviousTokenHash
+	saved.TokenIssuedAt = s.TokenIssuedAt
+
+	return nil
+}
+
+func (ss *sessionStub) Delete(id uint) error {
+	delete(ss.sessions, id)
+	return nil
+}
+
+func (ss *sessionStub) DeleteByUserID(userID uint) error {
+	for id, s := range ss.sessions {
+		if s.UserID == userID {
+			delete(ss.sessions, id)
+		}
+	}
+
+	return nil
+}
+
+// recoveryCodeStub keeps the code hashes of every user.
+type recoveryCodeStub struct {
+	hashes map[uint][]string
+}
+
+func (rs *recoveryCodeStub) Use(userID uint, codeHash string) (bool, error) {
+	for i, h := range rs.hashes[userID] {
+		if h == codeHash {
+			rs.hashes[userID] = append(rs.hashes[userID][:i], rs.hashes[userID][i+1:]...)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (rs *recoveryCodeStub) Replace(userID uint, codeHashes []string) error {
+	rs.hashes[userID] = codeHashes
+	return nil
+}
+
+func (rs *recoveryCodeStub) Count(userID uint) (int, error) {
+	return len(rs.hashes[userID]), nil
+}
+
+func (rs *recoveryCodeStub) DeleteByUserID(userID uint) error {
+	delete(rs.hashes, userID)
+	return nil
+}
+
+// apiTokenStub keeps the API tokens by hash.
+type apiTokenStub struct {
+	tokens map[string]APIToken
+	nextID uint
+}
+
+func (as *apiTokenStub) ByToken(tokenHash string) (*APIToken, error) {
+	t, ok := as.tokens[tokenHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &t, nil
+}
+
+func (as *apiTokenStub) ByUserID(userID uint) ([]APIToken, error) {
+	var tokens []APIToken
+	for _, t := range as.tokens {
+		if t.UserID == userID {
+			tokens = append(tokens, t)
+		}
+	}
+
+	return tokens, nil
+}
+
+func (as *apiTokenStub) Create(t *APIToken) error {
+	as.nextID++
+	t.ID = as.nextID
+	saved := *t
+	saved.Token = ""
+	as.tokens[t.TokenHash] = saved
+
+	return nil
+}
+
+func (as *apiTokenStub) Touch(t *APIToken) error {
+	return nil
+}
+
+func (as *apiTokenStub) Delete(id uint) error {
+	for tokenHash, t := range as.tokens {
+		if t.ID == id {
+			delete(as.tokens, tokenHash)
+		}
+	}
+
+	return nil
+}
+
+func (as *apiTokenStub) DeleteByUserID(userID uint) error {
+	for tokenHash, t := range as.tokens {
+		if t.UserID == userID {
+			delete(as.tokens, tokenHash)
+		}
+	}
+
+	return nil
+}
+
+type identityStub struct {
+	identities []Identity
+}
+
+func (is *identityStub) ByProviderSubject(provider, subject string) (*Identity, error) {
+	for _, i := range is.identities {
+		if i.Provider == provider && i.Subject == subject {
+			found := i
+			return &found, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (is *identityStub) ByUserID(userID uint) ([]Identity, error) {
+	var identities []Identity
+	for _, i := range is.identities {
+		if i.UserID == userID {
+			identities = append(identities, i)
+		}
+	}
+
+	return identities, nil
+}
+
+func (is *identityStub) Create(i *Identity) error {
+	i.ID = uint(len(is.identities) + 1)
+	is.identities = append(is.identities, *i)
+
+	return nil
+}
+
+func (is *identityStub) DeleteByUserID(userID uint) error {
+	kept := is.identities[:0]
+	for _, i := range is.identities {
+		if i.UserID != userID {
+			kept = append(kept, i)
+		}
+	}
+	is.identities = kept
+
+	return nil
+}
+
+// galleryStub only keeps the last updated gallery.
+type galleryStub struct {
+	GalleryDB
+	updated *Gallery
+}
+
+func (gs *galleryStub) Update(gallery *Gallery) error {
+	saved := *gallery
+	gs.updated = &saved
+
+	return nil
+}
+
+// collaboratorStub fails every lookup with err, if it is set.
+type collaboratorStub struct {
+	CollaboratorDB
+	collaborators []Collaborator
+	err           error
+}
+
+func (cs *collaboratorStub) ByGalleryUser(galleryID, userID uint) (*Collaborator, error) {
+	if cs.err != nil {
+		return nil, cs.err
+	}
+
+	for _, c := range cs.collaborators {
+		if c.GalleryID == galleryID && c.UserID == userID {
+			found := c
+			return &found, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (cs *collaboratorStub) Create(c *Collaborator) error {
+	c.ID = uint(len(cs.collaborators) + 1)
+	cs.collaborators = append(cs.collaborators, *c)
+
+	return nil
+}
+
+func (cs *collaboratorStub) Update(c *Collaborator) error {
+	for i := range cs.collaborators {
+		if cs.collaborators[i].ID == c.ID {
+			cs.collaborators[i] = *c
+		}
+	}
+
+	return nil
+}
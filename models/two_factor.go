@@ -0,0 +1,433 @@
+package models
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iamtraining/gallery/hash"
+	"github.com/iamtraining/gallery/rand"
+	"github.com/iamtraining/gallery/totp"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	ErrTOTPCodeInvalid      modelError = "models: the code is not valid, please try again"
+	ErrTwoFactorEnabled     modelError = "models: two-factor authentication is already turned on"
+	ErrTwoFactorNotEnrolled modelError = "models: two-factor authentication has not been set up"
+	ErrChallengeInvalid     modelError = "models: the sign in has expired, please log in again"
+)
+
+const (
+	// RecoveryCodes is how many recovery codes a user gets.
+	RecoveryCodes = 10
+	// recoveryCodeChars is the length of a recovery code, 50 random bits.
+	recoveryCodeChars = 10
+)
+
+// challengeLifetime is how long a user has to enter their code after the
+// password was accepted.
+const challengeLifetime = 5 * time.Minute
+
+// challengePurpose keeps challenge signatures apart from the other HMACs
+// made with the same key.
+const challengePurpose = "2fa-challenge:"
+
+var recoveryEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").
+	WithPadding(base32.NoPadding)
+
+var _ TwoFactorService = &twoFactorService{}
+
+// TwoFactorService manages the optional second factor of password logins:
+// codes from an authenticator app (TOTP), with single use recovery codes
+// for when the app is lost.
+type TwoFactorService interface {
+	// Enroll gives user a new secret to add to their authenticator app.
+	// It is only asked for once Enable confirmed a code made with it.
+	Enroll(user *User) (string, error)
+	// Enable turns two-factor authentication on if code was made with the
+	// secret from Enroll. It returns the recovery codes, which are shown
+	// once and only stored hashed.
+	Enable(user *User, code string) ([]string, error)
+	// Check accepts a current code of the authenticator app or an unused
+	// recovery code of user. Either can be used once.
+	Check(user *User, code string) error
+	// Disable turns two-factor authentication off for the user and
+	// deletes their recovery codes.
+	Disable(userID uint) error
+	RecoveryCodesLeft(userID uint) (int, error)
+
+	// ChallengeToken returns a short lived token that stands for a user
+	// whose password was accepted but who still has to enter a code.
+	ChallengeToken(user *User) (string, error)
+	// Challenge returns the user of a challenge token.
+	Challenge(token string) (*User, error)
+}
+
+// recoveryCode is an unused recovery code. Only the HMAC of the code is
+// stored, used codes are deleted.
+type recoveryCode struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null;index"`
+	CodeHash  string `gorm:"not null"`
+	CreatedAt time.Time
+}
+
+func (recoveryCode) TableName() string {
+	return "recovery_codes"
+}
+
+type recoveryCodeDB interface {
+	// Use deletes the code of the user and reports whether there was one.
+	Use(userID uint, code string) (bool, error)
+	// Replace swaps the codes of the user for codes.
+	Replace(userID uint, codes []string) error
+	Count(userID uint) (int, error)
+	DeleteByUserID(userID uint) error
+}
+
+type recoveryCodeGorm struct {
+	db *gorm.DB
+}
+
+type recoveryCodeValidator struct {
+	recoveryCodeDB
+	hmac hash.HMAC
+}
+
+// totpDB changes the two-factor columns of users without touching the
+// rest of the row.
+type totpDB interface {
+	SetTOTP(userID uint, secret string, enabled bool) error
+	// UseCounter records counter as the last accepted period of the user
+	// and reports whether it is newer than the one recorded before.
+	UseCounter(userID uint, counter int64) (bool, error)
+}
+
+type totpGorm struct {
+	db *gorm.DB
+}
+
+type twoFactorService struct {
+	users  UserDB
+	totpDB totpDB
+	codes  recoveryCodeDB
+	hmac   hash.HMAC
+}
+
+func NewTwoFactorService(db *gorm.DB, users UserDB, hmacKeys []hash.Key) TwoFactorService {
+	return &twoFactorService{
+		users:  users,
+		totpDB: &totpGorm{db},
+		codes: &recoveryCodeValidator{
+			recoveryCodeDB: &recoveryCodeGorm{db},
+			hmac:           hash.NewHMAC(hmacKeys...),
+		},
+		hmac: hash.NewHMAC(hmacKeys...),
+	}
+}
+
+func (tg *totpGorm) SetTOTP(userID uint, secret string, enabled bool) error {
+	return tg.db.Model(&User{}).Where("id = ?", userID).UpdateColumns(map[string]interface{}{
+		"totp_secret":  secret,
+		"totp_enabled": enabled,
+		"totp_counter": 0,
+	}).Error
+}
+
+// UseCounter updates the row only if counter is newer, so of two requests
+// with the same code only one succeeds.
+func (tg *totpGorm) UseCounter(userID uint, counter int64) (bool, error) {
+	db := tg.db.Model(&User{}).
+		Where("id = ? AND totp_counter < ?", userID, counter).
+		UpdateColumn("totp_counter", counter)
+	if db.Error != nil {
+		return false, db.Error
+	}
+
+	return db.RowsAffected == 1, nil
+}
+
+func (rcg *recoveryCodeGorm) Use(userID uint, codeHash string) (bool, error) {
+	db := rcg.db.Where("user_id = ? AND code_hash = ?", userID, codeHash).
+		Delete(&recoveryCode{})
+	if db.Error != nil {
+		return false, db.Error
+	}
+
+	return db.RowsAffected > 0, nil
+}
+
+func (rcg *recoveryCodeGorm) Replace(userID uint, codeHashes []string) error {
+	tx := rcg.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := tx.Where("user_id = ?", userID).Delete(&recoveryCode{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, codeHash := range codeHashes {
+		rc := recoveryCode{
+			UserID:   userID,
+			CodeHash: codeHash,
+		}
+		if err := tx.Create(&rc).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+func (rcg *recoveryCodeGorm) Count(userID uint) (int, error) {
+	var n int
+	err := rcg.db.Model(&recoveryCode{}).Where("user_id = ?", userID).Count(&n).Error
+
+	return n, err
+}
+
+func (rcg *recoveryCodeGorm) DeleteByUserID(userID uint) error {
+	return rcg.db.Where("user_id = ?", userID).Delete(&recoveryCode{}).Error
+}
+
+func (rcv *recoveryCodeValidator) Use(userID uint, code string) (bool, error) {
+	if userID <= 0 {
+		return false, ErrUserIDReq
+	}
+
+	code = normalizeRecoveryCode(code)
+	if len(code) != recoveryCodeChars {
+		return false, nil
+	}
+
+	// a code made under an older key is found by its old hash
+	for _, codeHash := range rcv.hmac.Hashes(code) {
+		ok, err := rcv.recoveryCodeDB.Use(userID, codeHash)
+		if ok || err != nil {
+			return ok, err
+		}
+	}
+
+	return false, nil
+}
+
+func (rcv *recoveryCodeValidator) Replace(userID uint, codes []string) error {
+	if userID <= 0 {
+		return ErrUserIDReq
+	}
+
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = rcv.hmac.Hash(normalizeRecoveryCode(code))
+	}
+
+	return rcv.recoveryCodeDB.Replace(userID, hashes)
+}
+
+func (rcv *recoveryCodeValidator) DeleteByUserID(userID uint) error {
+	if userID <= 0 {
+		return ErrUserIDReq
+	}
+
+	return rcv.recoveryCodeDB.DeleteByUserID(userID)
+}
+
+func (tfs *twoFactorService) Enroll(user *User) (string, error) {
+	if user.TOTPEnabled {
+		return "", ErrTwoFactorEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+
+	if err := tfs.totpDB.SetTOTP(user.ID, secret, false); err != nil {
+		return "", err
+	}
+	user.TOTPSecret = secret
+
+	return secret, nil
+}
+
+func (tfs *twoFactorService) Enable(user *User, code string) ([]string, error) {
+	if user.TOTPEnabled {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	if user.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+
+	counter, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return nil, ErrTOTPCodeInvalid
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tfs.codes.Replace(user.ID, codes); err != nil {
+		return nil, err
+	}
+
+	if err := tfs.totpDB.SetTOTP(user.ID, user.TOTPSecret, true); err != nil {
+		return nil, err
+	}
+
+	// the code that turned it on cannot be used to log in
+	if _, err := tfs.totpDB.UseCounter(user.ID, counter); err != nil {
+		return nil, err
+	}
+
+	user.TOTPEnabled = true
+	user.TOTPCounter = counter
+
+	return codes, nil
+}
+
+func (tfs *twoFactorService) Check(user *User, code string) error {
+	if !user.TOTPEnabled {
+		return ErrTwoFactorNotEnrolled
+	}
+
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if len(code) != totp.Digits {
+		ok, err := tfs.codes.Use(user.ID, code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrTOTPCodeInvalid
+		}
+
+		return nil
+	}
+
+	counter, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return ErrTOTPCodeInvalid
+	}
+
+	ok, err := tfs.totpDB.UseCounter(user.ID, counter)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrTOTPCodeInvalid
+	}
+	user.TOTPCounter = counter
+
+	return nil
+}
+
+func (tfs *twoFactorService) Disable(userID uint) error {
+	if userID <= 0 {
+		return ErrIDInvalid
+	}
+
+	if err := tfs.totpDB.SetTOTP(userID, "", false); err != nil {
+		return err
+	}
+
+	return tfs.codes.DeleteByUserID(userID)
+}
+
+func (tfs *twoFactorService) RecoveryCodesLeft(userID uint) (int, error) {
+	return tfs.codes.Count(userID)
+}
+
+// ChallengeToken is signed rather than stored, like the email verification
+// token: it holds the user ID and the expiry.
+func (tfs *twoFactorService) ChallengeToken(user *User) (string, error) {
+	if user.ID <= 0 {
+		return "", ErrIDInvalid
+	}
+
+	payload := fmt.Sprintf("%d:%d", user.ID, time.Now().Add(challengeLifetime).Unix())
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+
+	return encoded + "." + tfs.hmac.Hash(challengePurpose+encoded), nil
+}
+
+func (tfs *twoFactorService) Challenge(token string) (*User, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return nil, ErrChallengeInvalid
+	}
+	encoded, sig := token[:i], token[i+1:]
+
+	if !tfs.hmac.Verify(challengePurpose+encoded, sig) {
+		return nil, ErrChallengeInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrChallengeInvalid
+	}
+
+	parts := strings.SplitN(string(payload), ":", 2)
+	if len(parts) != 2 {
+		return nil, ErrChallengeInvalid
+	}
+
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrChallengeInvalid
+	}
+
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, ErrChallengeInvalid
+	}
+
+	user, err := tfs.users.ByID(uint(id))
+	if err == ErrNotFound {
+		return nil, ErrChallengeInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// turned off in the meantime, the password alone was enough
+	if !user.TOTPEnabled {
+		return nil, ErrChallengeInvalid
+	}
+
+	return user, nil
+}
+
+// newRecoveryCodes returns codes formatted for reading, like
+// "abcde-fghij".
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, RecoveryCodes)
+	for i := range codes {
+		b, err := rand.Bytes(recoveryCodeChars * 5 / 8)
+		if err != nil {
+			return nil, err
+		}
+
+		code := recoveryEncoding.EncodeToString(b)
+		codes[i] = code[:recoveryCodeChars/2] + "-" + code[recoveryCodeChars/2:]
+	}
+
+	return codes, nil
+}
+
+// normalizeRecoveryCode accepts codes typed with or without the dash, in
+// any case.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.Replace(code, "-", "", -1)
+
+	return strings.Replace(code, " ", "", -1)
+}
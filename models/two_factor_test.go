@@ -0,0 +1,190 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iamtraining/gallery/hash"
+	"github.com/iamtraining/gallery/totp"
+)
+
+// enabledUser enrolls and enables two-factor authentication for the test
+// user and returns them with their recovery codes.
+func enabledUser(t *testing.T, s *Services) (*User, []string) {
+	t.Helper()
+
+	user, _ := s.User.ByID(1)
+	secret, err := s.TwoFactor.Enroll(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := totp.Code(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes, err := s.TwoFactor.Enable(user, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user, codes
+}
+
+func TestTwoFactorEnable(t *testing.T) {
+	ts := newTestStores(testUser())
+	tfs := ts.services(testHMACKey).TwoFactor
+
+	user, _ := ts.users.ByID(1)
+	if _, err := tfs.Enable(user, "123456"); err != ErrTwoFactorNotEnrolled {
+		t.Errorf("Enable() before Enroll() = %v, want ErrTwoFactorNotEnrolled", err)
+	}
+
+	secret, err := tfs.Enroll(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.users.users[1].TOTPEnabled {
+		t.Fatal("Enroll() turned two-factor authentication on")
+	}
+
+	if _, err := tfs.Enable(user, "000000"); err != ErrTOTPCodeInvalid {
+		t.Errorf("Enable() with a wrong code = %v, want ErrTOTPCodeInvalid", err)
+	}
+
+	code, _ := totp.Code(secret, time.Now())
+	recovery, err := tfs.Enable(user, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ts.users.users[1].TOTPEnabled || !user.TOTPEnabled {
+		t.Error("Enable() did not turn two-factor authentication on")
+	}
+
+	if len(recovery) != RecoveryCodes {
+		t.Fatalf("%d recovery codes, want %d", len(recovery), RecoveryCodes)
+	}
+	seen := make(map[string]bool)
+	for _, rc := range recovery {
+		if len(normalizeRecoveryCode(rc)) != recoveryCodeChars || seen[rc] {
+			t.Errorf("recovery code %q is malformed or repeated", rc)
+		}
+		seen[rc] = true
+
+		for _, h := range ts.codes.hashes[1] {
+			if strings.Contains(h, rc) {
+				t.Errorf("recovery code %q is stored in clear", rc)
+			}
+		}
+	}
+
+	// the code that turned it on cannot sign in
+	if err := tfs.Check(user, code); err != ErrTOTPCodeInvalid {
+		t.Errorf("Check() with the code of Enable() = %v, want ErrTOTPCodeInvalid", err)
+	}
+
+	if _, err := tfs.Enroll(user); err != ErrTwoFactorEnabled {
+		t.Errorf("Enroll() while enabled = %v, want ErrTwoFactorEnabled", err)
+	}
+}
+
+func TestTwoFactorCheckTOTP(t *testing.T) {
+	ts := newTestStores(testUser())
+	s := ts.services(testHMACKey)
+	tfs := s.TwoFactor
+	user, _ := enabledUser(t, s)
+
+	// Enable() used the current period, the next one is still accepted
+	next, _ := totp.Code(user.TOTPSecret, time.Now().Add(totp.Period))
+	if err := tfs.Check(user, next); err != nil {
+		t.Fatalf("Check() of the next code = %v", err)
+	}
+
+	// a code is used once, and the codes before it are gone too
+	if err := tfs.Check(user, next); err != ErrTOTPCodeInvalid {
+		t.Errorf("Check() of a used code = %v, want ErrTOTPCodeInvalid", err)
+	}
+	previous, _ := totp.Code(user.TOTPSecret, time.Now().Add(-totp.Period))
+	if err := tfs.Check(user, previous); err != ErrTOTPCodeInvalid {
+		t.Errorf("Check() of an older code = %v, want ErrTOTPCodeInvalid", err)
+	}
+
+	if err := tfs.Check(&User{}, next); err != ErrTwoFactorNotEnrolled {
+		t.Errorf("Check() for a user without two-factor = %v, want ErrTwoFactorNotEnrolled", err)
+	}
+}
+
+func TestTwoFactorRecoveryCodes(t *testing.T) {
+	ts := newTestStores(testUser())
+	s := ts.services(testHMACKey)
+	tfs := s.TwoFactor
+	user, recovery := enabledUser(t, s)
+
+	// typed without the dash and in upper case
+	typed := strings.ToUpper(strings.Replace(recovery[0], "-", "", 1))
+	if err := tfs.Check(user, " "+typed+" "); err != nil {
+		t.Fatalf("Check() of a recovery code = %v", err)
+	}
+	if err := tfs.Check(user, recovery[0]); err != ErrTOTPCodeInvalid {
+		t.Errorf("Check() of a used recovery code = %v, want ErrTOTPCodeInvalid", err)
+	}
+	if left, _ := tfs.RecoveryCodesLeft(1); left != RecoveryCodes-1 {
+		t.Errorf("RecoveryCodesLeft() = %d, want %d", left, RecoveryCodes-1)
+	}
+
+	if err := tfs.Check(user, "aaaaa-aaaaa"); err != ErrTOTPCodeInvalid {
+		t.Errorf("Check() of an unknown recovery code = %v, want ErrTOTPCodeInvalid", err)
+	}
+
+	if err := tfs.Disable(1); err != nil {
+		t.Fatal(err)
+	}
+	if left, _ := tfs.RecoveryCodesLeft(1); left != 0 || ts.users.users[1].TOTPEnabled {
+		t.Errorf("after Disable() %d codes are left and enabled is %v", left, ts.users.users[1].TOTPEnabled)
+	}
+}
+
+func TestTwoFactorRecoveryCodesKeyRotation(t *testing.T) {
+	ts := newTestStores(testUser())
+	user, recovery := enabledUser(t, ts.services(testOldHMACKey))
+
+	rotated := ts.services(testHMACKey, testOldHMACKey).TwoFactor
+	if err := rotated.Check(user, recovery[1]); err != nil {
+		t.Errorf("Check() of a recovery code made with the previous key = %v", err)
+	}
+}
+
+func TestTwoFactorChallenge(t *testing.T) {
+	ts := newTestStores(testUser())
+	s := ts.services(testHMACKey)
+	tfs := s.TwoFactor
+	user, _ := enabledUser(t, s)
+
+	token, err := tfs.ChallengeToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := tfs.Challenge(token)
+	if err != nil || found.ID != user.ID {
+		t.Fatalf("Challenge() = %+v, %v; want user %d", found, err, user.ID)
+	}
+
+	i := strings.LastIndex(token, ".")
+	for _, bad := range []string{"", token[:i], token[:i] + ".AAAA",
+		token[:i] + "." + hash.NewHMAC(testHMACKey).Hash(verifyPurpose+token[:i])} {
+		if _, err := tfs.Challenge(bad); err != ErrChallengeInvalid {
+			t.Errorf("Challenge(%q) = %v, want ErrChallengeInvalid", bad, err)
+		}
+	}
+
+	// turned off in the meantime
+	if err := tfs.Disable(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tfs.Challenge(token); err != ErrChallengeInvalid {
+		t.Errorf("Challenge() after Disable() = %v, want ErrChallengeInvalid", err)
+	}
+}
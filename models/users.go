@@ -1,11 +1,12 @@
 package models
 
 import (
+	"fmt"
+	"log"
 	"regexp"
 	"strings"
 
 	"github.com/iamtraining/gallery/hash"
-	"github.com/iamtraining/gallery/rand"
 	"github.com/jinzhu/gorm"
 	_ "github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
@@ -24,29 +25,56 @@ var (
 	ErrRememberTokenTooShort modelError = "models: remember token must be at least 32 bytes"
 )
 
-var userPwPepper = "secret-random-string"
-
 var _ UserDB = &userGorm{}
 var _ UserService = &userService{}
 
-const hmacSecretKey = "secret-hmac-key"
-
 type User struct {
 	gorm.Model
 	Name         string
 	Email        string `gorm:"not null;unique_index"`
 	Password     string `gorm:"-"`
 	PasswordHash string `gorm:"not null"`
-	Remember     string `gorm:"-"`
-	RememberHash string `gorm:"not null; unique_index"`
+	// PepperID is the ID of the pepper PasswordHash was made with.
+	PepperID string `gorm:"not null;default:''"`
+	// EmailVerified is set once the user followed the link sent to Email.
+	EmailVerified bool `gorm:"not null;default:false"`
+	// TOTPSecret is the authenticator app secret, set when two-factor
+	// authentication is set up. Codes are asked for only once TOTPEnabled
+	// is set.
+	TOTPSecret  string `gorm:"not null;default:''"`
+	TOTPEnabled bool   `gorm:"not null;default:false"`
+	// TOTPCounter is the period of the last accepted code, so a code
+	// cannot be used twice.
+	TOTPCounter int64 `gorm:"not null;default:0"`
+	// Role is one of Roles, it decides what the user may do besides
+	// managing their own galleries.
+	Role string `gorm:"not null;default:'user'"`
+	// Disabled accounts cannot sign in, their sessions and API tokens are
+	// not accepted.
+	Disabled bool `gorm:"not null;default:false"`
 }
 
 type userService struct {
 	UserDB
+	peppers   []hash.Key
+	hmac      hash.HMAC
+	pwResetDB pwResetDB
 }
 
 type UserService interface {
 	Authentificate(email, password string) (*User, error)
+	// InitiateReset starts a password reset for the user with the email
+	// address and returns the token to send to them.
+	InitiateReset(email string) (string, error)
+	// CompleteReset sets the password of the user a reset token was issued
+	// for. The token cannot be used again.
+	CompleteReset(token, newPw string) (*User, error)
+	// VerificationToken returns the token to send to the email address of
+	// user to confirm it.
+	VerificationToken(user *User) (string, error)
+	// Verify marks the email address a verification token was issued for
+	// as confirmed.
+	Verify(token string) (*User, error)
 	UserDB
 }
 
@@ -56,7 +84,8 @@ type userGorm struct {
 
 type userValidator struct {
 	UserDB
-	hmac        hash.HMAC
+	// pepper is the current pepper, new password hashes are made with it.
+	pepper      hash.Key
 	emailRegexp *regexp.Regexp
 }
 
@@ -65,7 +94,9 @@ type userValFunc func(*User) error
 type UserDB interface {
 	ByID(id uint) (*User, error)
 	ByEmail(email string) (*User, error)
-	ByRemember(token string) (*User, error)
+	// List returns up to limit users, ordered by ID, skipping the first
+	// offset.
+	List(offset, limit int) ([]User, error)
 
 	// altering users methods
 	Create(user *User) error
@@ -75,20 +106,27 @@ type UserDB interface {
 
 type modelError string
 
-func NewUserService(db *gorm.DB) UserService {
+// NewUserService hashes new passwords with the first of peppers and signs
+// tokens with the first of hmacKeys. The other keys are previous ones:
+// passwords hashed with an older pepper are hashed again with the current
+// one when the user signs in, tokens made with an older HMAC key stay
+// valid until they expire.
+func NewUserService(db *gorm.DB, peppers, hmacKeys []hash.Key) UserService {
 	ug := &userGorm{db}
-	hmac := hash.NewHMAC(hmacSecretKey)
-	uv := newUserValidator(ug, hmac)
+	uv := newUserValidator(ug, peppers[0])
 
 	return &userService{
-		UserDB: uv,
+		UserDB:    uv,
+		peppers:   peppers,
+		hmac:      hash.NewHMAC(hmacKeys...),
+		pwResetDB: newPwResetValidator(&pwResetGorm{db}, hash.NewHMAC(hmacKeys...)),
 	}
 }
 
-func newUserValidator(udb UserDB, hmac hash.HMAC) *userValidator {
+func newUserValidator(udb UserDB, pepper hash.Key) *userValidator {
 	return &userValidator{
 		UserDB: udb,
-		hmac:   hmac,
+		pepper: pepper,
 		emailRegexp: regexp.MustCompile(
 			`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`,
 		),
@@ -126,13 +164,24 @@ func (ug *userGorm) ByEmail(email string) (*User, error) {
 	return &user, err
 }
 
+func (ug *userGorm) List(offset, limit int) ([]User, error) {
+	var users []User
+	if err := ug.db.Order("id").Offset(offset).Limit(limit).Find(&users).Error; err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
 func (ug *userGorm) Update(u *User) error {
 	return ug.db.Save(u).Error
 }
 
+// Delete removes the user row for good, a soft deleted row would keep the
+// email address taken.
 func (ug *userGorm) Delete(id uint) error {
 	user := User{Model: gorm.Model{ID: id}}
-	return ug.db.Delete(&user).Error
+	return ug.db.Unscoped().Delete(&user).Error
 }
 
 func (us *userService) Authentificate(email, password string) (*User, error) {
@@ -141,40 +190,101 @@ func (us *userService) Authentificate(email, password string) (*User, error) {
 		return nil, err
 	}
 
+	pepper, ok := us.pepper(foundUser.PepperID)
+	if !ok {
+		return nil, fmt.Errorf("models: pepper %q of user %d is not configured",
+			foundUser.PepperID, foundUser.ID)
+	}
+
 	err = bcrypt.CompareHashAndPassword(
 		[]byte(foundUser.PasswordHash),
-		[]byte(password+userPwPepper),
+		[]byte(password+pepper.Secret),
 	)
 
 	switch err {
 	case nil:
-		return foundUser, nil
 	case bcrypt.ErrMismatchedHashAndPassword:
 		return nil, ErrPasswordInvalid
 	default:
 		return nil, err
 	}
+
+	// the password is at hand only now, so this is when a hash made with
+	// an old pepper can be replaced
+	if pepper.ID != us.peppers[0].ID {
+		foundUser.Password = password
+		if err := us.Update(foundUser); err != nil {
+			log.Printf("rehashing the password of user %d: %v", foundUser.ID, err)
+		}
+	}
+
+	return foundUser, nil
 }
 
-func (ug *userGorm) ByRemember(rememberHash string) (*User, error) {
-	var user User
-	err := first(ug.db.Where("remember_hash = ?", rememberHash), &user)
+func (us *userService) pepper(id string) (hash.Key, bool) {
+	for _, pepper := range us.peppers {
+		if pepper.ID == id {
+			return pepper, true
+		}
+	}
+
+	return hash.Key{}, false
+}
+
+// Delete deletes the user along with their pending password resets.
+func (us *userService) Delete(id uint) error {
+	if err := us.pwResetDB.DeleteByUserID(id); err != nil {
+		return err
+	}
+
+	return us.UserDB.Delete(id)
+}
+
+func (us *userService) InitiateReset(email string) (string, error) {
+	user, err := us.ByEmail(email)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	return &user, err
+	pwr := pwReset{
+		UserID: user.ID,
+	}
+	if err := us.pwResetDB.Create(&pwr); err != nil {
+		return "", err
+	}
+
+	return pwr.Token, nil
 }
 
-func (uv *userValidator) ByRemember(token string) (*User, error) {
-	user := User{
-		Remember: token,
+func (us *userService) CompleteReset(token, newPw string) (*User, error) {
+	pwr, err := us.pwResetDB.ByToken(token)
+	if err == ErrNotFound {
+		return nil, ErrTokenInvalid
 	}
-	if err := runUserValFuncs(&user, uv.hmacRemember); err != nil {
+	if err != nil {
 		return nil, err
 	}
 
-	return uv.UserDB.ByRemember(user.RememberHash)
+	user, err := us.ByID(pwr.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if newPw == "" {
+		return nil, ErrPasswordRequired
+	}
+	user.Password = newPw
+
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+
+	// every link that was sent, not only the one used, stops working
+	if err := us.pwResetDB.DeleteByUserID(user.ID); err != nil {
+		return nil, err
+	}
+
+	return user, nil
 }
 
 func (uv *userValidator) Create(user *User) error {
@@ -183,14 +293,11 @@ func (uv *userValidator) Create(user *User) error {
 		uv.passwordMinLength,
 		uv.bcryptPassword,
 		uv.passwordHashRequired,
-		uv.setRememberUnset,
-		uv.rememberMinBytes,
-		uv.hmacRemember,
-		uv.rememberHashRequired,
 		uv.emailNorms,
 		uv.requireEmail,
 		uv.emailFormat,
 		uv.emailIsAvailable,
+		uv.roleCheck,
 	); err != nil {
 		return err
 	}
@@ -203,13 +310,12 @@ func (uv *userValidator) Update(user *User) error {
 		uv.passwordMinLength,
 		uv.bcryptPassword,
 		uv.passwordHashRequired,
-		uv.rememberMinBytes,
-		uv.hmacRemember,
-		uv.rememberHashRequired,
 		uv.emailNorms,
 		uv.requireEmail,
 		uv.emailFormat,
 		uv.emailIsAvailable,
+		uv.emailChangeUnverifies,
+		uv.roleCheck,
 	); err != nil {
 		return err
 	}
@@ -235,13 +341,14 @@ func (uv *userValidator) bcryptPassword(user *User) error {
 		return nil
 	}
 
-	pwBytes := []byte(user.Password + userPwPepper)
+	pwBytes := []byte(user.Password + uv.pepper.Secret)
 	hashedBytes, err := bcrypt.GenerateFromPassword(pwBytes, bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
 
 	user.PasswordHash = string(hashedBytes)
+	user.PepperID = uv.pepper.ID
 	user.Password = ""
 
 	return nil
@@ -257,29 +364,6 @@ func runUserValFuncs(user *User, funcs ...userValFunc) error {
 	return nil
 }
 
-func (uv *userValidator) hmacRemember(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-	user.RememberHash = uv.hmac.Hash(user.Remember)
-
-	return nil
-}
-
-func (uv *userValidator) setRememberUnset(user *User) error {
-	if user.Remember != "" {
-		return nil
-	}
-
-	token, err := rand.RememberToken()
-	if err != nil {
-		return err
-	}
-	user.Remember = token
-
-	return nil
-}
-
 func (uv *userValidator) idCheck() userValFunc {
 	return userValFunc(func(u *User) error {
 		if u.ID <= 0 {
@@ -347,54 +431,56 @@ func (uv *userValidator) emailIsAvailable(user *User) error {
 	return nil
 }
 
-func (uv *userValidator) passwordMinLength(user *User) error {
-	if user.Password == "" {
-		return nil
+// emailChangeUnverifies clears EmailVerified when the address is changed,
+// the new one has to be confirmed again.
+func (uv *userValidator) emailChangeUnverifies(user *User) error {
+	old, err := uv.UserDB.ByID(user.ID)
+	if err != nil {
+		return err
 	}
 
-	if len(user.Password) < 8 {
-		return ErrPasswordShort
+	if old.Email != user.Email {
+		user.EmailVerified = false
 	}
 
 	return nil
 }
 
-func (uv *userValidator) passwordRequired(user *User) error {
-	if user.Password == "" {
-		return ErrPasswordRequired
+func (uv *userValidator) roleCheck(user *User) error {
+	if user.Role == "" {
+		user.Role = RoleUser
 	}
 
-	return nil
-}
-
-func (uv *userValidator) passwordHashRequired(user *User) error {
-	if user.PasswordHash == "" {
-		return ErrPasswordRequired
+	if roleRank(user.Role) < 0 {
+		return ErrRoleInvalid
 	}
 
 	return nil
 }
 
-func (uv *userValidator) rememberMinBytes(user *User) error {
-	if user.Remember == "" {
+func (uv *userValidator) passwordMinLength(user *User) error {
+	if user.Password == "" {
 		return nil
 	}
 
-	n, err := rand.NBytes(user.Remember)
-	if err != nil {
-		return err
+	if len(user.Password) < 8 {
+		return ErrPasswordShort
 	}
 
-	if n < 32 {
-		return ErrRememberTokenTooShort
+	return nil
+}
+
+func (uv *userValidator) passwordRequired(user *User) error {
+	if user.Password == "" {
+		return ErrPasswordRequired
 	}
 
 	return nil
 }
 
-func (uv *userValidator) rememberHashRequired(user *User) error {
-	if user.RememberHash == "" {
-		return ErrRememberTokenRequired
+func (uv *userValidator) passwordHashRequired(user *User) error {
+	if user.PasswordHash == "" {
+		return ErrPasswordRequired
 	}
 
 	return nil
@@ -0,0 +1,190 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iamtraining/gallery/hash"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestInitiateReset(t *testing.T) {
+	ts := newTestStores(testUser())
+	us := ts.services(testHMACKey).User
+
+	if _, err := us.InitiateReset("nobody@example.com"); err != ErrNotFound {
+		t.Errorf("InitiateReset() of an unknown address = %v, want ErrNotFound", err)
+	}
+
+	token, err := us.InitiateReset("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ts.resets.resets) != 1 {
+		t.Fatalf("%d resets stored, want 1", len(ts.resets.resets))
+	}
+	for _, pwr := range ts.resets.resets {
+		if pwr.UserID != 1 {
+			t.Errorf("reset of user %d, want 1", pwr.UserID)
+		}
+		if pwr.TokenHash != hash.NewHMAC(testHMACKey).Hash(token) {
+			t.Error("the stored hash is not the HMAC of the token")
+		}
+		if left := time.Until(pwr.ExpiresAt); left <= pwResetLifetime-time.Minute || left > pwResetLifetime {
+			t.Errorf("reset expires in %v, want %v", left, pwResetLifetime)
+		}
+	}
+}
+
+func TestCompleteReset(t *testing.T) {
+	ts := newTestStores(testUser())
+	us := ts.services(testHMACKey).User
+
+	token, err := us.InitiateReset("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := us.InitiateReset("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := us.CompleteReset(token, ""); err != ErrPasswordRequired {
+		t.Fatalf("CompleteReset() without a password = %v, want ErrPasswordRequired", err)
+	}
+
+	// the failed attempt did not use the token up
+	user, err := us.CompleteReset(token, "new password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != 1 {
+		t.Errorf("CompleteReset() changed the password of user %d, want 1", user.ID)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(ts.users.users[1].PasswordHash),
+		[]byte("new password"+testPepper.Secret)); err != nil {
+		t.Errorf("the password was not changed: %v", err)
+	}
+
+	// every link that was sent stops working, the used one included
+	for _, used := range []string{token, other} {
+		if _, err := us.CompleteReset(used, "another password"); err != ErrTokenInvalid {
+			t.Errorf("CompleteReset() with a used token = %v, want ErrTokenInvalid", err)
+		}
+	}
+}
+
+func TestCompleteResetInvalid(t *testing.T) {
+	ts := newTestStores(testUser())
+	us := ts.services(testHMACKey).User
+
+	token, err := us.InitiateReset("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pwr := range ts.resets.resets {
+		pwr.ExpiresAt = time.Now().Add(-time.Second)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		token string
+	}{
+		{"expired", token},
+		{"malformed", "not a token"},
+		{"short", "c2hvcnQ="},
+		{"empty", ""},
+	} {
+		if _, err := us.CompleteReset(tc.token, "new password"); err != ErrTokenInvalid {
+			t.Errorf("%s: CompleteReset() = %v, want ErrTokenInvalid", tc.name, err)
+		}
+	}
+}
+
+func TestCompleteResetKeyRotation(t *testing.T) {
+	ts := newTestStores(testUser())
+
+	token, err := ts.services(testOldHMACKey).User.InitiateReset("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := ts.services(testHMACKey, testOldHMACKey).User
+	if _, err := rotated.CompleteReset(token, "new password"); err != nil {
+		t.Errorf("CompleteReset() of a token made with the previous key = %v", err)
+	}
+}
+
+// userWithPassword returns the test user with a password hashed with pepper.
+func userWithPassword(t *testing.T, password string, pepper hash.Key) User {
+	t.Helper()
+
+	h, err := bcrypt.GenerateFromPassword([]byte(password+pepper.Secret), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := testUser()
+	user.PasswordHash = string(h)
+	user.PepperID = pepper.ID
+
+	return user
+}
+
+func TestAuthentificatePepperRotation(t *testing.T) {
+	oldPepper := hash.Key{ID: "1", Secret: "old-pepper"}
+	newPepper := hash.Key{ID: "2", Secret: "new-pepper"}
+
+	ts := newTestStores(userWithPassword(t, "password", oldPepper))
+	ts.peppers = []hash.Key{newPepper, oldPepper}
+	us := ts.services(testHMACKey).User
+
+	if _, err := us.Authentificate("alice@example.com", "wrong password"); err != ErrPasswordInvalid {
+		t.Fatalf("Authentificate() with a wrong password = %v, want ErrPasswordInvalid", err)
+	}
+	if ts.users.updates != 0 {
+		t.Fatal("the hash was replaced after a failed sign in")
+	}
+
+	if _, err := us.Authentificate("alice@example.com", "password"); err != nil {
+		t.Fatalf("Authentificate() with the old pepper = %v", err)
+	}
+
+	// the hash was made again with the current pepper
+	saved := ts.users.users[1]
+	if saved.PepperID != newPepper.ID {
+		t.Errorf("PepperID = %q, want %q", saved.PepperID, newPepper.ID)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(saved.PasswordHash),
+		[]byte("password"+newPepper.Secret)); err != nil {
+		t.Errorf("the new hash is not of the password with the current pepper: %v", err)
+	}
+	if saved.Password != "" {
+		t.Error("the password was kept in clear")
+	}
+
+	// once every user has signed in the old pepper can be removed
+	ts.peppers = []hash.Key{newPepper}
+	current := ts.services(testHMACKey).User
+	updates := ts.users.updates
+	if _, err := current.Authentificate("alice@example.com", "password"); err != nil {
+		t.Errorf("Authentificate() with the current pepper only = %v", err)
+	}
+	if ts.users.updates != updates {
+		t.Error("a hash made with the current pepper was replaced")
+	}
+}
+
+func TestAuthentificateUnknownPepper(t *testing.T) {
+	removed := hash.Key{ID: "0", Secret: "removed-pepper"}
+	current := hash.Key{ID: "2", Secret: "new-pepper"}
+
+	ts := newTestStores(userWithPassword(t, "password", removed))
+	ts.peppers = []hash.Key{current}
+	us := ts.services(testHMACKey).User
+
+	if _, err := us.Authentificate("alice@example.com", "password"); err == nil {
+		t.Error("Authentificate() succeeded with a pepper that is not configured")
+	}
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// verifyLifetime is how long an email verification link can be used.
+const verifyLifetime = 48 * time.Hour
+
+// verifyPurpose keeps verification signatures apart from the other HMACs
+// made with the same key.
+const verifyPurpose = "verify-email:"
+
+// VerificationToken returns a signed token that confirms the current email
+// address of user. Nothing is stored: the token holds the user ID, the
+// address and the expiry, so it stops working once the address changes.
+func (us *userService) VerificationToken(user *User) (string, error) {
+	if user.ID <= 0 {
+		return "", ErrIDInvalid
+	}
+
+	payload := fmt.Sprintf("%d:%d:%s",
+		user.ID, time.Now().Add(verifyLifetime).Unix(), user.Email)
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+
+	return encoded + "." + us.hmac.Hash(verifyPurpose+encoded), nil
+}
+
+func (us *userService) Verify(token string) (*User, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return nil, ErrTokenInvalid
+	}
+	encoded, sig := token[:i], token[i+1:]
+
+	if !us.hmac.Verify(verifyPurpose+encoded, sig) {
+		return nil, ErrTokenInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	parts := strings.SplitN(string(payload), ":", 3)
+	if len(parts) != 3 {
+		return nil, ErrTokenInvalid
+	}
+
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, ErrTokenInvalid
+	}
+
+	user, err := us.ByID(uint(id))
+	if err == ErrNotFound {
+		return nil, ErrTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Email != parts[2] {
+		return nil, ErrTokenInvalid
+	}
+
+	if user.EmailVerified {
+		return user, nil
+	}
+
+	user.EmailVerified = true
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
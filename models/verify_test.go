@@ -0,0 +1,119 @@
+package models
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iamtraining/gallery/hash"
+)
+
+func TestVerify(t *testing.T) {
+	ts := newTestStores(testUser())
+	us := ts.services(testHMACKey).User
+
+	alice, _ := us.ByID(1)
+	token, err := us.VerificationToken(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := us.Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.EmailVerified || !ts.users.users[1].EmailVerified {
+		t.Error("the email address was not marked as verified")
+	}
+
+	// following the link again is fine and writes nothing
+	updates := ts.users.updates
+	if _, err := us.Verify(token); err != nil {
+		t.Errorf("Verify() a second time = %v", err)
+	}
+	if ts.users.updates != updates {
+		t.Error("an address that was verified already was saved again")
+	}
+}
+
+func TestVerifyEmailChanged(t *testing.T) {
+	ts := newTestStores(testUser())
+	us := ts.services(testHMACKey).User
+
+	alice, _ := us.ByID(1)
+	token, err := us.VerificationToken(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.users.users[1].Email = "alice@example.org"
+
+	if _, err := us.Verify(token); err != ErrTokenInvalid {
+		t.Errorf("Verify() after the address changed = %v, want ErrTokenInvalid", err)
+	}
+	if ts.users.users[1].EmailVerified {
+		t.Error("the new address was marked as verified")
+	}
+}
+
+// signedVerifyToken makes a token like VerificationToken, with any payload.
+func signedVerifyToken(payload string) string {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return encoded + "." + hash.NewHMAC(testHMACKey).Hash(verifyPurpose+encoded)
+}
+
+func TestVerifyInvalid(t *testing.T) {
+	us := newTestStores(testUser()).services(testHMACKey).User
+
+	alice, _ := us.ByID(1)
+	valid, err := us.VerificationToken(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := strings.LastIndex(valid, ".")
+
+	future := time.Now().Add(time.Hour).Unix()
+	cases := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"no signature", valid[:i]},
+		{"bad signature", valid[:i] + ".AAAA"},
+		{"payload changed", base64.RawURLEncoding.EncodeToString(
+			[]byte(fmt.Sprintf("2:%d:alice@example.com", future))) + valid[i:]},
+		{"expired", signedVerifyToken(fmt.Sprintf("1:%d:alice@example.com",
+			time.Now().Add(-time.Second).Unix()))},
+		{"unknown user", signedVerifyToken(fmt.Sprintf("2:%d:alice@example.com", future))},
+		{"malformed payload", signedVerifyToken("1:alice@example.com")},
+		{"signed for another purpose", valid[:i] + "." + hash.NewHMAC(testHMACKey).Hash(valid[:i])},
+	}
+
+	for _, tc := range cases {
+		if _, err := us.Verify(tc.token); err != ErrTokenInvalid {
+			t.Errorf("%s: Verify() = %v, want ErrTokenInvalid", tc.name, err)
+		}
+	}
+}
+
+func TestVerifyKeyRotation(t *testing.T) {
+	ts := newTestStores(testUser())
+	alice, _ := ts.users.ByID(1)
+
+	token, err := ts.services(testOldHMACKey).User.VerificationToken(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := ts.services(testHMACKey, testOldHMACKey).User
+	if _, err := rotated.Verify(token); err != nil {
+		t.Errorf("Verify() of a token made with the previous key = %v", err)
+	}
+
+	removed := ts.services(testHMACKey).User
+	if _, err := removed.Verify(token); err != ErrTokenInvalid {
+		t.Errorf("Verify() after the previous key was removed = %v, want ErrTokenInvalid", err)
+	}
+}
@@ -5,7 +5,10 @@ import (
 	"encoding/base64"
 )
 
-const RememberTokenBytes = 32
+const (
+	RememberTokenBytes = 32
+	ShareSlugBytes     = 12
+)
 
 func Bytes(n int) ([]byte, error) {
 	b := make([]byte, n)
@@ -39,3 +42,8 @@ func String(nBytes int) (string, error) {
 func RememberToken() (string, error) {
 	return String(RememberTokenBytes)
 }
+
+// ShareSlug returns a random, URL safe slug for sharing unlisted galleries.
+func ShareSlug() (string, error) {
+	return String(ShareSlugBytes)
+}
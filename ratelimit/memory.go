@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+var _ Store = &MemoryStore{}
+
+// MemoryStore keeps the buckets in memory. Buckets that have not been used
+// for maxIdle are dropped; by then they are full again, as long as maxIdle
+// is at least Burst*Refill of the limits using the store.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*Bucket
+	maxIdle   time.Duration
+	lastSweep time.Time
+}
+
+func NewMemoryStore(maxIdle time.Duration) *MemoryStore {
+	return &MemoryStore{
+		buckets:   make(map[string]*Bucket),
+		maxIdle:   maxIdle,
+		lastSweep: time.Now(),
+	}
+}
+
+func (m *MemoryStore) Update(key string, fn func(b *Bucket)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sweep()
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &Bucket{}
+		m.buckets[key] = b
+	}
+	fn(b)
+
+	return nil
+}
+
+func (m *MemoryStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.buckets, key)
+
+	return nil
+}
+
+// sweep drops idle buckets, at most once every maxIdle so that updates stay
+// cheap.
+func (m *MemoryStore) sweep() {
+	now := time.Now()
+	if now.Sub(m.lastSweep) < m.maxIdle {
+		return
+	}
+	m.lastSweep = now
+
+	for key, b := range m.buckets {
+		if now.Sub(b.Updated) > m.maxIdle {
+			delete(m.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreSweep(t *testing.T) {
+	m := NewMemoryStore(time.Hour)
+	touch := func(key string) {
+		m.Update(key, func(b *Bucket) { b.Updated = time.Now() })
+	}
+
+	touch("idle")
+	touch("recent")
+	m.buckets["idle"].Updated = time.Now().Add(-2 * time.Hour)
+	m.buckets["recent"].Updated = time.Now().Add(-time.Hour / 2)
+
+	// sweeps run at most once every maxIdle
+	touch("new")
+	if _, ok := m.buckets["idle"]; !ok {
+		t.Fatal("a bucket was dropped before maxIdle passed since the last sweep")
+	}
+
+	m.lastSweep = time.Now().Add(-time.Hour)
+	touch("new")
+	if _, ok := m.buckets["idle"]; ok {
+		t.Error("a bucket idle for longer than maxIdle was kept")
+	}
+	for _, key := range []string{"recent", "new"} {
+		if _, ok := m.buckets[key]; !ok {
+			t.Errorf("bucket %q was dropped", key)
+		}
+	}
+}
+
+func TestMemoryStoreDelete(t *testing.T) {
+	m := NewMemoryStore(time.Hour)
+	m.Update("key", func(b *Bucket) { b.Used = 3 })
+
+	if err := m.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Update("key", func(b *Bucket) {
+		if b.Used != 0 {
+			t.Errorf("Used = %v after Delete(), want a new bucket", b.Used)
+		}
+	})
+}
@@ -0,0 +1,115 @@
+// Package ratelimit throttles events per key, such as an IP address or an
+// email address, with token buckets. A bucket holds up to Burst tokens and
+// gets one back every Refill; an event takes a token and is refused when
+// the bucket is empty.
+package ratelimit
+
+import (
+	"time"
+)
+
+type Limit struct {
+	Burst  int
+	Refill time.Duration
+}
+
+// Bucket is the state of one key. The zero Bucket is full.
+type Bucket struct {
+	// Used is the number of tokens taken, as of Updated.
+	Used    float64
+	Updated time.Time
+}
+
+// Store keeps the buckets. It lets the limiters run in one process, with
+// MemoryStore, or share their state between processes.
+type Store interface {
+	// Update passes the bucket of key to fn and stores it afterwards.
+	// Updates of the same key must not run concurrently.
+	Update(key string, fn func(b *Bucket)) error
+	Delete(key string) error
+}
+
+// Limiter applies one limit to the buckets of a store. The name keeps
+// the keys of limiters sharing a store apart. A nil Limiter allows
+// everything.
+type Limiter struct {
+	store Store
+	name  string
+	limit Limit
+}
+
+func New(store Store, name string, limit Limit) *Limiter {
+	return &Limiter{
+		store: store,
+		name:  name,
+		limit: limit,
+	}
+}
+
+// Allow takes a token from the bucket of key. If there is none left it
+// returns false and how long it takes until the next one is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration, error) {
+	return l.take(key, true)
+}
+
+// Blocked reports whether the bucket of key is empty, without taking a
+// token. Together with Allow on failures only it locks a key out after
+// repeated failures.
+func (l *Limiter) Blocked(key string) (bool, time.Duration, error) {
+	ok, wait, err := l.take(key, false)
+	return !ok, wait, err
+}
+
+// Reset refills the bucket of key.
+func (l *Limiter) Reset(key string) error {
+	if l == nil {
+		return nil
+	}
+
+	return l.store.Delete(l.key(key))
+}
+
+// take checks whether the bucket of key has a token left and takes it if
+// consume is set.
+func (l *Limiter) take(key string, consume bool) (bool, time.Duration, error) {
+	if l == nil {
+		return true, 0, nil
+	}
+
+	var ok bool
+	var wait time.Duration
+	err := l.store.Update(l.key(key), func(b *Bucket) {
+		now := time.Now()
+		l.refill(b, now)
+
+		missing := b.Used + 1 - float64(l.limit.Burst)
+		ok = missing <= 0
+		if !ok {
+			wait = time.Duration(missing * float64(l.limit.Refill))
+			return
+		}
+
+		if consume {
+			b.Used++
+		}
+	})
+	if err != nil {
+		return false, 0, err
+	}
+
+	return ok, wait, nil
+}
+
+func (l *Limiter) refill(b *Bucket, now time.Time) {
+	if !b.Updated.IsZero() && l.limit.Refill > 0 {
+		b.Used -= float64(now.Sub(b.Updated)) / float64(l.limit.Refill)
+		if b.Used < 0 {
+			b.Used = 0
+		}
+	}
+	b.Updated = now
+}
+
+func (l *Limiter) key(key string) string {
+	return l.name + ":" + key
+}
@@ -0,0 +1,143 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+var testLimit = Limit{Burst: 3, Refill: time.Minute}
+
+// within reports whether got is want, give or take the time the test took.
+func within(got, want time.Duration) bool {
+	d := got - want
+	return d > -time.Second && d < time.Second
+}
+
+// setBucket stores the bucket of key as it was idle ago.
+func setBucket(t *testing.T, l *Limiter, key string, used float64, idle time.Duration) {
+	t.Helper()
+
+	err := l.store.Update(l.key(key), func(b *Bucket) {
+		b.Used = used
+		b.Updated = time.Now().Add(-idle)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllow(t *testing.T) {
+	cases := []struct {
+		name string
+		used float64
+		idle time.Duration
+		ok   bool
+		wait time.Duration
+	}{
+		{"new key", 0, 0, true, 0},
+		{"one token left", 2, 0, true, 0},
+		{"empty", 3, 0, false, time.Minute},
+		{"empty, half a token back", 3, 30 * time.Second, false, 30 * time.Second},
+		{"empty, one token back", 3, time.Minute, true, 0},
+		{"half a token left", 2.5, 0, false, 30 * time.Second},
+		{"idle for long", 3, time.Hour, true, 0},
+	}
+
+	for _, tc := range cases {
+		l := New(NewMemoryStore(time.Hour), "test", testLimit)
+		if tc.used > 0 {
+			setBucket(t, l, "key", tc.used, tc.idle)
+		}
+
+		ok, wait, err := l.Allow("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tc.ok || !within(wait, tc.wait) {
+			t.Errorf("%s: Allow() = %v, %v; want %v, %v", tc.name, ok, wait, tc.ok, tc.wait)
+		}
+	}
+}
+
+func TestAllowBurst(t *testing.T) {
+	l := New(NewMemoryStore(time.Hour), "test", testLimit)
+
+	for i := 0; i < testLimit.Burst; i++ {
+		if ok, _, _ := l.Allow("key"); !ok {
+			t.Fatalf("Allow() %d of the burst of %d = false", i+1, testLimit.Burst)
+		}
+	}
+
+	ok, wait, err := l.Allow("key")
+	if err != nil || ok || !within(wait, testLimit.Refill) {
+		t.Errorf("Allow() after the burst = %v, %v, %v; want false, %v", ok, wait, err, testLimit.Refill)
+	}
+
+	// the keys and the limiters sharing the store have their own buckets
+	if ok, _, _ := l.Allow("other"); !ok {
+		t.Error("Allow() of another key = false")
+	}
+	if ok, _, _ := New(l.store, "other", testLimit).Allow("key"); !ok {
+		t.Error("Allow() of another limiter = false")
+	}
+
+	// a bucket idle for Burst*Refill is full again, MemoryStore relies on it
+	idle := New(NewMemoryStore(time.Hour), "test", testLimit)
+	setBucket(t, idle, "key", 3, time.Duration(testLimit.Burst)*testLimit.Refill)
+	for i := 0; i < testLimit.Burst; i++ {
+		if ok, _, _ := idle.Allow("key"); !ok {
+			t.Fatalf("Allow() %d after Burst*Refill idle = false", i+1)
+		}
+	}
+
+	// however long it was idle, the bucket holds no more than Burst
+	long := New(NewMemoryStore(time.Hour), "test", testLimit)
+	setBucket(t, long, "key", 3, time.Hour)
+	for i := 0; i < testLimit.Burst; i++ {
+		long.Allow("key")
+	}
+	if ok, _, _ := long.Allow("key"); ok {
+		t.Errorf("Allow() %d after a long idle = true", testLimit.Burst+1)
+	}
+}
+
+func TestBlocked(t *testing.T) {
+	l := New(NewMemoryStore(time.Hour), "test", testLimit)
+
+	// failures are counted with Allow, Blocked only looks
+	for i := 0; i < testLimit.Burst; i++ {
+		if blocked, _, _ := l.Blocked("key"); blocked {
+			t.Fatalf("Blocked() after %d failures = true", i)
+		}
+		l.Allow("key")
+	}
+
+	blocked, wait, err := l.Blocked("key")
+	if err != nil || !blocked || !within(wait, testLimit.Refill) {
+		t.Fatalf("Blocked() after %d failures = %v, %v, %v; want true, %v",
+			testLimit.Burst, blocked, wait, err, testLimit.Refill)
+	}
+
+	if err := l.Reset("key"); err != nil {
+		t.Fatal(err)
+	}
+	if blocked, _, _ := l.Blocked("key"); blocked {
+		t.Error("Blocked() after Reset() = true")
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+
+	for i := 0; i < 10; i++ {
+		if ok, wait, err := l.Allow("key"); !ok || wait != 0 || err != nil {
+			t.Fatalf("Allow() of a nil Limiter = %v, %v, %v", ok, wait, err)
+		}
+	}
+	if blocked, _, err := l.Blocked("key"); blocked || err != nil {
+		t.Errorf("Blocked() of a nil Limiter = %v, %v", blocked, err)
+	}
+	if err := l.Reset("key"); err != nil {
+		t.Errorf("Reset() of a nil Limiter = %v", err)
+	}
+}
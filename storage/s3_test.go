@@ -0,0 +1,346 @@
+package storage
+
+import (
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a stand-in for a path style S3 service such as MinIO. It
+// checks the signature of every request and keeps the objects in memory.
+type fakeS3 struct {
+	t        *testing.T
+	bucket   string
+	signer   sigV4
+	pageSize int
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	modTime time.Time
+}
+
+type fakeS3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+func newFakeS3(t *testing.T, cfg S3Config) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{
+		t:      t,
+		bucket: cfg.Bucket,
+		signer: sigV4{
+			accessKeyID:     cfg.AccessKeyID,
+			secretAccessKey: cfg.SecretAccessKey,
+			region:          cfg.Region,
+			service:         "s3",
+		},
+		pageSize: 2,
+		objects:  make(map[string][]byte),
+		modTime:  time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	return f, srv
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.validSignature(r) {
+		f.error(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+
+	prefix := "/" + f.bucket + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if key == "" && r.Method == http.MethodGet {
+		f.list(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if r.ContentLength < 0 || len(r.TransferEncoding) > 0 {
+			f.error(w, http.StatusLengthRequired, "MissingContentLength")
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil || int64(len(body)) != r.ContentLength {
+			f.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[key] = body
+	case http.MethodGet, http.MethodHead:
+		body, ok := f.objects[key]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("Last-Modified", f.modTime.Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(body)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// list pages through the keys pageSize at a time, the continuation token
+// is the index of the next key.
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("list-type") != "2" {
+		f.error(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, q.Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start, _ := strconv.Atoi(q.Get("continuation-token"))
+	end := start + f.pageSize
+	if end > len(keys) {
+		end = len(keys)
+	}
+
+	type content struct {
+		Key string
+	}
+	res := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	for _, key := range keys[start:end] {
+		res.Contents = append(res.Contents, content{key})
+	}
+	if end < len(keys) {
+		res.IsTruncated = true
+		res.NextContinuationToken = strconv.Itoa(end)
+	}
+
+	xml.NewEncoder(w).Encode(res)
+}
+
+// validSignature signs the request as received again and compares the
+// result with its Authorization header.
+func (f *fakeS3) validSignature(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	i := strings.Index(auth, "SignedHeaders=")
+	if i < 0 {
+		return false
+	}
+	signed := strings.SplitN(auth[i+len("SignedHeaders="):], ",", 2)[0]
+
+	headers := make(map[string]string)
+	for _, name := range strings.Split(signed, ";") {
+		if name == "host" {
+			headers[name] = r.Host
+			continue
+		}
+		headers[name] = r.Header.Get(name)
+	}
+
+	now, err := time.Parse("20060102T150405Z", r.Header.Get("x-amz-date"))
+	if err != nil {
+		return false
+	}
+
+	want := f.signer.authorization(r.Method, r.URL.EscapedPath(), canonicalQuery(r.URL.Query()),
+		headers, r.Header.Get("x-amz-content-sha256"), now)
+
+	return auth == want
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(fakeS3Error{Code: code, Message: code})
+}
+
+func testS3Config() S3Config {
+	return S3Config{
+		Region:          "eu-central-1",
+		Bucket:          "gallery",
+		AccessKeyID:     "minio",
+		SecretAccessKey: "minio-secret",
+		PathStyle:       true,
+	}
+}
+
+func newTestS3(t *testing.T) (*S3, *fakeS3) {
+	cfg := testS3Config()
+	fake, srv := newFakeS3(t, cfg)
+
+	cfg.Endpoint = srv.URL
+	s, err := NewS3(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, fake
+}
+
+// onlyReader hides every method but Read, so Put cannot tell its length.
+type onlyReader struct {
+	io.Reader
+}
+
+func TestS3PutGetStatDelete(t *testing.T) {
+	s, fake := newTestS3(t)
+
+	file, err := ioutil.TempFile("", "gallery-s3-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	file.WriteString("skipped|from a file")
+	file.Seek(int64(len("skipped|")), io.SeekStart)
+
+	cases := []struct {
+		name string
+		key  string
+		body io.Reader
+		want string
+	}{
+		{"length known", "galleries/1/a.jpg", strings.NewReader("jpeg bytes"), "jpeg bytes"},
+		{"seeker", "galleries/1/b.png", file, "from a file"},
+		{"length unknown", "galleries/2/c.gif", onlyReader{strings.NewReader("spooled")}, "spooled"},
+		{"escaped key", "galleries/2/d e+f.jpg", strings.NewReader("escaped"), "escaped"},
+		{"empty", "galleries/3/empty.jpg", strings.NewReader(""), ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := s.Put(tc.key, tc.body); err != nil {
+				t.Fatalf("Put() = %v", err)
+			}
+
+			rc, err := s.Get(tc.key)
+			if err != nil {
+				t.Fatalf("Get() = %v", err)
+			}
+			got, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil || string(got) != tc.want {
+				t.Errorf("Get() read %q, %v; want %q", got, err, tc.want)
+			}
+
+			info, err := s.Stat(tc.key)
+			if err != nil {
+				t.Fatalf("Stat() = %v", err)
+			}
+			if info.Size != int64(len(tc.want)) || !info.ModTime.Equal(fake.modTime) {
+				t.Errorf("Stat() = %+v, want size %d and mod time %v", info, len(tc.want), fake.modTime)
+			}
+		})
+	}
+
+	// the caller keeps ownership of the reader
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		t.Errorf("file was closed by Put: %v", err)
+	}
+
+	if err := s.Delete("galleries/1/a.jpg"); err != nil {
+		t.Fatalf("Delete() = %v", err)
+	}
+	if _, err := s.Get("galleries/1/a.jpg"); err != ErrNotExist {
+		t.Errorf("Get() after Delete() = %v, want ErrNotExist", err)
+	}
+	if _, err := s.Stat("galleries/1/a.jpg"); err != ErrNotExist {
+		t.Errorf("Stat() after Delete() = %v, want ErrNotExist", err)
+	}
+	if err := s.Delete("galleries/1/a.jpg"); err != nil {
+		t.Errorf("Delete() of a missing object = %v, want nil", err)
+	}
+}
+
+func TestS3List(t *testing.T) {
+	s, _ := newTestS3(t)
+
+	keys := []string{
+		"galleries/1/a.jpg",
+		"galleries/1/thumb/a.jpg",
+		"galleries/10/b.jpg",
+		"galleries/2/c.jpg",
+		"other/d.jpg",
+	}
+	for _, key := range keys {
+		if err := s.Put(key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// more keys than fit on a page of the fake
+	got, err := s.List("galleries/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := keys[:4]; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+
+	got, err = s.List("galleries/1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := keys[:2]; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+}
+
+func TestS3InvalidKey(t *testing.T) {
+	s, _ := newTestS3(t)
+
+	for _, key := range []string{"", "/abs", "../up", "a/../b"} {
+		if err := s.Put(key, strings.NewReader("x")); err != ErrInvalidKey {
+			t.Errorf("Put(%q) = %v, want ErrInvalidKey", key, err)
+		}
+	}
+}
+
+func TestS3WrongSecret(t *testing.T) {
+	cfg := testS3Config()
+	_, srv := newFakeS3(t, cfg)
+
+	cfg.Endpoint = srv.URL
+	cfg.SecretAccessKey = "wrong"
+	s, err := NewS3(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Put("galleries/1/a.jpg", strings.NewReader("x"))
+	s3err, ok := err.(*S3Error)
+	if !ok || s3err.StatusCode != http.StatusForbidden || s3err.Code != "SignatureDoesNotMatch" {
+		t.Errorf("Put() = %v, want a 403 SignatureDoesNotMatch error", err)
+	}
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotExist   = errors.New("storage: object does not exist")
+	ErrInvalidKey = errors.New("storage: invalid key")
+)
+
+// Storage keeps blobs under slash separated keys such as
+// "galleries/1/photo.jpg".
+type Storage interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+	// List returns the keys that start with prefix.
+	List(prefix string) ([]string, error)
+	Stat(key string) (*ObjectInfo, error)
+}
+
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// checkKey rejects keys that are not clean relative paths, so no backend
+// can be tricked into reading or writing outside of its root.
+func checkKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") ||
+		path.Clean(key) != key || key == ".." || strings.HasPrefix(key, "../") {
+		return ErrInvalidKey
+	}
+
+	return nil
+}
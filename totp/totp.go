@@ -0,0 +1,106 @@
+// Package totp implements time based one-time passwords (RFC 6238) as used
+// by authenticator apps: HMAC-SHA1, six digits, a new code every 30
+// seconds.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/iamtraining/gallery/rand"
+)
+
+const (
+	// SecretBytes is the size of generated secrets, 160 bits as the RFC
+	// recommends for SHA1.
+	SecretBytes = 20
+	Digits      = 6
+	Period      = 30 * time.Second
+	// Skew is how many periods a code may be off, for clocks that are not
+	// quite in sync.
+	Skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a random secret, base32 encoded the way
+// authenticator apps expect it.
+func GenerateSecret() (string, error) {
+	b, err := rand.Bytes(SecretBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(b), nil
+}
+
+// URI returns the otpauth URI that authenticator apps import, usually from
+// a QR code.
+func URI(issuer, account, secret string) string {
+	v := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(Digits)},
+		"period":    {fmt.Sprint(int(Period / time.Second))},
+	}
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// Validate checks code against the codes of the periods around now. It
+// returns the counter of the period the code belongs to, so callers can
+// refuse a code that was used before.
+func Validate(secret, code string, now time.Time) (int64, bool) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	counter := now.Unix() / int64(Period/time.Second)
+	for i := -Skew; i <= Skew; i++ {
+		c := counter + int64(i)
+		if hmac.Equal([]byte(generate(key, c)), []byte(code)) {
+			return c, true
+		}
+	}
+
+	return 0, false
+}
+
+// Code returns the code of the period at t.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	return generate(key, t.Unix()/int64(Period/time.Second)), nil
+}
+
+// generate is HOTP (RFC 4226) for counter.
+func generate(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	m := hmac.New(sha1.New, key)
+	m.Write(msg[:])
+	sum := m.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", Digits, value%1000000)
+}
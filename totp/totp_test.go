@@ -0,0 +1,123 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 secret of the test vectors of RFC 4226 and RFC
+// 6238, "12345678901234567890", base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestGenerateRFC4226(t *testing.T) {
+	key, err := encoding.DecodeString(rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489",
+	}
+	for counter, code := range want {
+		if got := generate(key, int64(counter)); got != code {
+			t.Errorf("generate(%d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+// The RFC 6238 vectors have eight digits, six digit codes are their last
+// six.
+func TestCodeRFC6238(t *testing.T) {
+	cases := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tc := range cases {
+		got, err := Code(rfcSecret, time.Unix(tc.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("Code(%d) = %s, want %s", tc.unix, got, tc.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	counter := now.Unix() / int64(Period/time.Second)
+
+	code := func(t time.Time) string {
+		c, _ := Code(rfcSecret, t)
+		return c
+	}
+
+	cases := []struct {
+		name        string
+		secret      string
+		code        string
+		wantOK      bool
+		wantCounter int64
+	}{
+		{"current", rfcSecret, code(now), true, counter},
+		{"previous period", rfcSecret, code(now.Add(-Period)), true, counter - 1},
+		{"next period", rfcSecret, code(now.Add(Period)), true, counter + 1},
+		{"too old", rfcSecret, code(now.Add(-2 * Period)), false, 0},
+		{"too new", rfcSecret, code(now.Add(2 * Period)), false, 0},
+		{"with a space", rfcSecret, code(now)[:3] + " " + code(now)[3:], true, counter},
+		{"lower case secret", strings.ToLower(rfcSecret), code(now), true, counter},
+		{"too short", rfcSecret, code(now)[:5], false, 0},
+		{"too long", rfcSecret, code(now) + "0", false, 0},
+		{"bad secret", "not base32!", code(now), false, 0},
+	}
+
+	for _, tc := range cases {
+		got, ok := Validate(tc.secret, tc.code, now)
+		if ok != tc.wantOK || got != tc.wantCounter {
+			t.Errorf("%s: Validate() = %d, %v; want %d, %v", tc.name, got, ok, tc.wantCounter, tc.wantOK)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := encoding.DecodeString(secret)
+	if err != nil || len(key) != SecretBytes {
+		t.Errorf("secret %q decodes to %d bytes, %v; want %d", secret, len(key), err, SecretBytes)
+	}
+
+	other, _ := GenerateSecret()
+	if other == secret {
+		t.Error("two secrets are the same")
+	}
+}
+
+func TestURI(t *testing.T) {
+	got := URI("Gallery", "alice@example.com", rfcSecret)
+
+	for _, want := range []string{
+		"otpauth://totp/Gallery:alice@example.com?",
+		"secret=" + rfcSecret,
+		"issuer=Gallery",
+		"digits=6",
+		"period=30",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("URI() = %s, want it to contain %s", got, want)
+		}
+	}
+}
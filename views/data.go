@@ -16,8 +16,10 @@ const (
 
 type Data struct {
 	Alert *Alert
-	Body  interface{}
-	User  *models.User
+	// Alerts are rendered below Alert, e.g. one per file of an upload.
+	Alerts []Alert
+	Body   interface{}
+	User   *models.User
 }
 
 type Alert struct {
@@ -26,18 +28,28 @@ type Alert struct {
 }
 
 func (d *Data) SetAlert(err error) {
-	var msg string
-	if pub, ok := err.(PublicError); ok {
-		msg = pub.Public()
-	} else {
-		log.Println(err)
-		msg = AlertMsg
+	d.Alert = &Alert{
+		Level:   AlertLvlError,
+		Message: publicMsg(err),
 	}
+}
 
-	d.Alert = &Alert{
+// AddErrorAlert appends an error alert whose message is prefixed with
+// subject, e.g. the name of the file that failed.
+func (d *Data) AddErrorAlert(subject string, err error) {
+	d.Alerts = append(d.Alerts, Alert{
 		Level:   AlertLvlError,
-		Message: msg,
+		Message: subject + ": " + publicMsg(err),
+	})
+}
+
+func publicMsg(err error) string {
+	if pub, ok := err.(PublicError); ok {
+		return pub.Public()
 	}
+
+	log.Println(err)
+	return AlertMsg
 }
 
 type PublicError interface {
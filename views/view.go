@@ -2,6 +2,7 @@ package views
 
 import (
 	"bytes"
+	"errors"
 	"html/template"
 	"io"
 	"net/http"
@@ -10,6 +11,9 @@ import (
 	"github.com/iamtraining/gallery/context"
 )
 
+// CSRFField is the name of the form field that carries the CSRF token.
+const CSRFField = "csrf_token"
+
 var (
 	LayoutDir string = "views/layouts/"
 	TmplDir   string = "views/"
@@ -25,7 +29,13 @@ func NewView(layout string, files ...string) *View {
 	addTemplatePath(files)
 	addTemplateExt(files)
 	files = append(files, extract()...)
-	t, err := template.ParseFiles(files...)
+	// request specific functions are replaced in Render, these only make
+	// the templates parse
+	t, err := template.New("").Funcs(template.FuncMap{
+		"csrfField": func() (template.HTML, error) {
+			return "", errors.New("csrfField is not implemented")
+		},
+	}).ParseFiles(files...)
 	if err != nil {
 		panic(err)
 	}
@@ -37,6 +47,10 @@ func NewView(layout string, files ...string) *View {
 }
 
 func (v *View) Render(w http.ResponseWriter, r *http.Request, data interface{}) {
+	v.RenderStatus(w, r, http.StatusOK, data)
+}
+
+func (v *View) RenderStatus(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
 	w.Header().Set("Content-Type", "text/html")
 
 	var d Data
@@ -45,21 +59,36 @@ func (v *View) Render(w http.ResponseWriter, r *http.Request, data interface{})
 	case Data:
 		d = ok
 	default:
-		data = Data{
+		d = Data{
 			Body: data,
 		}
 	}
 
 	d.User = context.GetUser(r.Context())
 
+	tpl, err := v.Tmpl.Clone()
+	if err != nil {
+		http.Error(w, "something goes wrong. view render error", http.StatusInternalServerError)
+		return
+	}
+
+	csrfToken := context.GetCSRFToken(r.Context())
+	tpl = tpl.Funcs(template.FuncMap{
+		"csrfField": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="` + CSRFField +
+				`" value="` + template.HTMLEscapeString(csrfToken) + `">`)
+		},
+	})
+
 	var buf bytes.Buffer
 
-	err := v.Tmpl.ExecuteTemplate(&buf, v.Layout, data)
+	err = tpl.ExecuteTemplate(&buf, v.Layout, d)
 	if err != nil {
 		http.Error(w, "something goes wrong. view render error", http.StatusInternalServerError)
 		return
 	}
 
+	w.WriteHeader(status)
 	io.Copy(w, &buf)
 }
 